@@ -0,0 +1,128 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"pkg.jsn.cam/abacus/middleware"
+	"pkg.jsn.cam/abacus/store"
+	"pkg.jsn.cam/abacus/utils"
+)
+
+// maxAPIKeys bounds /ratelimit/keys/list. Keys are issued by hand, one per
+// service; an instance with more has a bigger problem than a short list.
+const maxAPIKeys = 1000
+
+// CreateAPIKeyView issues a rate limit API key in one of the operator's
+// tiers, e.g. /ratelimit/keys/create?tier=partner&label=backend. The key is
+// shown once.
+func CreateAPIKeyView(c *gin.Context) {
+	tier, ok := middleware.LookupTier(c.Query("tier"))
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "tier must be one of the tiers in RATE_LIMIT_TIERS, e.g. ?tier=partner"})
+		return
+	}
+	label := c.Query("label")
+	if len(label) > maxTokenLabelLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "label must be at most " + strconv.Itoa(maxTokenLabelLength) + " characters"})
+		return
+	}
+	key, err := utils.NewAPIKey(tier.Name, label)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate API key. Try again later."})
+		return
+	}
+	err = storeNewSecret(utils.CreateAPIKeyKey(key.ID), key.Secret, func(hashedSecret string) (string, error) {
+		hashed := key
+		hashed.Secret = hashedSecret
+		return hashed.Encode()
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create API key. Try again later."})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"id": key.ID, "key": key.Key(), "tier": key.Tier, "label": key.Label, "created_at": key.CreatedAt})
+}
+
+// ListAPIKeysView lists the issued rate limit API keys, oldest first. Keys
+// given in the environment aren't listed, and secrets are never returned.
+func ListAPIKeysView(c *gin.Context) {
+	ctx := context.Background()
+	recordKeys, err := Store.ScanPrefix(ctx, utils.APIKeyPrefix, maxAPIKeys)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get data. Try again later."})
+		return
+	}
+	keys := make([]utils.APIKey, 0, len(recordKeys))
+	if len(recordKeys) > 0 {
+		records, err := Store.MGet(ctx, recordKeys...)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get data. Try again later."})
+			return
+		}
+		for _, raw := range records {
+			key, err := utils.DecodeAPIKey(raw)
+			if raw == "" || err != nil {
+				continue
+			}
+			key.Secret = ""
+			keys = append(keys, key)
+		}
+	}
+	slices.SortFunc(keys, func(a, b utils.APIKey) int {
+		return cmp.Or(cmp.Compare(a.CreatedAt, b.CreatedAt), strings.Compare(a.ID, b.ID))
+	})
+	c.JSON(http.StatusOK, gin.H{"keys": keys})
+}
+
+// RevokeAPIKeyView deletes an issued API key, /ratelimit/keys/revoke?id=ID.
+// Other instances may accept it until their cache of it expires.
+func RevokeAPIKeyView(c *gin.Context) {
+	id := c.Query("id")
+	if id == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "id is required, please provide the key's id in the fmt of ?id=KEY_ID"})
+		return
+	}
+	recordKey := utils.CreateAPIKeyKey(id)
+	if _, err := Store.Get(context.Background(), recordKey); errors.Is(err, store.ErrNotFound) || !utils.ValidTokenID(id) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke API key. Try again later."})
+		return
+	}
+	if err := Store.Del(context.Background(), recordKey); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke API key. Try again later."})
+		return
+	}
+	utils.APIKeyCacheV.Forget(recordKey)
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "message": "Revoked API key: " + id})
+}
+
+var errIDTaken = errors.New("id already taken")
+
+// storeNewSecret hashes a freshly minted API key's secret and stores
+// encode's record of it under key. The key is named by a random id; should it
+// exist anyway, it's reported as errIDTaken rather than overwritten.
+func storeNewSecret(key, secret string, encode func(hashedSecret string) (string, error)) error {
+	hashedSecret, err := utils.HashToken(secret)
+	if err != nil {
+		return err
+	}
+	record, err := encode(hashedSecret)
+	if err != nil {
+		return err
+	}
+	stored, err := Store.SetNX(context.Background(), key, record, 0)
+	if err == nil && !stored {
+		err = errIDTaken
+	}
+	return err
+}
@@ -1,3 +1,10 @@
+// Command loadtest opens many /stream connections to one counter from this
+// machine and hits it, reporting how the server holds up. Every connection
+// comes from the same IP, so the server must not cap or rate limit it, e.g.
+//
+//	SSE_MAX_PER_IP=0 SSE_MAX_CONNECTIONS=0 RATE_LIMIT_ALLOWLIST=127.0.0.1 ./abacus
+//
+// or run with -connections at most SSE_MAX_PER_IP (default 20).
 package main
 
 import (
@@ -15,7 +22,7 @@ import (
 )
 
 var (
-	targetConnections = flag.Int("connections", 10000, "Number of concurrent connections")
+	targetConnections = flag.Int("connections", 10000, "Number of concurrent connections (the server must allow this many per IP, see the package doc)")
 	serverURL         = flag.String("url", "http://localhost:8080", "Server URL")
 	testKey           = flag.String("key", "loadtest/10k", "Test key path")
 	duration          = flag.Duration("duration", 30*time.Second, "Test duration")
@@ -126,6 +133,16 @@ func main() {
 					return
 				}
 
+				if resp.StatusCode != http.StatusOK {
+					// 429: the server's per-IP or per-instance stream cap, or
+					// its rate limit.
+					resp.Body.Close()
+					atomic.AddInt32(&failedConnects, 1)
+					atomic.AddInt32(&connectionErrors, 1)
+					log.Printf("Connection refused: status %d (raise SSE_MAX_PER_IP on the server?)", resp.StatusCode)
+					return
+				}
+
 				latency := time.Since(start).Milliseconds()
 				atomic.AddInt64(&totalLatency, latency)
 				atomic.AddInt32(&latencyCount, 1)
@@ -20,6 +20,7 @@ import (
 	"github.com/redis/go-redis/v9"
 
 	"pkg.jsn.cam/abacus/middleware"
+	"pkg.jsn.cam/abacus/store"
 
 	"github.com/getsentry/sentry-go"
 	sentrygin "github.com/getsentry/sentry-go/gin"
@@ -37,6 +38,9 @@ const (
 )
 
 var (
+	// Store backs every counter read and write. Client and RateLimitClient
+	// are only set when running on Redis (nil with STORE_BACKEND=bolt).
+	Store           store.CounterStore
 	Client          *redis.Client
 	RateLimitClient *redis.Client
 	DbNum           = 0 // 0-16
@@ -54,6 +58,93 @@ func getEnv(key, defaultValue string) string {
 	return value
 }
 
+// parseDurationEnv reads a duration from the environment, falling back to def
+// (with a warning) if it is unset or invalid.
+func parseDurationEnv(key string, def time.Duration) time.Duration {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return def
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil || d <= 0 {
+		log.Printf("warn: %s=%q is not a valid duration (%v); defaulting to %s", key, raw, err, def)
+		return def
+	}
+	return d
+}
+
+// parseOptionalDurationEnv is parseDurationEnv for settings where 0 turns the
+// feature off.
+func parseOptionalDurationEnv(key string, def time.Duration) time.Duration {
+	if raw := os.Getenv(key); raw == "0" {
+		return 0
+	}
+	return parseDurationEnv(key, def)
+}
+
+// parseIntEnv reads a non-negative integer from the environment, falling back
+// to def (with a warning) if it is unset or invalid.
+func parseIntEnv(key string, def int) int {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return def
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 0 {
+		log.Printf("warn: %s=%q is not a valid count; defaulting to %d", key, raw, def)
+		return def
+	}
+	return n
+}
+
+// parsePolicyEnv reads a route group's rate limit from RATE_LIMIT_{NAME},
+// e.g. RATE_LIMIT_READ=120/10s, falling back to def (with a warning) if it is
+// unset or invalid.
+func parsePolicyEnv(def middleware.Policy) middleware.Policy {
+	key := "RATE_LIMIT_" + strings.ToUpper(def.Name)
+	raw := os.Getenv(key)
+	if raw == "" {
+		return def
+	}
+	p, err := middleware.ParsePolicy(def.Name, raw)
+	if err != nil {
+		log.Printf("warn: %s=%q is not a valid policy (%v); defaulting to %s", key, raw, err, def)
+		return def
+	}
+	return p
+}
+
+// rateLimitTiers reads the rate limit tiers (RATE_LIMIT_TIERS), the API keys
+// given in the environment (RATE_LIMIT_API_KEYS) and the client networks
+// that aren't limited at all (RATE_LIMIT_ALLOWLIST). Unlike a policy, a bad
+// value here is fatal: falling back would quietly limit the services the
+// operator meant to let through.
+func rateLimitTiers() (middleware.TierConfig, error) {
+	tiers, err := middleware.ParseTiers(os.Getenv("RATE_LIMIT_TIERS"))
+	if err != nil {
+		return middleware.TierConfig{}, fmt.Errorf("RATE_LIMIT_TIERS: %w", err)
+	}
+	keys, err := middleware.ParseAPIKeys(os.Getenv("RATE_LIMIT_API_KEYS"))
+	if err != nil {
+		return middleware.TierConfig{}, fmt.Errorf("RATE_LIMIT_API_KEYS: %w", err)
+	}
+	allowlist, err := middleware.ParseAllowlist(os.Getenv("RATE_LIMIT_ALLOWLIST"))
+	if err != nil {
+		return middleware.TierConfig{}, fmt.Errorf("RATE_LIMIT_ALLOWLIST: %w", err)
+	}
+	return middleware.TierConfig{Tiers: tiers, Keys: keys, Allowlist: allowlist}, nil
+}
+
+// parseHitQuotaEnv reads a hit quota such as 100/1s from the environment;
+// unset or invalid (with a warning) means none.
+func parseHitQuotaEnv(key string) utils.HitQuota {
+	q, err := utils.ParseHitQuota(os.Getenv(key))
+	if err != nil {
+		log.Printf("warn: %s=%q is not a valid quota (%v); no quota", key, os.Getenv(key), err)
+	}
+	return q
+}
+
 func init() {
 	utils.LoadEnv()
 
@@ -66,12 +157,31 @@ func init() {
 	// Use miniredis for testing
 	if strings.ToLower(os.Getenv("TESTING")) == "true" {
 		setupMockRedis()
+		Store = store.NewRedis(Client)
 		return
 	}
 
-	// Production Redis setup
 	Shard = namegen.New().Get()
 
+	switch backend := strings.ToLower(getEnv("STORE_BACKEND", "redis")); backend {
+	case "redis":
+	case "bolt":
+		// Single-file embedded store for small self-hosted deployments. No
+		// Redis means no RateLimitClient either; see CreateRouter.
+		path := getEnv("BOLT_PATH", "abacus.db")
+		boltStore, err := store.OpenBolt(path)
+		if err != nil {
+			log.Fatalf("Failed to open bolt store: %v", err)
+		}
+		log.Println("Using embedded bolt store at " + path)
+		Store = boltStore
+		return
+	default:
+		log.Fatalf("STORE_BACKEND must be redis or bolt, got %q", backend)
+	}
+
+	// Production Redis setup
+
 	ADDR := os.Getenv("REDIS_HOST") + ":" + os.Getenv("REDIS_PORT")
 	log.Println("Listening to redis on: " + ADDR)
 	var err error
@@ -109,6 +219,7 @@ func init() {
 	}
 	Client = redis.NewClient(poolOpts(DbNum))
 	RateLimitClient = redis.NewClient(poolOpts(DbNum + 1))
+	Store = store.NewRedis(Client)
 }
 
 func setupMockRedis() {
@@ -215,8 +326,41 @@ func initSentry() {
 	sentry.Flush(3 * time.Second)
 }
 
+// clientIPPlatforms maps TRUSTED_PLATFORM names to the header their proxy
+// puts the client's IP in. Any other value is taken as a header name.
+var clientIPPlatforms = map[string]string{
+	"fly":        "Fly-Client-IP",
+	"cloudflare": gin.PlatformCloudflare,
+}
+
+// configureClientIP decides which IP c.ClientIP() reports, which is what
+// gets rate limited, hashed into unique visitors and logged. By default
+// that's the address the connection came from: forwarding headers are only
+// believed from the proxies in TRUSTED_PROXIES (comma-separated IPs or
+// CIDRs), walking X-Forwarded-For back past them, or from the platform
+// named by TRUSTED_PLATFORM, whose proxy overwrites its header on every
+// request. Only set that when every request comes through the platform.
+func configureClientIP(r *gin.Engine) error {
+	if platform := strings.TrimSpace(os.Getenv("TRUSTED_PLATFORM")); platform != "" {
+		if header, ok := clientIPPlatforms[strings.ToLower(platform)]; ok {
+			platform = header
+		}
+		r.TrustedPlatform = http.CanonicalHeaderKey(platform)
+	}
+	var proxies []string
+	for _, proxy := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			proxies = append(proxies, proxy)
+		}
+	}
+	if r.TrustedPlatform != "" || len(proxies) > 0 {
+		log.Printf("Client IP: platform header=%q trusted proxies=%v", r.TrustedPlatform, proxies)
+	}
+	return r.SetTrustedProxies(proxies)
+}
+
 func CreateRouter() *gin.Engine {
-	utils.InitializeStatsManager(Client)
+	utils.InitializeStatsManager(Store)
 
 	// Async stdout for gin's access log so per-request writes never block on a
 	// stdout flush. Gin's Logger reads this writer when Default() runs below.
@@ -225,6 +369,9 @@ func CreateRouter() *gin.Engine {
 	gin.DefaultErrorWriter = asyncOut
 
 	r := gin.Default()
+	if err := configureClientIP(r); err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
 	r.Use(sentrygin.New(sentrygin.Options{Repanic: true}))
 
 	if gin.Mode() == gin.DebugMode {
@@ -235,7 +382,8 @@ func CreateRouter() *gin.Engine {
 	// Cors
 	corsConfig := cors.Config{
 		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "HEAD", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Length", "Content-Type", "Authorization"},
+		AllowHeaders:     []string{"Origin", "Content-Length", "Content-Type", "Authorization", middleware.APIKeyHeader},
+		ExposeHeaders:    middleware.RateLimitHeaders,
 		AllowCredentials: false,
 		AllowAllOrigins:  true,
 		MaxAge:           12 * time.Hour,
@@ -253,9 +401,44 @@ func CreateRouter() *gin.Engine {
 	}
 	route := r.Group("")
 	route.Use(middleware.Stats())
+	// Each group has its own rate limit, so e.g. reading a badge doesn't use
+	// up the budget for creating counters.
+	reads, hits, creates, authorized := route.Group(""), route.Group(""), route.Group(""), route.Group("")
 	if os.Getenv("RATE_LIMIT_ENABLED") == "true" {
-		route.Use(middleware.RateLimit(RateLimitClient))
-		log.Println("Rate limiting enabled")
+		// Limits are counted in Redis, shared by every instance, unless
+		// RATE_LIMIT_STORE=memory or there's no Redis (the bolt backend).
+		// In memory each instance enforces them on its own.
+		client := RateLimitClient
+		if strings.ToLower(getEnv("RATE_LIMIT_STORE", "redis")) == "memory" {
+			client = nil
+		}
+		if client == nil {
+			log.Println("Rate limiting in memory only; limits are per instance")
+		}
+		tiers, err := rateLimitTiers()
+		if err == nil {
+			err = middleware.InitTiers(tiers)
+		}
+		if err != nil {
+			log.Fatalf("Invalid rate limit tiers: %v", err)
+		}
+		if len(tiers.Tiers) > 0 || len(tiers.Allowlist) > 0 {
+			log.Printf("Rate limit tiers: %d, API keys in the environment: %d, allowlisted networks: %d",
+				len(tiers.Tiers), len(tiers.Keys), len(tiers.Allowlist))
+		}
+		resolveTier := middleware.ResolveTier(Store)
+		middleware.LegacyHeaders = os.Getenv("RATE_LIMIT_LEGACY_HEADERS") == "true"
+		for _, g := range []struct {
+			group  *gin.RouterGroup
+			policy middleware.Policy
+		}{
+			{reads, middleware.PolicyRead}, {hits, middleware.PolicyHit},
+			{creates, middleware.PolicyCreate}, {authorized, middleware.PolicyAdmin},
+		} {
+			p := parsePolicyEnv(g.policy)
+			g.group.Use(resolveTier, middleware.RateLimit(client, p))
+			log.Printf("Rate limiting enabled: %s=%s", p.Name, p)
+		}
 	}
 	// Define routes
 	r.NoRoute(func(c *gin.Context) {
@@ -266,41 +449,74 @@ func CreateRouter() *gin.Engine {
 	r.StaticFile("/favicon.ico", "./assets/favicon.ico")
 
 	{ // Stats Routes
-		route.GET("/healthcheck", func(context *gin.Context) {
+		reads.GET("/healthcheck", func(context *gin.Context) {
 			context.JSON(http.StatusOK, gin.H{
 				"status": "ok", "uptime": time.Since(StartTime).String()})
 		})
 
-		route.GET("/docs", func(context *gin.Context) {
+		reads.GET("/docs", func(context *gin.Context) {
 			context.Redirect(http.StatusPermanentRedirect, DocsUrl)
 		})
 
-		route.GET("/stats", StatsView)
+		reads.GET("/stats", StatsView)
 	}
 	{ // Public Routes
-		route.GET("/get/:namespace/:key", GetView)
-		route.GET("/get/:namespace/:key/shield", GetShieldView)
+		reads.GET("/get/:namespace/:key", GetView)
+		reads.GET("/get/:namespace/:key/shield", GetShieldView)
+		reads.GET("/get/:namespace/:key/endpoint", GetEndpointView)
+
+		hits.GET("/hit/:namespace/:key/shield", HitShieldView)
+		hits.GET("/hit/:namespace/:key/endpoint", HitEndpointView)
+		hits.GET("/hit/:namespace/:key", HitView)
+		reads.GET("/stream/:namespace", middleware.SSEAdmission(), middleware.SSEMiddleware(), StreamValueView)
+		reads.GET("/stream/:namespace/*key", middleware.SSEAdmission(), middleware.SSEMiddleware(), StreamValueView)
+		reads.GET("/ws/:namespace", middleware.SSEAdmission(), WebSocketView)
+		reads.GET("/ws/:namespace/*key", middleware.SSEAdmission(), WebSocketView)
 
-		route.GET("/hit/:namespace/:key/shield", HitShieldView)
-		route.GET("/hit/:namespace/:key", HitView)
-		route.GET("/stream/:namespace/*key", middleware.SSEMiddleware(), StreamValueView)
+		creates.POST("/create/:namespace/*key", CreateView)
+		creates.GET("/create/:namespace/*key", CreateView)
 
-		route.POST("/create/:namespace/*key", CreateView)
-		route.GET("/create/:namespace/*key", CreateView)
+		creates.GET("/create/", CreateRandomView)
+		creates.POST("/create/", CreateRandomView)
 
-		route.GET("/create/", CreateRandomView)
-		route.POST("/create/", CreateRandomView)
+		creates.POST("/namespace/create/:namespace", CreateNamespaceView)
+		creates.GET("/namespace/create/:namespace", CreateNamespaceView)
 
-		route.GET("/info/:namespace/*key", InfoView)
+		reads.GET("/info/:namespace/*key", InfoView)
+		reads.GET("/history/:namespace/*key", HistoryView)
 	}
-	authorized := route.Group("")
-	authorized.Use(middleware.Auth(Client))
-	{ // Authorized Routes
-		authorized.POST("/delete/:namespace/*key", DeleteView)
+	{ // Unique-visitor Routes
+		hits.GET("/unique/hit/:namespace/:key", UniqueHitView)
+		hits.GET("/unique/hit/:namespace/:key/shield", UniqueHitShieldView)
+		reads.GET("/unique/get/:namespace/:key", UniqueGetView)
+		reads.GET("/unique/get/:namespace/:key/shield", UniqueGetShieldView)
+		reads.GET("/unique/info/:namespace/*key", UniqueInfoView)
+	}
+	{ // Authorized Routes, each requiring the scope it names
+		authorized.POST("/delete/:namespace/*key", middleware.Auth(Store, utils.ScopeDelete), DeleteView)
+		authorized.POST("/rotate/:namespace/*key", middleware.Auth(Store, utils.ScopeAdmin), RotateView)
+
+		authorized.POST("/set/:namespace/*key", middleware.Auth(Store, utils.ScopeSet), SetView)
+		authorized.POST("/reset/:namespace/*key", middleware.Auth(Store, utils.ScopeSet), ResetView)
+		authorized.POST("/update/:namespace/*key", middleware.Auth(Store, utils.ScopeUpdate), UpdateByView)
+
+		authorized.GET("/settings/:namespace/*key", middleware.Auth(Store, utils.ScopeAdmin), SettingsView)
+		authorized.POST("/settings/:namespace/*key", middleware.Auth(Store, utils.ScopeAdmin), UpdateSettingsView)
+		authorized.POST("/sign/:namespace/*key", middleware.Auth(Store, utils.ScopeAdmin), SignView)
+
+		authorized.POST("/tokens/create/:namespace/*key", middleware.Auth(Store, utils.ScopeAdmin), CreateTokenView)
+		authorized.GET("/tokens/list/:namespace/*key", middleware.Auth(Store, utils.ScopeAdmin), ListTokensView)
+		authorized.POST("/tokens/revoke/:namespace/*key", middleware.Auth(Store, utils.ScopeAdmin), RevokeTokenView)
 
-		authorized.POST("/set/:namespace/*key", SetView)
-		authorized.POST("/reset/:namespace/*key", ResetView)
-		authorized.POST("/update/:namespace/*key", UpdateByView)
+		// Checked against the namespace's admin token by the views themselves.
+		authorized.GET("/namespace/settings/:namespace", NamespaceSettingsView)
+		authorized.POST("/namespace/settings/:namespace", UpdateNamespaceSettingsView)
+	}
+	if operatorToken := os.Getenv("OPERATOR_TOKEN"); operatorToken != "" { // Operator Routes
+		apiKeys := authorized.Group("/ratelimit/keys", middleware.OperatorAuth(operatorToken))
+		apiKeys.POST("/create", CreateAPIKeyView)
+		apiKeys.GET("/list", ListAPIKeysView)
+		apiKeys.POST("/revoke", RevokeAPIKeyView)
 	}
 	return r
 }
@@ -351,7 +567,52 @@ func main() {
 		getCacheMax = 100_000
 	}
 	utils.InitGetCache(getCacheTTL, getCacheMax)
+	utils.InitVisitorHasher(os.Getenv("VISITOR_SALT"))
+
+	// Optional hourly/daily time series behind /history. Off by default since
+	// it roughly triples the writes per hit.
+	utils.InitHistory(utils.HistoryConfig{
+		Enabled:         strings.ToLower(os.Getenv("HISTORY_ENABLED")) == "true",
+		HourlyRetention: parseDurationEnv("HISTORY_HOURLY_RETENTION", 7*24*time.Hour),
+		DailyRetention:  parseDurationEnv("HISTORY_DAILY_RETENTION", 365*24*time.Hour),
+	})
+	log.Printf("History: enabled=%t hourly=%s daily=%s", utils.History.Enabled, utils.History.HourlyRetention, utils.History.DailyRetention)
 	log.Printf("GetCache: ttl=%s max=%d enabled=%t", getCacheTTL, getCacheMax, utils.GetCacheV.Enabled())
+	utils.InitSSE(utils.SSEConfig{
+		Retry:       parseOptionalDurationEnv("SSE_RETRY", 5*time.Second),
+		Heartbeat:   parseOptionalDurationEnv("SSE_HEARTBEAT_INTERVAL", 15*time.Second),
+		MaxLifetime: parseOptionalDurationEnv("SSE_MAX_LIFETIME", time.Hour),
+		IdleTimeout: parseOptionalDurationEnv("SSE_IDLE_TIMEOUT", 0),
+		// Caps on concurrent streams; 0 disables either one.
+		MaxPerIP:       parseIntEnv("SSE_MAX_PER_IP", 20),
+		MaxConnections: parseIntEnv("SSE_MAX_CONNECTIONS", 20000),
+		CoalesceWindow: parseOptionalDurationEnv("SSE_COALESCE_WINDOW", 0),
+	})
+	// Operator-wide hit quotas per key and per namespace, e.g. 100/1s. Off
+	// unless set; owners can always set stricter ones of their own.
+	utils.InitHitQuotas(utils.HitQuotaConfig{
+		Key:       parseHitQuotaEnv("HIT_QUOTA_KEY"),
+		Namespace: parseHitQuotaEnv("HIT_QUOTA_NAMESPACE"),
+	})
+	log.Printf("Hit quotas: key=%q namespace=%q", utils.HitQuotas.Key, utils.HitQuotas.Namespace)
+	// The bot list keys with filter_bots use, bundled unless replaced by a
+	// newer one without waiting for a release.
+	if path := os.Getenv("BOT_LIST_PATH"); path != "" {
+		n, err := utils.InitBotList(path)
+		if err != nil {
+			log.Fatalf("Failed to load BOT_LIST_PATH: %v", err)
+		}
+		log.Printf("Bot list: %d patterns from %s", n, path)
+	}
+	log.Printf("SSE: retry=%s heartbeat=%s max_lifetime=%s idle_timeout=%s max_per_ip=%d max_connections=%d coalesce_window=%s",
+		utils.SSE.Retry, utils.SSE.Heartbeat, utils.SSE.MaxLifetime, utils.SSE.IdleTimeout, utils.SSE.MaxPerIP, utils.SSE.MaxConnections, utils.SSE.CoalesceWindow)
+
+	// Relay /stream updates between instances so subscribers see hits served
+	// by any machine. Needs Redis; on by default there.
+	if Client != nil && strings.ToLower(os.Getenv("STREAM_PUBSUB_ENABLED")) != "false" {
+		utils.InitStreamBridge(ctx, Client)
+		log.Println("Stream pub/sub bridge enabled")
+	}
 
 	utils.InitPrometheus(ctx, getEnv("METRICS_ADDR", ":9091"), Client, RateLimitClient)
 	startPprofServer(ctx)
@@ -382,11 +643,11 @@ func main() {
 	<-utils.ServerClose
 	log.Println("Stats saving confirmed complete")
 
-	// Now close Redis connections
-	log.Println("Closing Redis connections...")
-	if Client != nil {
-		if err := Client.Close(); err != nil {
-			log.Printf("Error closing Redis client: %v", err)
+	// Now close the store (and with it the main Redis client, if any)
+	log.Println("Closing store...")
+	if Store != nil {
+		if err := Store.Close(); err != nil {
+			log.Printf("Error closing store: %v", err)
 		}
 	}
 	if RateLimitClient != nil {
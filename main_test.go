@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigureClientIP(t *testing.T) {
+	clientIP := func(t *testing.T, remoteAddr string, headers map[string]string) string {
+		t.Helper()
+		gin.SetMode(gin.TestMode)
+		r := gin.New()
+		require.NoError(t, configureClientIP(r))
+		r.GET("/ip", func(c *gin.Context) { c.String(http.StatusOK, c.ClientIP()) })
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/ip", nil)
+		req.RemoteAddr = remoteAddr
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		r.ServeHTTP(w, req)
+		return w.Body.String()
+	}
+	spoofed := map[string]string{"X-Forwarded-For": "198.51.100.1", "Fly-Client-IP": "198.51.100.2", "CF-Connecting-IP": "198.51.100.3"}
+
+	t.Run("no proxies are trusted by default", func(t *testing.T) {
+		assert.Equal(t, "203.0.113.9", clientIP(t, "203.0.113.9:1234", spoofed))
+	})
+
+	t.Run("trusted proxies", func(t *testing.T) {
+		t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8, 172.16.0.1")
+		assert.Equal(t, "198.51.100.1", clientIP(t, "10.1.2.3:1234", spoofed))
+		assert.Equal(t, "198.51.100.1", clientIP(t, "10.1.2.3:1234", map[string]string{"X-Forwarded-For": "6.6.6.6, 198.51.100.1, 172.16.0.1"}),
+			"X-Forwarded-For is walked back past trusted proxies only")
+		assert.Equal(t, "203.0.113.9", clientIP(t, "203.0.113.9:1234", spoofed), "other peers can't forward")
+	})
+
+	t.Run("platforms", func(t *testing.T) {
+		t.Setenv("TRUSTED_PLATFORM", "fly")
+		assert.Equal(t, "198.51.100.2", clientIP(t, "203.0.113.9:1234", spoofed))
+		assert.Equal(t, "203.0.113.9", clientIP(t, "203.0.113.9:1234", nil), "falls back to the peer without the header")
+
+		t.Setenv("TRUSTED_PLATFORM", "cloudflare")
+		assert.Equal(t, "198.51.100.3", clientIP(t, "203.0.113.9:1234", spoofed))
+
+		t.Setenv("TRUSTED_PLATFORM", "X-Client-IP")
+		assert.Equal(t, "198.51.100.4", clientIP(t, "203.0.113.9:1234", map[string]string{"X-Client-IP": "198.51.100.4"}))
+	})
+
+	t.Run("invalid proxies", func(t *testing.T) {
+		t.Setenv("TRUSTED_PROXIES", "not-an-ip")
+		require.Error(t, configureClientIP(gin.New()))
+	})
+}
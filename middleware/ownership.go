@@ -2,44 +2,147 @@ package middleware
 
 import (
 	"context"
-	"errors"
+	"crypto/subtle"
+	"log"
 	"net/http"
 	"strings"
-
-	"github.com/redis/go-redis/v9"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"pkg.jsn.cam/abacus/store"
 	"pkg.jsn.cam/abacus/utils"
 )
 
-func Auth(Client *redis.Client) gin.HandlerFunc {
+// Token returns the admin token sent as a Bearer header or ?token=, or "".
+func Token(c *gin.Context) string {
+	if authTokenHeader := c.Request.Header.Get("Authorization"); strings.HasPrefix(authTokenHeader, "Bearer ") {
+		return strings.TrimPrefix(authTokenHeader, "Bearer ")
+	}
+	return c.DefaultQuery("token", "")
+}
+
+// Auth lets a request through if it carries the key's own admin token, the
+// namespace's admin token for a claimed namespace, or a scoped token minted
+// for the key that grants scope. Admin tokens hold every scope; routes only
+// the owner may use pass utils.ScopeAdmin.
+func Auth(s store.CounterStore, scope string) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		authToken := ""
-		authTokenHeader := c.Request.Header.Get("Authorization")
-		if !strings.HasPrefix(authTokenHeader, "Bearer ") {
-			authTokenQuery := c.DefaultQuery("token", "")
-			if authTokenQuery == "" {
-				c.JSON(http.StatusBadRequest, gin.H{"error": "Token is required, " +
-					"please provide a token in the format of a Bearer token header or ?token=ADMIN_TOKEN"})
-				c.Abort() // Abort further processing
-				return
-			}
-			authToken = authTokenQuery
-		} else {
-			authToken = strings.TrimPrefix(authTokenHeader, "Bearer ")
+		authToken := Token(c)
+		if authToken == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Token is required, " +
+				"please provide a token in the format of a Bearer token header or ?token=ADMIN_TOKEN"})
+			c.Abort() // Abort further processing
+			return
 		}
 
 		adminDBKey := utils.CreateRawAdminKey(c)
-		adminKey, err := Client.Get(context.Background(), adminDBKey).Result()
-		switch {
-		case errors.Is(err, redis.Nil):
-			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "This entry is genuine and does not have an admin key. You cannot delete it. If you wanted to delete it, you should have created it with the /create endpoint."})
-		case err != nil:
-			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify token. Try again later."})
-		case adminKey != authToken:
+		if adminDBKey == "" {
+			c.Abort() // error is handled in CreateRawAdminKey
+			return
+		}
+		dbKey := "K:" + strings.TrimPrefix(adminDBKey, "A:")
+		if status, msg := authorize(s, dbKey, authToken, scope); status != http.StatusOK {
+			c.AbortWithStatusJSON(status, gin.H{"error": msg})
+			return
+		}
+		c.Next()
+	}
+}
+
+// Authorized is Auth for handlers that only need a yes or no, such as /hit
+// letting a token with the hit scope skip the signature check.
+func Authorized(c *gin.Context, s store.CounterStore, dbKey, scope string) bool {
+	authToken := Token(c)
+	if authToken == "" {
+		return false
+	}
+	status, _ := authorize(s, dbKey, authToken, scope)
+	return status == http.StatusOK
+}
+
+// OperatorAuth guards the instance's own endpoints, such as issuing rate
+// limit API keys, with the operator's token from the environment, sent like
+// an admin token. No counter's token gets through.
+func OperatorAuth(operatorToken string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		authToken := Token(c)
+		if authToken == "" {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Token is required, " +
+				"please provide the operator token in the format of a Bearer token header or ?token=OPERATOR_TOKEN"})
+			return
+		}
+		if operatorToken == "" || subtle.ConstantTimeCompare([]byte(authToken), []byte(operatorToken)) != 1 {
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "token is invalid"})
-		default:
-			c.Next()
+			return
+		}
+		c.Next()
+	}
+}
+
+// authorize checks authToken against dbKey's tokens, returning
+// http.StatusOK or the status and message to reject the request with.
+func authorize(s store.CounterStore, dbKey, authToken, scope string) (int, string) {
+	keys := []string{utils.CreateAdminKey(dbKey), utils.CreateNamespaceAdminKey(utils.NamespaceOf(dbKey))}
+	tokenID, secret, scoped := utils.SplitScopedToken(authToken)
+	if scoped {
+		keys = append(keys, utils.CreateTokenKey(dbKey))
+	}
+	tokens, err := s.MGet(context.Background(), keys...)
+	switch {
+	case err != nil:
+		return http.StatusInternalServerError, "Failed to verify token. Try again later."
+	case tokens[0] == "" && tokens[1] == "":
+		return http.StatusBadRequest, "This entry is genuine and does not have an admin key. You cannot delete it. If you wanted to delete it, you should have created it with the /create endpoint."
+	case CheckToken(s, keys[0], tokens[0], authToken) || CheckToken(s, keys[1], tokens[1], authToken):
+		return http.StatusOK, ""
+	case !scoped || tokens[2] == "":
+		return http.StatusUnauthorized, "token is invalid"
+	}
+
+	set, err := utils.DecodeTokenSet(tokens[2])
+	i := set.Find(tokenID)
+	if err != nil || i < 0 {
+		return http.StatusUnauthorized, "token is invalid"
+	}
+	record := set[i]
+	ok, legacy := utils.VerifyToken(record.Secret, secret)
+	switch {
+	case !ok:
+		return http.StatusUnauthorized, "token is invalid"
+	case legacy:
+		if set[i].Secret, err = utils.HashToken(secret); err == nil {
+			if upgraded, err := set.Encode(); err == nil {
+				upgradeToken(s, keys[2], tokens[2], upgraded)
+			}
 		}
 	}
+	switch {
+	case record.Expired(time.Now()):
+		return http.StatusUnauthorized, "token has expired"
+	case !record.HasScope(scope):
+		return http.StatusForbidden, "token does not have the " + scope + " scope"
+	}
+	return http.StatusOK, ""
+}
+
+// CheckToken reports whether token matches stored, the value of the admin
+// token record at key. A legacy plaintext record is replaced with its hash
+// on the first match.
+func CheckToken(s store.CounterStore, key, stored, token string) bool {
+	ok, legacy := utils.VerifyToken(stored, token)
+	if ok && legacy {
+		if hashed, err := utils.HashToken(token); err == nil {
+			upgradeToken(s, key, stored, hashed)
+		}
+	}
+	return ok
+}
+
+// upgradeToken swaps a legacy record at key for its hashed form. Best effort:
+// if it fails, the next successful request tries again. The swap is
+// conditional so it can't undo a concurrent rotation.
+func upgradeToken(s store.CounterStore, key, old, upgraded string) {
+	if _, err := s.CompareAndSwap(context.Background(), key, old, upgraded); err != nil {
+		log.Printf("Failed to upgrade legacy token at %s: %v", key, err)
+	}
 }
@@ -38,17 +38,18 @@ import (
 //   - /healthcheck: scraped by Fly every 30s, would dominate the count
 //     without telling us anything about user-facing latency.
 //
-//   - /stream/:namespace/*key: SSE long-lived connections held open for
-//     the lifetime of the subscriber. Recording these in the same histogram
-//     as fast request/response endpoints would land every sample in the
-//     +Inf / 30s buckets and poison the global p50/p95/p99 math.
+//   - /stream/:namespace, /stream/:namespace/*key and the /ws equivalents:
+//     long-lived SSE/WebSocket connections held open for the lifetime of
+//     the subscriber. Recording these in the same histogram as fast
+//     request/response endpoints would land every sample in the +Inf / 30s
+//     buckets and poison the global p50/p95/p99 math.
 //
 // (/metrics isn't listed because it's served on a separate :9091 listener
 // outside the gin router, so it never reaches this middleware.)
 func Prometheus() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		switch c.FullPath() {
-		case "/healthcheck", "/stream/:namespace/*key":
+		case "/healthcheck", "/stream/:namespace", "/stream/:namespace/*key", "/ws/:namespace", "/ws/:namespace/*key":
 			c.Next()
 			return
 		}
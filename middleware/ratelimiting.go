@@ -1,56 +1,227 @@
 package middleware
 
 import (
-	"fmt"
+	"context"
 	"net/http"
 	"strconv"
+	"sync"
 	"time"
 
 	ratelimit "github.com/JGLTechnologies/gin-rate-limit"
 	"github.com/gin-gonic/gin"
 	"github.com/redis/go-redis/v9"
+
+	"pkg.jsn.cam/abacus/utils"
+)
+
+// Policy is one rate limit: Limit requests per Window from each client IP.
+// Every policy counts in its own bucket, so cheap reads don't spend the
+// budget of counter creation.
+type Policy struct {
+	Name   string // also the Redis key prefix, R:{Name}:{ip}
+	Limit  uint
+	Window time.Duration // whole seconds
+}
+
+// The route groups' policies, used unless overridden in the environment (see
+// ParsePolicy).
+var (
+	PolicyRead   = Policy{Name: "read", Limit: 120, Window: 10 * time.Second}
+	PolicyHit    = Policy{Name: "hit", Limit: 30, Window: 10 * time.Second}
+	PolicyCreate = Policy{Name: "create", Limit: 10, Window: time.Minute}
+	PolicyAdmin  = Policy{Name: "admin", Limit: 60, Window: time.Minute}
+)
+
+// Header is the policy's RateLimit-Policy value, a structured field item
+// naming it with its quota and window in seconds, e.g. "hit";q=30;w=10
+// (draft-ietf-httpapi-ratelimit-headers).
+func (p Policy) Header() string {
+	return strconv.Quote(p.Name) + ";q=" + strconv.FormatUint(uint64(p.Limit), 10) + ";w=" + strconv.Itoa(int(p.Window.Seconds()))
+}
+
+// String formats p the way ParsePolicy reads it, e.g. "30/10s".
+func (p Policy) String() string {
+	return strconv.FormatUint(uint64(p.Limit), 10) + "/" + strconv.Itoa(int(p.Window.Seconds())) + "s"
+}
+
+// ParsePolicy reads a policy written as LIMIT/WINDOW, e.g. "120/10s".
+func ParsePolicy(name, raw string) (Policy, error) {
+	limit, window, err := utils.ParseRate(raw)
+	if err != nil {
+		return Policy{}, err
+	}
+	return Policy{Name: name, Limit: uint(limit), Window: window}, nil
+}
+
+// limiters are the stores behind RateLimit by policy name, kept so requests
+// that don't pass through the middleware (hits over a WebSocket) spend from
+// the same budget. Empty while rate limiting is off.
+var (
+	limitersMu sync.RWMutex
+	limiters   = map[string]ratelimit.Store{}
 )
 
-var rateLimitPolicy string
+func keyFunc(c *gin.Context, p Policy) string {
+	if bucket := tierOf(c).bucket; bucket != "" {
+		return "R:" + p.Name + ":" + bucket
+	}
+	return "R:" + p.Name + ":" + c.ClientIP() // rate limit key in REDIS (add R: to the beginning to distinguish from other keys)
+}
 
-const rate = 10
-const limit = 30
+// LegacyHeaders also sends X-RateLimit-Limit, X-RateLimit-Remaining and
+// X-RateLimit-Reset, for clients that predate the IETF fields. As is the
+// convention for those, X-RateLimit-Reset is a Unix timestamp. Set once at
+// startup.
+var LegacyHeaders bool
 
-func keyFunc(c *gin.Context) string {
-	return "R:" + c.ClientIP() // rate limit key in REDIS (add R: to the beginning to distinguish from other keys)
-	// return c.ClientIP() + c.FullPath()
+// RateLimitHeaders are the headers RateLimit may send, for CORS to let
+// browsers read them.
+var RateLimitHeaders = []string{
+	"RateLimit", "RateLimit-Policy", "RateLimit-Remaining", "RateLimit-Reset", "Retry-After",
+	"X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset",
+}
 
+// resetSeconds is the delta-seconds until reset, rounded up so a client that
+// waits it out is never early.
+func resetSeconds(reset time.Time) int64 {
+	d := time.Until(reset)
+	if d <= 0 {
+		return 0
+	}
+	return int64((d + time.Second - 1) / time.Second)
 }
-func errorHandler(c *gin.Context, info ratelimit.Info) {
+
+func errorHandler(c *gin.Context, info ratelimit.Info, p Policy) {
+	retryAfter := strconv.FormatInt(max(resetSeconds(info.ResetTime), 1), 10)
+	c.Header("Retry-After", retryAfter)
 	c.JSON(http.StatusTooManyRequests, gin.H{
-		"error": "Too many requests. Try again in " + time.Until(info.ResetTime).String(),
+		"error": "Too many requests. Try again in " + retryAfter + "s",
 	})
-	c.Header("Retry-After", time.Until(info.ResetTime).String())
-	c.Header("RateLimit-Reset", fmt.Sprintf("%d", info.ResetTime.Unix()))
-	c.Header("RateLimit-Remaining", "0")
-	c.Header("RateLimit-Policy", rateLimitPolicy)
+}
 
+// beforeResponse describes the client's budget under p on every response,
+// rate limited or not: RateLimit-Policy with the policy, RateLimit with
+// what's left of it, e.g. "hit";r=12;t=4 for 12 requests in the next 4
+// seconds, and the same as the older RateLimit-Remaining and RateLimit-Reset.
+func beforeResponse(c *gin.Context, info ratelimit.Info, p Policy) {
+	remaining := uint64(info.RemainingHits)
+	if info.RateLimited {
+		remaining = 0
+	}
+	r, t := strconv.FormatUint(remaining, 10), strconv.FormatInt(resetSeconds(info.ResetTime), 10)
+	c.Header("RateLimit-Policy", p.Header())
+	c.Header("RateLimit", strconv.Quote(p.Name)+";r="+r+";t="+t)
+	c.Header("RateLimit-Remaining", r)
+	c.Header("RateLimit-Reset", t)
+	if LegacyHeaders {
+		c.Header("X-RateLimit-Limit", strconv.FormatUint(uint64(p.Limit), 10))
+		c.Header("X-RateLimit-Remaining", r)
+		c.Header("X-RateLimit-Reset", strconv.FormatInt(info.ResetTime.Unix(), 10))
+	}
 }
-func beforeResponse(c *gin.Context, info ratelimit.Info) {
-	c.Header("RateLimit-Remaining", fmt.Sprintf("%v", info.RemainingHits))
-	c.Header("RateLimit-Reset", fmt.Sprintf("%d", info.ResetTime.Unix()))
-	c.Header("RateLimit-Policy", rateLimitPolicy)
+
+// localMaxEntries bounds the clients each policy's in-process limiter
+// tracks; see utils.TokenBuckets.
+const localMaxEntries = 50_000
+
+// redisLimitTimeout bounds the Redis round trip of a rate limit check. Past
+// it the in-process limiter decides, so a struggling Redis can't hold up
+// every request behind its pool timeout.
+const redisLimitTimeout = 100 * time.Millisecond
+
+// limiterStore is the ratelimit.Store behind RateLimit. A request first
+// spends a token from its client's in-process bucket; one this instance
+// alone has seen exceed the limit is turned away without asking Redis.
+// Otherwise Redis, shared by every instance, decides, unless it fails, in
+// which case the local answer stands. Without a client it's local only.
+type limiterStore struct {
+	policy Policy
+	// locals are the in-process limiters by tier name, "" being requests
+	// without an API key. Each tier's limit differs, so each needs its own.
+	locals map[string]*utils.TokenBuckets
+	client *redis.Client
 }
 
-func RateLimit(client *redis.Client) gin.HandlerFunc {
-	// This makes it so each ip can only make 30 requests per 10 seconds
-	rateLimitPolicy = strconv.Itoa(limit) + ";w=" + strconv.Itoa(rate) // paragraph 2.1 of the IETF Draft
-	store := ratelimit.RedisStore(&ratelimit.RedisOptions{
-		RedisClient: client,
-		Rate:        time.Second * rate,
-		Limit:       limit,
-	})
+func newLimiterStore(p Policy, client *redis.Client) *limiterStore {
+	s := &limiterStore{policy: p, locals: map[string]*utils.TokenBuckets{}, client: client}
+	s.locals[""] = utils.NewTokenBuckets(p.Limit, p.Window, localMaxEntries)
+	for name, t := range tiers.byName {
+		if !t.Unlimited {
+			tp := t.apply(p)
+			s.locals[name] = utils.NewTokenBuckets(tp.Limit, tp.Window, localMaxEntries)
+		}
+	}
+	return s
+}
+
+func (s *limiterStore) Limit(key string, c *gin.Context) ratelimit.Info {
+	now := time.Now()
+	rt := tierOf(c)
+	p := rt.apply(s.policy)
+	local := s.locals[rt.Name]
+	if local == nil { // a tier the operator has since removed: default limits
+		local = s.locals[""]
+	}
+	allowed, remaining, reset := local.Take(key, now)
+	localInfo := ratelimit.Info{Limit: p.Limit, RateLimited: !allowed, ResetTime: reset, RemainingHits: remaining}
+	if s.client == nil || !allowed {
+		utils.RateLimitDecisionsLocal.Add(1)
+		return localInfo
+	}
+	info, err := s.redisLimit(c.Request.Context(), key, p, now)
+	if err != nil {
+		utils.RateLimitDecisionsFallback.Add(1)
+		return localInfo
+	}
+	utils.RateLimitDecisionsRedis.Add(1)
+	return info
+}
+
+// redisLimit counts a request in its client's current fixed window,
+// R:{policy}:{ip}:{window} (or R:{policy}:key:{id}:{window} for an API
+// key), with window the index of the window since the epoch. p is the
+// store's policy as it applies to the request's tier.
+func (s *limiterStore) redisLimit(ctx context.Context, key string, p Policy, now time.Time) (ratelimit.Info, error) {
+	ctx, cancel := context.WithTimeout(ctx, redisLimitTimeout)
+	defer cancel()
+	window := int64(p.Window / time.Second)
+	current := now.Unix() / window
+	windowKey := key + ":" + strconv.FormatInt(current, 10)
+	hits, err := utils.IncrWithTTL.Run(ctx, s.client, []string{windowKey}, p.Window.Milliseconds()).Int64()
+	if err != nil {
+		return ratelimit.Info{}, err
+	}
+	info := ratelimit.Info{Limit: p.Limit, ResetTime: time.Unix((current+1)*window, 0)}
+	if hits > int64(p.Limit) {
+		info.RateLimited = true
+	} else {
+		info.RemainingHits = p.Limit - uint(hits) // #nosec G115 -- 0 < hits <= Limit
+	}
+	return info, nil
+}
+
+// RateLimit limits each client IP to p, counting in Redis with an
+// in-process limiter in front of it (see limiterStore). A nil client limits
+// in memory only, which is exact for a single instance; with several, each
+// enforces p on its own. Requests ResolveTier put in a tier are limited per
+// API key at the tier's multiple of p, or not at all.
+func RateLimit(client *redis.Client, p Policy) gin.HandlerFunc {
+	store := newLimiterStore(p, client)
+	limitersMu.Lock()
+	limiters[p.Name] = store
+	limitersMu.Unlock()
 	mw := RateLimiter(store, &ratelimit.Options{
-		ErrorHandler:   errorHandler,
-		KeyFunc:        keyFunc,
-		BeforeResponse: beforeResponse,
+		ErrorHandler:   func(c *gin.Context, info ratelimit.Info) { errorHandler(c, info, tierOf(c).apply(p)) },
+		KeyFunc:        func(c *gin.Context) string { return keyFunc(c, p) },
+		BeforeResponse: func(c *gin.Context, info ratelimit.Info) { beforeResponse(c, info, tierOf(c).apply(p)) },
 	})
-	return mw
+	return func(c *gin.Context) {
+		if tierOf(c).Unlimited {
+			c.Next()
+			return
+		}
+		mw(c)
+	}
 }
 func RateLimiter(s ratelimit.Store, options *ratelimit.Options) gin.HandlerFunc {
 	if options == nil {
@@ -71,3 +242,17 @@ func RateLimiter(s ratelimit.Store, options *ratelimit.Options) gin.HandlerFunc
 		}
 	}
 }
+
+// Allow charges one request from c's client IP or API key against p's
+// budget and reports whether it's within it. Always true while p isn't
+// enforced, or for requests in an unlimited tier.
+func Allow(c *gin.Context, p Policy) (ratelimit.Info, bool) {
+	limitersMu.RLock()
+	limiter := limiters[p.Name]
+	limitersMu.RUnlock()
+	if limiter == nil || tierOf(c).Unlimited {
+		return ratelimit.Info{}, true
+	}
+	info := limiter.Limit(keyFunc(c, p), c)
+	return info, !info.RateLimited
+}
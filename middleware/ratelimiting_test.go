@@ -0,0 +1,143 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/require"
+
+	"pkg.jsn.cam/abacus/utils"
+)
+
+func TestParsePolicy(t *testing.T) {
+	p, err := ParsePolicy("read", "120/10s")
+	require.NoError(t, err)
+	require.Equal(t, Policy{Name: "read", Limit: 120, Window: 10 * time.Second}, p)
+	require.Equal(t, `"read";q=120;w=10`, p.Header())
+	require.Equal(t, "120/10s", p.String())
+
+	p, err = ParsePolicy("create", "5/1m")
+	require.NoError(t, err)
+	require.Equal(t, `"create";q=5;w=60`, p.Header())
+	require.Equal(t, "5/60s", p.String())
+
+	for _, raw := range []string{"", "120", "0/10s", "-1/10s", "x/10s", "10/", "10/500ms", "10/1.5s", "10/-10s"} {
+		_, err := ParsePolicy("read", raw)
+		require.Error(t, err, raw)
+	}
+}
+
+func TestRateLimitPoliciesCountSeparately(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+
+	strict := Policy{Name: "test-strict", Limit: 2, Window: time.Minute}
+	generous := Policy{Name: "test-generous", Limit: 100, Window: 10 * time.Second}
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+	r.GET("/strict", RateLimit(client, strict), ok)
+	r.GET("/generous", RateLimit(client, generous), ok)
+
+	do := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = "203.0.113.7:1234"
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		w := do("/strict")
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, `"test-strict";q=2;w=60`, w.Header().Get("RateLimit-Policy"))
+	}
+	w := do("/strict")
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+	require.Equal(t, "0", w.Header().Get("RateLimit-Remaining"))
+	require.Regexp(t, `^"test-strict";r=0;t=\d+$`, w.Header().Get("RateLimit"))
+	retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After"))
+	require.NoError(t, err, "Retry-After is whole seconds")
+	require.True(t, retryAfter >= 1 && retryAfter <= 60, retryAfter)
+	require.Equal(t, w.Header().Get("RateLimit-Reset"), w.Header().Get("Retry-After"), "RateLimit-Reset is delta-seconds too")
+	require.Empty(t, w.Header().Get("X-RateLimit-Limit"), "legacy headers are opt-in")
+
+	// The strict budget is spent; the generous one is untouched.
+	w = do("/generous")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, `"test-generous";q=100;w=10`, w.Header().Get("RateLimit-Policy"))
+	require.Regexp(t, `^"test-generous";r=99;t=([1-9]|10)$`, w.Header().Get("RateLimit"))
+	require.Equal(t, "99", w.Header().Get("RateLimit-Remaining"))
+
+	LegacyHeaders = true
+	t.Cleanup(func() { LegacyHeaders = false })
+	w = do("/generous")
+	require.Equal(t, "100", w.Header().Get("X-RateLimit-Limit"))
+	require.Equal(t, "98", w.Header().Get("X-RateLimit-Remaining"))
+	reset, err := strconv.ParseInt(w.Header().Get("X-RateLimit-Reset"), 10, 64)
+	require.NoError(t, err)
+	require.InDelta(t, time.Now().Unix()+5, reset, 6, "a Unix timestamp")
+	require.Regexp(t, `^"test-generous";r=98;t=`, w.Header().Get("RateLimit"), "alongside the IETF fields")
+	var keys []string
+	for _, k := range mr.Keys() {
+		keys = append(keys, k[:strings.LastIndexByte(k, ':')])
+	}
+	require.ElementsMatch(t, []string{"R:test-strict:203.0.113.7", "R:test-generous:203.0.113.7"}, keys)
+
+	// Allow spends from the named policy's budget.
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+	c.Request.RemoteAddr = "203.0.113.7:1234"
+	_, allowed := Allow(c, strict)
+	require.False(t, allowed)
+	info, allowed := Allow(c, generous)
+	require.True(t, allowed)
+	require.Equal(t, uint(97), info.RemainingHits)
+}
+
+func TestRateLimitWithoutRedis(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr(), MaxRetries: -1})
+	t.Cleanup(func() { client.Close() })
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+	r.GET("/redis", RateLimit(client, Policy{Name: "test-fallback", Limit: 3, Window: time.Minute}), ok)
+	r.GET("/memory", RateLimit(nil, Policy{Name: "test-memory", Limit: 3, Window: time.Minute}), ok)
+	do := func(path string) int {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = "203.0.113.8:1234"
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	redisBefore := utils.RateLimitDecisionsRedis.Load()
+	require.Equal(t, http.StatusOK, do("/redis"))
+	require.Equal(t, redisBefore+1, utils.RateLimitDecisionsRedis.Load())
+
+	// Redis goes away: the in-process limiter takes over, with the token
+	// already spent above.
+	mr.Close()
+	fallbackBefore := utils.RateLimitDecisionsFallback.Load()
+	require.Equal(t, http.StatusOK, do("/redis"))
+	require.Equal(t, http.StatusOK, do("/redis"))
+	require.Equal(t, fallbackBefore+2, utils.RateLimitDecisionsFallback.Load())
+	localBefore := utils.RateLimitDecisionsLocal.Load()
+	require.Equal(t, http.StatusTooManyRequests, do("/redis"), "limiting doesn't stop with Redis")
+	require.Equal(t, localBefore+1, utils.RateLimitDecisionsLocal.Load(), "over the limit locally, Redis isn't asked")
+
+	for i := 0; i < 3; i++ {
+		require.Equal(t, http.StatusOK, do("/memory"))
+	}
+	require.Equal(t, http.StatusTooManyRequests, do("/memory"))
+}
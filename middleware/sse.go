@@ -1,9 +1,18 @@
 package middleware
 
 import (
+	"net/http"
+	"strconv"
+	"time"
+
 	"github.com/gin-gonic/gin"
+	"pkg.jsn.cam/abacus/utils"
 )
 
+// sseRetryAfter is the Retry-After sent with a 429 from SSEAdmission. There's
+// no telling when another stream will close, so it's just a sensible backoff.
+const sseRetryAfter = 30 * time.Second
+
 func SSEMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		c.Writer.Header().Set("Content-Type", "text/event-stream")
@@ -14,3 +23,19 @@ func SSEMiddleware() gin.HandlerFunc {
 		c.Next()
 	}
 }
+
+// SSEAdmission caps concurrent streams per client IP and per instance (see
+// utils.SSEConfig), answering 429 once a cap is hit. The slot is held until
+// the stream handler returns.
+func SSEAdmission() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ip := c.ClientIP()
+		if err := utils.ValueEventServer.Admit(ip); err != nil {
+			c.Header("Retry-After", strconv.Itoa(int(sseRetryAfter.Seconds())))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "Too many requests: " + err.Error() + "."})
+			return
+		}
+		defer utils.ValueEventServer.Release(ip)
+		c.Next()
+	}
+}
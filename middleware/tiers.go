@@ -0,0 +1,232 @@
+package middleware
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"pkg.jsn.cam/abacus/store"
+	"pkg.jsn.cam/abacus/utils"
+)
+
+// APIKeyHeader carries a rate limit API key, for services that send more
+// traffic than one client IP is allowed, e.g. a backend proxying hits.
+const APIKeyHeader = "X-API-Key"
+
+// Tier is what an API key is rate limited under: every policy's limit times
+// Multiplier, or no limit at all.
+type Tier struct {
+	Name       string
+	Multiplier uint
+	Unlimited  bool
+}
+
+// apply returns p as it applies to requests under t.
+func (t Tier) apply(p Policy) Policy {
+	if t.Multiplier > 1 {
+		p.Limit *= t.Multiplier
+	}
+	return p
+}
+
+// ParseTiers reads tiers written as NAME=MULTIPLIER or NAME=unlimited,
+// comma-separated, e.g. "partner=10,internal=unlimited".
+func ParseTiers(raw string) (map[string]Tier, error) {
+	tiers := map[string]Tier{}
+	for _, entry := range splitList(raw) {
+		name, value, ok := strings.Cut(entry, "=")
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("%q: expected NAME=MULTIPLIER or NAME=unlimited", entry)
+		}
+		if _, dup := tiers[name]; dup {
+			return nil, fmt.Errorf("tier %q is defined twice", name)
+		}
+		if strings.EqualFold(value, "unlimited") {
+			tiers[name] = Tier{Name: name, Unlimited: true}
+			continue
+		}
+		multiplier, err := strconv.ParseUint(value, 10, 16)
+		if err != nil || multiplier == 0 {
+			return nil, fmt.Errorf("tier %q: the multiplier must be a positive number or unlimited", name)
+		}
+		tiers[name] = Tier{Name: name, Multiplier: uint(multiplier)}
+	}
+	return tiers, nil
+}
+
+// ParseAPIKeys reads API keys given in the environment, written as KEY=TIER,
+// comma-separated. Keys issued through /ratelimit/keys live in the store
+// instead.
+func ParseAPIKeys(raw string) (map[string]string, error) {
+	keys := map[string]string{}
+	for _, entry := range splitList(raw) {
+		key, tier, ok := strings.Cut(entry, "=")
+		key, tier = strings.TrimSpace(key), strings.TrimSpace(tier)
+		if !ok || key == "" || tier == "" {
+			return nil, fmt.Errorf("expected KEY=TIER, got an entry of %d characters", len(entry)) // don't log the key
+		}
+		keys[key] = tier
+	}
+	return keys, nil
+}
+
+// ParseAllowlist reads client IPs and CIDRs, comma-separated, that are never
+// rate limited.
+func ParseAllowlist(raw string) ([]netip.Prefix, error) {
+	var allowlist []netip.Prefix
+	for _, entry := range splitList(raw) {
+		if prefix, err := netip.ParsePrefix(entry); err == nil {
+			allowlist = append(allowlist, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an IP or CIDR", entry)
+		}
+		allowlist = append(allowlist, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return allowlist, nil
+}
+
+func splitList(raw string) []string {
+	var entries []string
+	for _, entry := range strings.Split(raw, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// TierConfig is the operator's rate limit tiers and who gets them.
+type TierConfig struct {
+	Tiers     map[string]Tier
+	Keys      map[string]string // API key to tier name
+	Allowlist []netip.Prefix
+}
+
+// tiers is set once at startup by InitTiers. Keys are held by their SHA-256,
+// so looking one up doesn't compare secrets byte by byte.
+var tiers struct {
+	byName    map[string]Tier
+	keys      map[[sha256.Size]byte]string
+	allowlist []netip.Prefix
+}
+
+// InitTiers installs cfg. Every key must name one of cfg.Tiers.
+func InitTiers(cfg TierConfig) error {
+	keys := make(map[[sha256.Size]byte]string, len(cfg.Keys))
+	for key, tier := range cfg.Keys {
+		if _, ok := cfg.Tiers[tier]; !ok {
+			return fmt.Errorf("an API key names tier %q, which isn't defined", tier)
+		}
+		keys[sha256.Sum256([]byte(key))] = tier
+	}
+	tiers.byName, tiers.keys, tiers.allowlist = cfg.Tiers, keys, cfg.Allowlist
+	return nil
+}
+
+// LookupTier returns the tier called name, if the operator defined one.
+func LookupTier(name string) (Tier, bool) {
+	t, ok := tiers.byName[name]
+	return t, ok
+}
+
+// allowlisted is the tier of requests from RATE_LIMIT_ALLOWLIST.
+var allowlisted = requestTier{Tier: Tier{Name: "allowlist", Unlimited: true}}
+
+// requestTier is how ResolveTier sorted a request: the tier it's limited
+// under and the bucket it counts in, "key:{id}" for an API key or "" for its
+// client IP.
+type requestTier struct {
+	Tier
+	bucket string
+}
+
+const tierContextKey = "abacus.ratelimit_tier"
+
+// tierOf returns what ResolveTier found for c; the zero value, limited per
+// IP at the policies' own limits, if it didn't run.
+func tierOf(c *gin.Context) requestTier {
+	if v, ok := c.Get(tierContextKey); ok {
+		return v.(requestTier)
+	}
+	return requestTier{}
+}
+
+// ResolveTier sorts each request into a tier for RateLimit, which must come
+// after it. Requests without an API key are limited per client IP, unless
+// the IP is allowlisted. A key that isn't valid is rejected rather than
+// quietly limited per IP, so a misconfigured service finds out before its
+// traffic does.
+func ResolveTier(s store.CounterStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader(APIKeyHeader)
+		if key == "" {
+			if len(tiers.allowlist) > 0 {
+				if addr, err := netip.ParseAddr(c.ClientIP()); err == nil {
+					for _, prefix := range tiers.allowlist {
+						if prefix.Contains(addr.Unmap()) {
+							c.Set(tierContextKey, allowlisted)
+							break
+						}
+					}
+				}
+			}
+			c.Next()
+			return
+		}
+		rt, status, msg := lookupAPIKey(s, key)
+		if status != http.StatusOK {
+			c.AbortWithStatusJSON(status, gin.H{"error": msg})
+			return
+		}
+		c.Set(tierContextKey, rt)
+		c.Next()
+	}
+}
+
+// lookupAPIKey finds key among the keys in the environment, then those
+// issued through /ratelimit/keys, returning http.StatusOK or the status and
+// message to reject the request with.
+func lookupAPIKey(s store.CounterStore, key string) (requestTier, int, string) {
+	digest := sha256.Sum256([]byte(key))
+	if name, ok := tiers.keys[digest]; ok {
+		return requestTier{Tier: tiers.byName[name], bucket: "key:" + hex.EncodeToString(digest[:8])}, http.StatusOK, ""
+	}
+	invalid := "API key is invalid. Send a key issued by this instance's operator in the " + APIKeyHeader + " header, or none at all."
+	id, secret, ok := utils.SplitScopedToken(key)
+	if !ok {
+		return requestTier{}, http.StatusUnauthorized, invalid
+	}
+	recordKey := utils.CreateAPIKeyKey(id)
+	raw, notFound, err := utils.APIKeyCacheV.Fetch(recordKey, func() (string, bool, error) {
+		return store.GetThrough(context.Background(), s, recordKey)
+	})
+	if err != nil {
+		return requestTier{}, http.StatusInternalServerError, "Failed to verify API key. Try again later."
+	}
+	if notFound {
+		return requestTier{}, http.StatusUnauthorized, invalid
+	}
+	record, err := utils.DecodeAPIKey(raw)
+	if err != nil {
+		return requestTier{}, http.StatusInternalServerError, "Failed to verify API key. Try again later."
+	}
+	if ok, _ := utils.VerifyToken(record.Secret, secret); !ok {
+		return requestTier{}, http.StatusUnauthorized, invalid
+	}
+	tier, ok := tiers.byName[record.Tier]
+	if !ok { // the operator has since removed the tier: default limits, still per key
+		tier = Tier{Name: record.Tier}
+	}
+	return requestTier{Tier: tier, bucket: "key:" + id}, http.StatusOK, ""
+}
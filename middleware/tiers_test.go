@@ -0,0 +1,126 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/require"
+
+	"pkg.jsn.cam/abacus/store"
+	"pkg.jsn.cam/abacus/utils"
+)
+
+func TestParseTiers(t *testing.T) {
+	tiers, err := ParseTiers(" partner=10, internal=unlimited ")
+	require.NoError(t, err)
+	require.Equal(t, map[string]Tier{
+		"partner":  {Name: "partner", Multiplier: 10},
+		"internal": {Name: "internal", Unlimited: true},
+	}, tiers)
+	require.Equal(t, uint(300), tiers["partner"].apply(PolicyHit).Limit)
+
+	tiers, err = ParseTiers("")
+	require.NoError(t, err)
+	require.Empty(t, tiers)
+
+	for _, raw := range []string{"partner", "=10", "partner=0", "partner=x", "partner=-1", "partner=10,partner=20"} {
+		_, err := ParseTiers(raw)
+		require.Error(t, err, raw)
+	}
+
+	keys, err := ParseAPIKeys("secret-one=partner,secret-two=internal")
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"secret-one": "partner", "secret-two": "internal"}, keys)
+	_, err = ParseAPIKeys("secret-one")
+	require.Error(t, err)
+	require.NotContains(t, err.Error(), "secret-one", "keys stay out of logs")
+	require.Error(t, InitTiers(TierConfig{Tiers: tiers, Keys: map[string]string{"secret": "gold"}}), "keys must name a defined tier")
+
+	allowlist, err := ParseAllowlist("10.1.2.3/8, 192.0.2.1, ::1")
+	require.NoError(t, err)
+	require.Equal(t, []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("192.0.2.1/32"), netip.MustParsePrefix("::1/128"),
+	}, allowlist)
+	_, err = ParseAllowlist("10.0.0.0/8,localhost")
+	require.Error(t, err)
+}
+
+func TestRateLimitTiers(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	s := store.NewRedis(client)
+
+	tiers, err := ParseTiers("partner=3,internal=unlimited")
+	require.NoError(t, err)
+	require.NoError(t, InitTiers(TierConfig{
+		Tiers:     tiers,
+		Keys:      map[string]string{"env-key": "partner", "env-internal": "internal"},
+		Allowlist: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")},
+	}))
+	t.Cleanup(func() { _ = InitTiers(TierConfig{}) })
+
+	// An issued key, stored the way /ratelimit/keys/create stores it.
+	issued, err := utils.NewAPIKey("partner", "")
+	require.NoError(t, err)
+	record := issued
+	record.Secret, err = utils.HashToken(issued.Secret)
+	require.NoError(t, err)
+	raw, err := record.Encode()
+	require.NoError(t, err)
+	require.NoError(t, client.Set(context.Background(), utils.CreateAPIKeyKey(issued.ID), raw, 0).Err())
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/", ResolveTier(s), RateLimit(client, Policy{Name: "test-tiers", Limit: 2, Window: time.Minute}),
+		func(c *gin.Context) { c.Status(http.StatusOK) })
+	do := func(remoteAddr, key string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteAddr
+		if key != "" {
+			req.Header.Set(APIKeyHeader, key)
+		}
+		r.ServeHTTP(w, req)
+		return w
+	}
+	// allowed counts the requests let through out of n.
+	allowed := func(remoteAddr, key string, n int) int {
+		ok := 0
+		for i := 0; i < n; i++ {
+			if do(remoteAddr, key).Code == http.StatusOK {
+				ok++
+			}
+		}
+		return ok
+	}
+
+	require.Equal(t, 2, allowed("203.0.113.10:1234", "", 5), "no key: the policy's limit, per IP")
+	require.Equal(t, 6, allowed("203.0.113.10:1234", "env-key", 10), "a key in the tier gets three times as many, in its own bucket")
+	require.Equal(t, 6, allowed("203.0.113.11:1234", issued.Key(), 10), "issued keys too")
+	require.Equal(t, 0, allowed("203.0.113.12:1234", issued.Key(), 1), "the bucket follows the key, not the IP")
+	w := do("203.0.113.13:1234", issued.Key())
+	require.Equal(t, `"test-tiers";q=6;w=60`, w.Header().Get("RateLimit-Policy"))
+
+	require.Equal(t, 10, allowed("203.0.113.10:1234", "env-internal", 10), "unlimited")
+	require.Empty(t, do("203.0.113.10:1234", "env-internal").Header().Get("RateLimit-Policy"))
+	require.Equal(t, 10, allowed("192.0.2.50:1234", "", 10), "allowlisted")
+
+	for _, key := range []string{"not-a-key", issued.ID + ".wrong-secret", "missing.secret"} {
+		w := do("203.0.113.14:1234", key)
+		require.Equal(t, http.StatusUnauthorized, w.Code, key)
+	}
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+	c.Set(tierContextKey, allowlisted)
+	_, ok := Allow(c, Policy{Name: "test-tiers"})
+	require.True(t, ok, "Allow honours the tier")
+}
@@ -3,205 +3,119 @@ package main
 import (
 	"context"
 	"errors"
-	"fmt"
-	"io"
 	"log"
 	"math"
 	"net/http"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
-	"github.com/redis/go-redis/v9"
-
 	"github.com/google/uuid"
 
+	"pkg.jsn.cam/abacus/middleware"
+	"pkg.jsn.cam/abacus/store"
 	"pkg.jsn.cam/abacus/utils"
 
 	"github.com/gin-gonic/gin"
 )
 
-func StreamValueView(c *gin.Context) {
+// hitKey increments the counter named by the request and returns its db key
+// and new value. A hit over the key's quota, from a bot on a key that
+// filters them or repeated within the key's cooldown isn't counted: counted
+// is false and val is the current value, so badges keep rendering. ok=false
+// means a response has already been written.
+func hitKey(c *gin.Context) (dbKey string, val int64, counted, ok bool) {
 	namespace, key := utils.GetNamespaceKey(c)
 	if namespace == "" || key == "" {
-		c.AbortWithStatus(http.StatusBadRequest)
-		return
+		return "", 0, false, false
 	}
-
-	dbKey := utils.CreateKey(c, namespace, key, false)
-	if dbKey == "" {
-		c.AbortWithStatus(http.StatusBadRequest)
-		return
+	dbKey = utils.CreateKey(c, namespace, key, false)
+	if dbKey == "" { // error is handled in CreateKey
+		return "", 0, false, false
 	}
-
-	// Set SSE headers
-	c.Header("Content-Type", "text/event-stream")
-	c.Header("Cache-Control", "no-cache")
-	c.Header("Connection", "keep-alive")
-
-	// Initialize client channel with a buffer to prevent blocking
-	clientChan := make(chan int, 100)
-
-	// Create a context that's canceled when the client disconnects
-	ctx := c.Request.Context()
-
-	// Add this client to the event server for this specific key
-	utils.ValueEventServer.NewClients <- utils.KeyClientPair{
-		Key:    dbKey,
-		Client: clientChan,
+	if !checkHitSettings(c, dbKey) {
+		return "", 0, false, false
 	}
-
-	// Track if cleanup has been done
-	var cleanupDone bool
-	var cleanupMutex sync.Mutex
-
-	// Ensure client is always removed when handler exits
-	defer func() {
-		cleanupMutex.Lock()
-		if !cleanupDone {
-			cleanupDone = true
-			cleanupMutex.Unlock()
-
-			// Signal the event server to remove this client
-			select {
-			case utils.ValueEventServer.ClosedClients <- utils.KeyClientPair{Key: dbKey, Client: clientChan}:
-				// Successfully sent cleanup signal
-			case <-time.After(500 * time.Millisecond):
-				// Timed out waiting to send cleanup signal
-				log.Printf("Warning: Timed out sending cleanup signal for %s", dbKey)
-			}
-		} else {
-			cleanupMutex.Unlock()
-		}
-	}()
-
-	// Monitor for client disconnection in a separate goroutine
-	go func() {
-		<-ctx.Done() // Wait for context cancellation (client disconnected)
-
-		cleanupMutex.Lock()
-		if !cleanupDone {
-			cleanupDone = true
-			cleanupMutex.Unlock()
-
-			log.Printf("Client disconnected for key %s, cleaning up", dbKey)
-
-			// Signal the event server to remove this client
-			select {
-			case utils.ValueEventServer.ClosedClients <- utils.KeyClientPair{Key: dbKey, Client: clientChan}:
-				// Successfully sent cleanup signal
-			case <-time.After(500 * time.Millisecond):
-				// Timed out waiting to send cleanup signal
-				log.Printf("Warning: Timed out sending cleanup signal for %s after disconnect", dbKey)
-			}
-		} else {
-			cleanupMutex.Unlock()
+	counts, err := countsHit(c, dbKey)
+	if err == nil && !counts {
+		val, _, err = cachedValue(dbKey)
+		if err == nil {
+			return dbKey, val, false, true
 		}
-	}()
-
-	// Send initial value. redis.Nil = key doesn't exist yet (legit, just stream
-	// future updates). Any other error gets logged so it isn't silently lost.
-	initialVal, err := Client.Get(context.Background(), dbKey).Result()
-	if err != nil && !errors.Is(err, redis.Nil) {
-		log.Printf("StreamValueView initial GET for %s failed: %v", dbKey, err)
-	} else if count, convErr := strconv.Atoi(initialVal); convErr == nil {
-		// Keep your exact format
-		if _, werr := c.Writer.WriteString(fmt.Sprintf("data: {\"value\":%d}\n\n", count)); werr != nil {
-			log.Printf("Error writing to client: %v", werr)
-			return
-		}
-		c.Writer.Flush()
 	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get data. Try again later."})
+		return "", 0, false, false
+	}
+	val, err = incrKey(dbKey)
+	if errors.Is(err, errValueTooLarge) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Value is too large. Max value is " + strconv.Itoa(math.
+			MaxInt), "message": "If you are seeing this error and have a legitimate use case, please contact me @ abacus@jasoncameron.dev"})
+		return "", 0, false, false
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get data. Try again later."})
+		return "", 0, false, false
+	}
+	return dbKey, val, true, true
+}
 
-	// Stream updates
-	c.Stream(func(w io.Writer) bool {
-		select {
-		case <-ctx.Done():
-			return false
-		case count, ok := <-clientChan:
-			if !ok {
-				return false
-			}
-			// Keep your exact format
-			_, err := c.Writer.WriteString(fmt.Sprintf("data: {\"value\":%d}\n\n", count))
-			if err != nil {
-				log.Printf("Error writing to client: %v", err)
-				return false
-			}
-			c.Writer.Flush()
-			return true
-		}
+// cachedValue reads dbKey through the get micro-cache, for answers that
+// don't need to be exact: WebSocket gets and hits that weren't counted.
+// notFound keys read as 0.
+func cachedValue(dbKey string) (int64, bool, error) {
+	raw, notFound, err := utils.GetCacheV.Fetch(dbKey, func() (string, bool, error) {
+		return store.GetThrough(context.Background(), Store, dbKey)
 	})
+	if notFound || err != nil {
+		return 0, notFound, err
+	}
+	val, err := strconv.ParseInt(raw, 10, 64)
+	return val, false, err
 }
 
-func HitView(c *gin.Context) {
-	namespace, key := utils.GetNamespaceKey(c)
-	if namespace == "" || key == "" {
-		return
-	}
-	dbKey := utils.CreateKey(c, namespace, key, false)
-	if dbKey == "" { // error is handled in CreateKey
-		return
-	}
-	// Get data from Redis
-	val, err := Client.Incr(context.Background(), dbKey).Result()
+var errValueTooLarge = errors.New("value is too large")
+
+// incrKey increments dbKey, notifies its streams and refreshes its TTL. It's
+// the part of a hit shared by /hit and the WebSocket endpoint.
+func incrKey(dbKey string) (int64, error) {
+	val, err := Store.Incr(context.Background(), dbKey)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get data. Try again later."})
-		return
+		return 0, err
 	}
 	// check if val is is greater than the max value of an int
 	if val > math.MaxInt {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Value is too large. Max value is " + strconv.Itoa(math.
-			MaxInt), "message": "If you are seeing this error and have a legitimate use case, please contact me @ abacus@jasoncameron.dev"})
+		return 0, errValueTooLarge
+	}
+	go utils.SetStream(dbKey, int(val)) // #nosec G115 -- This is safe as we perform a check (
+	// see above) to ensure val is within the range of an int.
+	refreshTTL(dbKey)
+	return val, nil
+}
+
+func HitView(c *gin.Context) {
+	_, val, counted, ok := hitKey(c)
+	if !ok {
 		return
 	}
-	go func() {
-		utils.SetStream(dbKey, int(val)) // #nosec G115 -- This is safe as we perform a check (
-		// see above) to ensure val is within the range of an int.
-		if utils.ExpireGate.ShouldRefresh(dbKey) {
-			Client.Expire(context.Background(), dbKey, utils.BaseTTLPeriod)
-		}
-	}()
+	body := gin.H{"value": val}
+	if !counted {
+		body["counted"] = false
+	}
 	if c.Query("callback") != "" {
-		c.JSONP(http.StatusOK, gin.H{"value": val})
+		c.JSONP(http.StatusOK, body)
 
 	} else {
-		c.JSON(http.StatusOK, gin.H{"value": val})
+		c.JSON(http.StatusOK, body)
 
 	}
 }
 
 func HitShieldView(c *gin.Context) {
-	namespace, key := utils.GetNamespaceKey(c)
-	if namespace == "" || key == "" {
+	_, val, _, ok := hitKey(c)
+	if !ok {
 		return
 	}
 
-	dbKey := utils.CreateKey(c, namespace, key, false)
-	if dbKey == "" { // error is handled in CreateKey
-		return
-	}
-	// Get data from Redis
-	val, err := Client.Incr(context.Background(), dbKey).Result()
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get data. Try again later."})
-		return
-	}
-	// check if val is is greater than the max value of an int
-	if val > math.MaxInt {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Value is too large. Max value is " + strconv.Itoa(math.
-			MaxInt), "message": "If you are seeing this error and have a legitimate use case, please contact me @ abacus@jasoncameron.dev"})
-		return
-	}
-	go func() {
-		utils.SetStream(dbKey, int(val)) // #nosec G115 -- This is safe as we perform a check (
-		// see above) to ensure val is within the range of an int.
-		if utils.ExpireGate.ShouldRefresh(dbKey) {
-			Client.Expire(context.Background(), dbKey, utils.BaseTTLPeriod)
-		}
-	}()
-
 	badgeSVG, err := utils.GenerateBadge(c, val)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error:": err.Error()})
@@ -213,6 +127,24 @@ func HitShieldView(c *gin.Context) {
 	c.Data(http.StatusOK, "image/svg+xml", badgeSVG)
 }
 
+// HitEndpointView counts a hit and serves the new value as shields.io
+// endpoint badge JSON. shields.io caches endpoint responses, so this counts
+// its fetches rather than every view of the badge.
+func HitEndpointView(c *gin.Context) {
+	// Before the hit, so a bad request isn't counted.
+	opts, err := utils.ParseBadgeOptions(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	_, val, _, ok := hitKey(c)
+	if !ok {
+		return
+	}
+	c.Header("Cache-Control", "max-age=0, no-cache, no-store, must-revalidate")
+	c.JSON(http.StatusOK, utils.GenerateEndpointBadge(opts, val))
+}
+
 func GetView(c *gin.Context) {
 	namespace, key := utils.GetNamespaceKey(c)
 	if namespace == "" || key == "" {
@@ -227,7 +159,7 @@ func GetView(c *gin.Context) {
 	// fills for the same key into one Redis GET. Misses, including the
 	// "key doesn't exist" case, are cached for the TTL window.
 	val, notFound, err := utils.GetCacheV.Fetch(dbKey, func() (string, bool, error) {
-		return utils.RedisGetThrough(context.Background(), Client, dbKey)
+		return store.GetThrough(context.Background(), Store, dbKey)
 	})
 	if notFound {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Key not found"})
@@ -238,6 +170,14 @@ func GetView(c *gin.Context) {
 		return
 	}
 
+	// Settings only narrow CORS here; a lookup failure isn't worth failing
+	// the read over. A token with the read scope lifts the restriction, e.g.
+	// for a dashboard hosted on another site.
+	if settings, err := keySettings(dbKey); err == nil && len(settings.AllowedOrigins) > 0 &&
+		!middleware.Authorized(c, Store, dbKey, utils.ScopeRead) {
+		restrictCORS(c, settings)
+	}
+
 	intval, _ := strconv.Atoi(val)
 	if c.Query("callback") != "" {
 		c.JSONP(http.StatusOK, gin.H{"value": intval})
@@ -246,58 +186,238 @@ func GetView(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{"value": intval})
 
 	}
-	// Fire the TTL refresh AFTER the response has been written. The coalescer
-	// suppresses ~99% of these so most cache hits incur zero Redis traffic.
+	refreshTTL(dbKey)
+}
+
+func GetShieldView(c *gin.Context) {
+	dbKey, intval, ok := getValue(c)
+	if !ok {
+		return
+	}
+
+	badgeSVG, err := utils.GenerateBadge(c, intval)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get SVG data."})
+		return
+	}
+	c.Header("Content-Type", "image/svg+xml")
+	c.Data(http.StatusOK, "image/svg+xml", badgeSVG)
+	refreshTTL(dbKey)
+}
+
+// GetEndpointView serves the counter as shields.io endpoint badge JSON, for
+// https://img.shields.io/endpoint?url=... It takes the same parameters as
+// the shield.
+func GetEndpointView(c *gin.Context) {
+	opts, err := utils.ParseBadgeOptions(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	dbKey, val, ok := getValue(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, utils.GenerateEndpointBadge(opts, val))
+	refreshTTL(dbKey)
+}
+
+// getValue reads the counter named by the request through the get
+// micro-cache, for the badge views. ok=false means a response has already
+// been written.
+func getValue(c *gin.Context) (dbKey string, val int64, ok bool) {
+	namespace, key := utils.GetNamespaceKey(c)
+	if namespace == "" || key == "" {
+		return "", 0, false
+	}
+	dbKey = utils.CreateKey(c, namespace, key, false)
+	if dbKey == "" { // error is handled in CreateKey
+		return "", 0, false
+	}
+
+	raw, notFound, err := utils.GetCacheV.Fetch(dbKey, func() (string, bool, error) {
+		return store.GetThrough(context.Background(), Store, dbKey)
+	})
+	if notFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Key not found"})
+		return "", 0, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get data. Try again later."})
+		return "", 0, false
+	}
+
+	val, convErr := strconv.ParseInt(raw, 10, 64)
+	if convErr != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get data. Invalid data format."})
+		return "", 0, false
+	}
+	return dbKey, val, true
+}
+
+// refreshTTL pushes back the expiry of dbKey, a counter or unique-visitor
+// set, after it's read or written, along with a counter's namespace marker.
+// On reads, call it after the response has been written; the coalescer
+// suppresses ~99% of refreshes, so most cache hits incur zero Redis traffic.
+func refreshTTL(dbKey string) {
 	go func() {
 		if utils.ExpireGate.ShouldRefresh(dbKey) {
-			Client.Expire(context.Background(), dbKey, utils.BaseTTLPeriod)
+			_ = Store.Expire(context.Background(), dbKey, utils.BaseTTLPeriod)
+			if strings.HasPrefix(dbKey, "K:") {
+				_ = markNamespace(utils.NamespaceOf(dbKey))
+			}
 		}
 	}()
 }
 
-func GetShieldView(c *gin.Context) {
+// markNamespace records that namespace has counters in it, so that
+// /namespace/create can refuse it without scanning for them. Counters renew
+// the marker along with their own TTL, so it outlives them.
+func markNamespace(namespace string) error {
+	ctx := context.Background()
+	marker := utils.CreateNamespaceMarkerKey(namespace)
+	set, err := Store.SetNX(ctx, marker, "1", utils.BaseTTLPeriod)
+	if err != nil || set {
+		return err
+	}
+	return Store.Expire(ctx, marker, utils.BaseTTLPeriod)
+}
+
+// uniqueHit records the caller as a visitor of the namespace/key's HLL and
+// returns the HLL key and its new cardinality. ok=false means a response has
+// already been written.
+func uniqueHit(c *gin.Context) (string, int64, bool) {
 	namespace, key := utils.GetNamespaceKey(c)
 	if namespace == "" || key == "" {
-		return
+		return "", 0, false
 	}
 	dbKey := utils.CreateKey(c, namespace, key, false)
 	if dbKey == "" { // error is handled in CreateKey
-		return
+		return "", 0, false
 	}
+	uniqueKey := utils.CreateUniqueKey(dbKey)
 
-	val, notFound, err := utils.GetCacheV.Fetch(dbKey, func() (string, bool, error) {
-		return utils.RedisGetThrough(context.Background(), Client, dbKey)
+	count, err := Store.AddUnique(context.Background(), uniqueKey, utils.VisitorHash(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get data. Try again later."})
+		return "", 0, false
+	}
+	refreshTTL(uniqueKey)
+	return uniqueKey, count, true
+}
+
+// uniqueGet reads the distinct-visitor count through the GET micro-cache.
+// ok=false means a response has already been written.
+func uniqueGet(c *gin.Context) (string, int64, bool) {
+	namespace, key := utils.GetNamespaceKey(c)
+	if namespace == "" || key == "" {
+		return "", 0, false
+	}
+	dbKey := utils.CreateKey(c, namespace, key, false)
+	if dbKey == "" { // error is handled in CreateKey
+		return "", 0, false
+	}
+	uniqueKey := utils.CreateUniqueKey(dbKey)
+
+	val, notFound, err := utils.GetCacheV.Fetch(uniqueKey, func() (string, bool, error) {
+		return store.CountUniqueThrough(context.Background(), Store, uniqueKey)
 	})
 	if notFound {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Key not found"})
-		return
+		return "", 0, false
 	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get data. Try again later."})
+		return "", 0, false
+	}
+	count, _ := strconv.ParseInt(val, 10, 64)
+	return uniqueKey, count, true
+}
+
+func UniqueHitView(c *gin.Context) {
+	_, count, ok := uniqueHit(c)
+	if !ok {
 		return
 	}
+	if c.Query("callback") != "" {
+		c.JSONP(http.StatusOK, gin.H{"value": count})
+	} else {
+		c.JSON(http.StatusOK, gin.H{"value": count})
+	}
+}
 
-	intval, convErr := strconv.ParseInt(val, 10, 64)
-	if convErr != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get data. Invalid data format."})
+func UniqueHitShieldView(c *gin.Context) {
+	_, count, ok := uniqueHit(c)
+	if !ok {
 		return
 	}
+	badgeSVG, err := utils.GenerateBadge(c, count)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error:": err.Error()})
+		return
+	}
+	c.Header("Content-Type", "image/svg+xml")
+	// github camo likes caching this
+	c.Header("Cache-Control", "max-age=0, no-cache, no-store, must-revalidate")
+	c.Data(http.StatusOK, "image/svg+xml", badgeSVG)
+}
 
-	badgeSVG, err := utils.GenerateBadge(c, intval)
+func UniqueGetView(c *gin.Context) {
+	uniqueKey, count, ok := uniqueGet(c)
+	if !ok {
+		return
+	}
+	if c.Query("callback") != "" {
+		c.JSONP(http.StatusOK, gin.H{"value": count})
+	} else {
+		c.JSON(http.StatusOK, gin.H{"value": count})
+	}
+	refreshTTL(uniqueKey)
+}
+
+func UniqueGetShieldView(c *gin.Context) {
+	uniqueKey, count, ok := uniqueGet(c)
+	if !ok {
+		return
+	}
+	badgeSVG, err := utils.GenerateBadge(c, count)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get SVG data."})
 		return
 	}
 	c.Header("Content-Type", "image/svg+xml")
 	c.Data(http.StatusOK, "image/svg+xml", badgeSVG)
+	refreshTTL(uniqueKey)
+}
 
-	// TTL refresh AFTER the response has been written. Coalescer suppresses
-	// ~99% so most cache hits incur zero Redis traffic.
-	go func() {
-		if utils.ExpireGate.ShouldRefresh(dbKey) {
-			Client.Expire(context.Background(), dbKey, utils.BaseTTLPeriod)
-		}
-	}()
+func UniqueInfoView(c *gin.Context) {
+	namespace, key := utils.GetNamespaceKey(c)
+	if namespace == "" || key == "" {
+		return
+	}
+	dbKey := utils.CreateKey(c, namespace, key, true)
+	if dbKey == "" { // error is handled in CreateKey
+		return
+	}
+	uniqueKey := utils.CreateUniqueKey(dbKey)
+
+	ctx := context.Background()
+	count, err := Store.CountUnique(ctx, uniqueKey)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get data. Try again later."})
+		return
+	}
+	expiresAt, err := Store.TTL(ctx, uniqueKey)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get data. Try again later."})
+		return
+	}
+
+	exists := expiresAt != store.TTLMissing
+	if !exists {
+		count = -1
+	}
+	c.JSON(http.StatusOK, gin.H{"value": count, "full_key": uniqueKey, "expires_in": expiresAt.Seconds(), "expires_str": expiresAt.String(), "exists": exists})
 }
 
 func CreateRandomView(c *gin.Context) {
@@ -325,22 +445,137 @@ func CreateView(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "initializer must be a number"})
 		return
 	}
+	// ?dedupe= sets the key's cooldown (see /settings) from the start.
+	cooldown, err := utils.ParseHitCooldown(c.Query("dedupe"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, invalidHitCooldown(err))
+		return
+	}
+	// Mark the namespace before checking whether it's claimed: a claim racing
+	// this request then either sees the marker or is seen by the check.
+	if err := markNamespace(utils.NamespaceOf(dbKey)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create. Try again later."})
+		return
+	}
+	if !checkNamespaceToken(c, utils.NamespaceOf(dbKey)) {
+		return
+	}
 	AdminKey := uuid.New().String()
-	created, err := utils.CreateWithAdmin.Run(
-		context.Background(), Client,
-		[]string{dbKey, utils.CreateAdminKey(dbKey)},
-		initialValue, int(utils.BaseTTLPeriod.Seconds()), AdminKey,
-	).Int()
+	hashedAdminKey, err := utils.HashToken(AdminKey)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create. Try again later."})
 		return
 	}
-	if created == 0 {
+	created, err := Store.CreateWithAdmin(context.Background(), dbKey, utils.CreateAdminKey(dbKey),
+		int64(initialValue), utils.BaseTTLPeriod, hashedAdminKey)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create. Try again later."})
+		return
+	}
+	if !created {
 		c.JSON(http.StatusConflict, gin.H{"error": "Key already exists, please use a different key."})
 		return
 	}
+	// Tokens and settings left over from an earlier counter of the same name
+	// that expired.
+	clearOwnerData(dbKey)
 	utils.SetStream(dbKey, initialValue)
-	c.JSON(http.StatusCreated, gin.H{"key": key, "namespace": namespace, "admin_key": AdminKey, "value": initialValue})
+	resp := gin.H{"key": key, "namespace": namespace, "admin_key": AdminKey, "value": initialValue}
+	if cooldown > 0 {
+		_, err := updateSettings(utils.CreateSettingsKey(dbKey), func(s *utils.KeySettings) { s.Cooldown = int64(cooldown / time.Second) })
+		if err != nil {
+			// The key exists now; its admin key must still reach the caller.
+			log.Printf("Failed to save the cooldown of %s: %v", dbKey, err)
+			resp["warning"] = "Failed to save the cooldown. Set it with /settings."
+		} else {
+			resp["cooldown"] = cooldownJSON(cooldown)
+		}
+	}
+	c.JSON(http.StatusCreated, resp)
+}
+
+// checkNamespaceToken enforces that keys in a claimed namespace are only
+// created with the namespace's admin token. Unclaimed namespaces pass.
+// false means a response has already been written.
+func checkNamespaceToken(c *gin.Context, namespace string) bool {
+	nsAdminKey := utils.CreateNamespaceAdminKey(namespace)
+	stored, err := Store.Get(context.Background(), nsAdminKey)
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		return true
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create. Try again later."})
+		return false
+	case !middleware.CheckToken(Store, nsAdminKey, stored, middleware.Token(c)):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "This namespace has been claimed. Creating keys in it requires the namespace's admin token."})
+		return false
+	}
+	return true
+}
+
+// CreateNamespaceView claims an unused namespace. The returned admin token
+// works on every key in the namespace and is required to create new ones.
+func CreateNamespaceView(c *gin.Context) {
+	namespace := utils.CreateNamespace(c, c.Param("namespace"))
+	if namespace == "" { // error is handled in CreateNamespace
+		return
+	}
+	if namespace == "default" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The default namespace is shared and can't be claimed."})
+		return
+	}
+	AdminKey := uuid.New().String()
+	hashedAdminKey, err := utils.HashToken(AdminKey)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create. Try again later."})
+		return
+	}
+	ctx := context.Background()
+	adminKey := utils.CreateNamespaceAdminKey(namespace)
+	claimed, err := Store.SetNX(ctx, adminKey, hashedAdminKey, 0)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create. Try again later."})
+		return
+	}
+	if !claimed {
+		c.JSON(http.StatusConflict, gin.H{"error": "Namespace has already been claimed."})
+		return
+	}
+	// Only unused namespaces: the token must not grant control over keys
+	// someone else created. Checked after claiming, as /create marks the
+	// namespace before checking for a claim, so one of the two always sees
+	// the other.
+	inUse, err := namespaceInUse(ctx, namespace)
+	if err != nil || inUse {
+		_ = Store.Del(ctx, adminKey)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create. Try again later."})
+			return
+		}
+		c.JSON(http.StatusConflict, gin.H{"error": "Namespace already has keys in it. Only unused namespaces can be claimed."})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"namespace": namespace, "admin_key": AdminKey})
+}
+
+// namespaceInUse reports whether namespace has counters in it. Its marker
+// answers for namespaces used since markers were introduced; without one,
+// it looks for a counter, in case the namespace's counters predate markers
+// and haven't been used since, and marks the namespace if it finds one.
+func namespaceInUse(ctx context.Context, namespace string) (bool, error) {
+	_, err := Store.Get(ctx, utils.CreateNamespaceMarkerKey(namespace))
+	if err == nil {
+		return true, nil
+	}
+	if !errors.Is(err, store.ErrNotFound) {
+		return false, err
+	}
+	keys, err := Store.ScanPrefix(ctx, "K:"+namespace+":", 1)
+	if err != nil || len(keys) == 0 {
+		return false, err
+	}
+	_ = markNamespace(namespace)
+	return true, nil
 }
 
 func InfoView(c *gin.Context) { // todo: write docs on what negative values mean (https://redis.io/commands/ttl/)
@@ -353,31 +588,17 @@ func InfoView(c *gin.Context) { // todo: write docs on what negative values mean
 		return
 	}
 
-	// One pipelined RTT instead of three sequential GET/EXISTS/TTL.
-	ctx := context.Background()
-	pipe := Client.Pipeline()
-	getCmd := pipe.Get(ctx, dbKey)
-	existsCmd := pipe.Exists(ctx, utils.CreateAdminKey(dbKey))
-	ttlCmd := pipe.TTL(ctx, dbKey)
-	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+	info, err := Store.Info(context.Background(), dbKey, utils.CreateAdminKey(dbKey))
+	if err != nil {
 		// Real transport failure. Don't fabricate exists=true.
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get data. Try again later."})
 		return
 	}
-	// Re-check each cmd individually; pipeline Exec returns only the first error.
-	if err := existsCmd.Err(); err != nil && !errors.Is(err, redis.Nil) {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get data. Try again later."})
-		return
-	}
-	if err := ttlCmd.Err(); err != nil && !errors.Is(err, redis.Nil) {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get data. Try again later."})
-		return
-	}
 
-	count, _ := strconv.Atoi(getCmd.Val())
-	isGenuine := existsCmd.Val() == 0
-	expiresAt := ttlCmd.Val()
-	exists := expiresAt != -2
+	count, _ := strconv.Atoi(info.Value)
+	isGenuine := !info.HasAdmin
+	expiresAt := info.TTL
+	exists := expiresAt != store.TTLMissing
 	if !exists {
 		count = -1
 	}
@@ -393,12 +614,78 @@ func DeleteView(c *gin.Context) {
 	if dbKey == "" { // error is handled in CreateKey
 		return
 	}
-	// Single variadic DEL = 1 RTT instead of 2.
-	Client.Del(context.Background(), dbKey, utils.CreateAdminKey(dbKey))
+	// Unique visitors and history go too, or a counter created under the
+	// same name would inherit them. History buckets are only written while
+	// history is enabled; any left from before it was turned off expire on
+	// their own.
+	keys := []string{dbKey, utils.CreateAdminKey(dbKey), utils.CreateUniqueKey(dbKey)}
+	if utils.History.Enabled {
+		keys = append(keys, utils.AllHistoryBuckets(dbKey, time.Now())...)
+	}
+	_ = Store.Del(context.Background(), keys...)
+	clearOwnerData(dbKey)
 	c.JSON(http.StatusOK, gin.H{"status": "ok", "message": "Deleted key: " + dbKey})
 	utils.CloseStream(dbKey)
 }
 
+// RotateView replaces a key's admin token with a new one and returns it, so a
+// leaked token can be retired without recreating the counter. Scoped tokens
+// keep working unless ?revoke_tokens=true; hit signatures never do.
+func RotateView(c *gin.Context) {
+	namespace, key := utils.GetNamespaceKey(c)
+	if namespace == "" || key == "" {
+		return
+	}
+	dbKey := utils.CreateKey(c, namespace, key, true)
+	if dbKey == "" { // error is handled in CreateKey
+		return
+	}
+	revokeTokens := c.Query("revoke_tokens") == "true"
+
+	ctx := context.Background()
+	adminDBKey := utils.CreateAdminKey(dbKey)
+	old, err := Store.Get(ctx, adminDBKey)
+	if errors.Is(err, store.ErrNotFound) {
+		// Auth let a namespace token through for a key created by a hit.
+		c.JSON(http.StatusConflict, gin.H{"error": "This key has no admin key of its own to rotate."})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rotate. Try again later."})
+		return
+	}
+	AdminKey := uuid.New().String()
+	hashedAdminKey, err := utils.HashToken(AdminKey)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rotate. Try again later."})
+		return
+	}
+	// Swap against the value just read, so of two concurrent rotations only
+	// one succeeds rather than both handing out keys and one being dead.
+	rotated, err := Store.CompareAndSwap(ctx, adminDBKey, old, hashedAdminKey)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rotate. Try again later."})
+		return
+	}
+	if !rotated {
+		c.JSON(http.StatusConflict, gin.H{"error": "The admin key changed while rotating. Try again with the current one."})
+		return
+	}
+	if revokeTokens {
+		revokeAllTokens(dbKey)
+	}
+	// A leaked admin key leaks the signing key derived from it; switch to one
+	// derived from the new key. Links signed with the old one stop working.
+	signingKey := utils.DeriveSigningKey(AdminKey, dbKey)
+	if _, err := updateSettings(utils.CreateSettingsKey(dbKey), func(s *utils.KeySettings) {
+		if s.SigningKey != "" {
+			s.SigningKey = signingKey
+		}
+	}); err != nil {
+		log.Printf("Failed to rotate the signing key of %s: %v", dbKey, err)
+	}
+	c.JSON(http.StatusOK, gin.H{"key": key, "namespace": namespace, "admin_key": AdminKey})
+}
+
 func SetView(c *gin.Context) {
 	updatedValueRaw, _ := c.GetQuery("value")
 	if updatedValueRaw == "" {
@@ -420,8 +707,7 @@ func SetView(c *gin.Context) {
 		return
 	}
 
-	// Get data from Redis
-	val, err := Client.SetXX(context.Background(), dbKey, updatedValue, utils.BaseTTLPeriod).Result()
+	val, err := Store.SetXX(context.Background(), dbKey, int64(updatedValue), utils.BaseTTLPeriod)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set data. Try again later."})
 		return
@@ -444,8 +730,7 @@ func ResetView(c *gin.Context) {
 		return
 	}
 
-	// Get data from Redis
-	val, err := Client.SetXX(context.Background(), dbKey, 0, utils.BaseTTLPeriod).Result()
+	val, err := Store.SetXX(context.Background(), dbKey, 0, utils.BaseTTLPeriod)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set data. Try again later."})
 		return
@@ -483,9 +768,10 @@ func UpdateByView(c *gin.Context) {
 		return
 	}
 
-	// One round trip, race-free: atomic exists-check + INCRBY.
-	val, err := utils.IncrByIfExists.Run(context.Background(), Client, []string{dbKey}, incrByValue).Int64()
-	if errors.Is(err, redis.Nil) {
+	// Race-free: atomic exists-check + INCRBY, plus the history buckets when
+	// enabled.
+	val, err := Store.IncrByIfExists(context.Background(), dbKey, int64(incrByValue))
+	if errors.Is(err, store.ErrNotFound) {
 		c.JSON(http.StatusConflict, gin.H{"error": "Key does not exist, please first create it using /create."})
 		return
 	}
@@ -498,64 +784,97 @@ func UpdateByView(c *gin.Context) {
 	go utils.SetStream(dbKey, int(val))
 }
 
-func StatsView(c *gin.Context) {
-	// get average ttl using INFO
+func HistoryView(c *gin.Context) {
+	if !utils.History.Enabled {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "History is not enabled on this server."})
+		return
+	}
+	namespace, key := utils.GetNamespaceKey(c)
+	if namespace == "" || key == "" {
+		return
+	}
+	dbKey := utils.CreateKey(c, namespace, key, false)
+	if dbKey == "" { // error is handled in CreateKey
+		return
+	}
 
+	granularity := c.DefaultQuery("granularity", utils.GranularityHour)
+	to := time.Now()
+	if raw := c.Query("to"); raw != "" {
+		parsed, err := utils.ParseHistoryTime(raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid to: " + err.Error()})
+			return
+		}
+		to = parsed
+	}
+	// Default window: the last day of hours or the last 30 days.
+	from := to.Add(-23 * time.Hour)
+	if granularity == utils.GranularityDay {
+		from = to.AddDate(0, 0, -29)
+	}
+	if raw := c.Query("from"); raw != "" {
+		parsed, err := utils.ParseHistoryTime(raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid from: " + err.Error()})
+			return
+		}
+		from = parsed
+	}
+	times, err := utils.HistoryRange(granularity, from, to)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	bucketKeys := make([]string, len(times))
+	for i, t := range times {
+		bucketKeys[i] = utils.HistoryBucketKey(dbKey, granularity, t)
+	}
+	vals, err := Store.MGet(context.Background(), bucketKeys...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get data. Try again later."})
+		return
+	}
+
+	// Buckets that were never written (or have aged out) are reported as 0
+	// so the series has no gaps.
+	points := make([]gin.H, len(times))
+	for i, t := range times {
+		value, _ := strconv.ParseInt(vals[i], 10, 64)
+		points[i] = gin.H{"time": t.Format(time.RFC3339), "value": value}
+	}
+	c.JSON(http.StatusOK, gin.H{"granularity": granularity, "points": points})
+}
+
+func StatsView(c *gin.Context) {
 	ctx := context.Background()
 
-	// INFO + 4 stats GETs in one pipelined RTT instead of 5 sequential ones.
-	pipe := Client.Pipeline()
-	infoCmd := pipe.Info(ctx)
-	totalCmd := pipe.Get(ctx, "stats:Total")
-	hitsCmd := pipe.Get(ctx, "stats:hit")
-	getsCmd := pipe.Get(ctx, "stats:get")
-	createCmd := pipe.Get(ctx, "stats:create")
-	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+	info, err := Store.ServerInfo(ctx)
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get stats. Try again later."})
 		return
 	}
-	infoStr, err := infoCmd.Result()
+	vals, err := Store.MGet(ctx, "stats:Total", "stats:hit", "stats:get", "stats:create")
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get stats. Try again later."})
 		return
 	}
 
-	infoDict := make(map[string]map[string]string)
-	sections := strings.Split(infoStr, "\r\n\r\n")
-
-	for _, section := range sections {
-		lines := strings.Split(section, "\r\n")
-		if len(lines) == 0 || len(lines[0]) < 2 {
-			continue
-		}
-		sectionName := lines[0][2:] // Remove "# " prefix
-
-		infoDict[sectionName] = make(map[string]string)
-		for _, line := range lines[1:] {
-			parts := strings.Split(line, ":")
-			if len(parts) == 2 {
-				key := strings.TrimSpace(parts[0])
-				value := strings.TrimSpace(parts[1])
-				infoDict[sectionName][key] = value
-			}
-		}
-	}
-
-	// redis.Nil on these counters just means "never been incremented yet" → 0.
-	total, _ := strconv.Atoi(totalCmd.Val())
-	hits, _ := strconv.Atoi(hitsCmd.Val())
-	gets, _ := strconv.Atoi(getsCmd.Val())
-	create, _ := strconv.Atoi(createCmd.Val())
-
+	// Missing counters just mean "never been incremented yet" → 0.
+	total, _ := strconv.Atoi(vals[0])
+	hits, _ := strconv.Atoi(vals[1])
+	gets, _ := strconv.Atoi(vals[2])
+	create, _ := strconv.Atoi(vals[3])
 	totalKeys := create + (hits / 60) // 60 hits per key (average taken from the first 6m requests) ~ Json
 
 	c.JSON(http.StatusOK, gin.H{
 		"version":                     Version,
 		"uptime":                      time.Since(StartTime).String(),
-		"db_uptime":                   infoDict["Server"]["uptime_in_seconds"],
-		"db_version":                  infoDict["Server"]["redis_version"],
-		"expired_keys__since_restart": infoDict["Stats"]["expired_keys"],
-		"key_misses__since_restart":   infoDict["Stats"]["keyspace_misses"],
+		"db_uptime":                   info.Uptime,
+		"db_version":                  info.Version,
+		"expired_keys__since_restart": info.ExpiredKeys,
+		"key_misses__since_restart":   info.KeyspaceMisses,
 		"commands": map[string]int{
 			"total":  total,
 			"get":    gets,
@@ -18,12 +18,14 @@ import (
 
 	"github.com/redis/go-redis/v9"
 
+	"pkg.jsn.cam/abacus/middleware"
 	"pkg.jsn.cam/abacus/utils"
 
 	"github.com/goccy/go-json"
 
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func init() {
@@ -165,6 +167,83 @@ func TestHitView(t *testing.T) {
 	})
 }
 
+func TestUniqueHitView(t *testing.T) {
+	r := setupTestRouter()
+
+	hit := func(userAgent string) float64 {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/unique/hit/test/unique_key", nil)
+		req.Header.Set("User-Agent", userAgent)
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var response map[string]interface{}
+		err := json.Unmarshal(w.Body.Bytes(), &response)
+		assert.NoError(t, err)
+		return response["value"].(float64)
+	}
+
+	t.Run("Repeat visitor is counted once", func(t *testing.T) {
+		assert.Equal(t, float64(1), hit("agent-a"))
+		assert.Equal(t, float64(1), hit("agent-a"))
+	})
+
+	t.Run("Different visitor is counted", func(t *testing.T) {
+		assert.Equal(t, float64(2), hit("agent-b"))
+	})
+
+	t.Run("Raw counter is untouched", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/get/test/unique_key", nil)
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("Info reports the HLL key", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/unique/info/test/unique_key", nil)
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var response map[string]interface{}
+		err := json.Unmarshal(w.Body.Bytes(), &response)
+		assert.NoError(t, err)
+		assert.Equal(t, "U:test:unique_key", response["full_key"])
+		assert.Equal(t, float64(2), response["value"])
+		assert.True(t, response["exists"].(bool))
+	})
+}
+
+func TestUniqueGetView(t *testing.T) {
+	r := setupTestRouter()
+
+	t.Run("Get non-existent unique key", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/unique/get/test/nonexistent_unique_key", nil)
+		r.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("Get unique shield", func(t *testing.T) {
+		hitW := httptest.NewRecorder()
+		hitReq, _ := http.NewRequest("GET", "/unique/hit/test/unique_shield_key/shield", nil)
+		r.ServeHTTP(hitW, hitReq)
+		assert.Equal(t, http.StatusOK, hitW.Code)
+		assert.Equal(t, "image/svg+xml", hitW.Header().Get("Content-Type"))
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/unique/get/test/unique_shield_key/shield", nil)
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		re := regexp.MustCompile(`<text.*?>(\d+)</text>`)
+		matches := re.FindAllStringSubmatch(w.Body.String(), -1)
+		assert.NotEmpty(t, matches, "SVG should contain at least one <text> element with a number")
+		assert.Equal(t, "1", matches[len(matches)-1][1])
+	})
+}
+
 func TestHitShield(t *testing.T) {
 	r := setupTestRouter()
 
@@ -300,6 +379,401 @@ func TestCreateRandomView(t *testing.T) {
 	})
 }
 
+// doRequest serves one request, with token as a Bearer header if set, and
+// returns the status and decoded JSON body.
+func doRequest(r *gin.Engine, method, url, token string) (int, map[string]interface{}) {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, url, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	r.ServeHTTP(w, req)
+	var body map[string]interface{}
+	_ = json.Unmarshal(w.Body.Bytes(), &body)
+	return w.Code, body
+}
+
+func TestNamespaceClaim(t *testing.T) {
+	r := setupTestRouter()
+	do := func(method, url, token string) (int, map[string]interface{}) {
+		return doRequest(r, method, url, token)
+	}
+
+	code, body := do("POST", "/namespace/create/claimedns", "")
+	require.Equal(t, http.StatusCreated, code)
+	nsToken := body["admin_key"].(string)
+	assert.NotEmpty(t, nsToken)
+	assert.Equal(t, "claimedns", body["namespace"])
+
+	code, _ = do("POST", "/namespace/create/claimedns", "")
+	assert.Equal(t, http.StatusConflict, code, "a namespace can only be claimed once")
+
+	t.Run("Creating keys needs the namespace token", func(t *testing.T) {
+		code, _ := do("POST", "/create/claimedns/counter", "")
+		assert.Equal(t, http.StatusUnauthorized, code)
+		code, _ = do("POST", "/create/claimedns/counter", "not-the-token")
+		assert.Equal(t, http.StatusUnauthorized, code)
+		code, body := do("POST", "/create/claimedns/counter?initializer=5", nsToken)
+		assert.Equal(t, http.StatusCreated, code)
+		assert.NotEmpty(t, body["admin_key"], "keys still get their own admin token")
+	})
+
+	t.Run("The namespace token manages every key in it", func(t *testing.T) {
+		code, _ := do("POST", "/set/claimedns/counter?value=42", nsToken)
+		assert.Equal(t, http.StatusOK, code)
+		val, _ := Client.Get(context.Background(), "K:claimedns:counter").Int()
+		assert.Equal(t, 42, val)
+
+		// Keys created by a hit have no admin token of their own.
+		code, _ = do("GET", "/hit/claimedns/hit-created", "")
+		require.Equal(t, http.StatusOK, code)
+		code, _ = do("POST", "/update/claimedns/hit-created?value=2", nsToken)
+		assert.Equal(t, http.StatusOK, code)
+
+		code, _ = do("POST", "/delete/claimedns/counter", "wrong")
+		assert.Equal(t, http.StatusUnauthorized, code)
+		code, _ = do("POST", "/delete/claimedns/counter", nsToken)
+		assert.Equal(t, http.StatusOK, code)
+	})
+
+	t.Run("Only unused namespaces can be claimed", func(t *testing.T) {
+		code, _ := do("POST", "/create/usedns/counter", "")
+		require.Equal(t, http.StatusCreated, code)
+		code, _ = do("POST", "/namespace/create/usedns", "")
+		assert.Equal(t, http.StatusConflict, code)
+		n, _ := Client.Exists(context.Background(), "N:usedns").Result()
+		assert.Zero(t, n, "a refused claim must not leave its token behind")
+
+		// Keys created by a hit mark their namespace too.
+		code, _ = do("GET", "/hit/hitns/counter", "")
+		require.Equal(t, http.StatusOK, code)
+		require.Eventually(t, func() bool {
+			n, _ := Client.Exists(context.Background(), "M:hitns").Result()
+			return n == 1
+		}, time.Second, 10*time.Millisecond)
+		code, _ = do("POST", "/namespace/create/hitns", "")
+		assert.Equal(t, http.StatusConflict, code)
+
+		// Counters from before markers, not used since, have none.
+		require.NoError(t, Client.Set(context.Background(), "K:legacyns:counter", 7, 0).Err())
+		code, _ = do("POST", "/namespace/create/legacyns", "")
+		assert.Equal(t, http.StatusConflict, code)
+		n, _ = Client.Exists(context.Background(), "N:legacyns", "M:legacyns").Result()
+		assert.Equal(t, int64(1), n, "the namespace is marked, not claimed")
+
+		code, _ = do("POST", "/namespace/create/default", "")
+		assert.Equal(t, http.StatusBadRequest, code)
+		code, _ = do("POST", "/namespace/create/x", "")
+		assert.Equal(t, http.StatusBadRequest, code)
+	})
+
+	t.Run("The namespace token doesn't reach other namespaces", func(t *testing.T) {
+		code, _ := do("POST", "/set/usedns/counter?value=1", nsToken)
+		assert.Equal(t, http.StatusUnauthorized, code)
+	})
+}
+
+func TestScopedTokens(t *testing.T) {
+	r := setupTestRouter()
+	do := func(method, url, token string) (int, map[string]interface{}) {
+		return doRequest(r, method, url, token)
+	}
+
+	code, body := do("POST", "/create/tokens/build?initializer=1", "")
+	require.Equal(t, http.StatusCreated, code)
+	adminKey := body["admin_key"].(string)
+
+	code, body = do("POST", "/tokens/create/tokens/build?scopes=update&label=ci", adminKey)
+	require.Equal(t, http.StatusCreated, code)
+	ciToken := body["token"].(string)
+	ciID := body["id"].(string)
+	assert.Equal(t, []interface{}{"update"}, body["scopes"])
+
+	t.Run("A token can only do what its scopes allow", func(t *testing.T) {
+		code, body := do("POST", "/update/tokens/build?value=1", ciToken)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, float64(2), body["value"])
+		code, _ = do("POST", "/set/tokens/build?value=9", ciToken)
+		assert.Equal(t, http.StatusForbidden, code)
+		code, _ = do("POST", "/delete/tokens/build", ciToken)
+		assert.Equal(t, http.StatusForbidden, code)
+		code, _ = do("POST", "/tokens/create/tokens/build?scopes=delete", ciToken)
+		assert.Equal(t, http.StatusForbidden, code, "only the admin token mints tokens")
+		code, _ = do("POST", "/update/tokens/build?value=1", ciID+".wrong-secret")
+		assert.Equal(t, http.StatusUnauthorized, code)
+	})
+
+	t.Run("Tokens are bound to their key", func(t *testing.T) {
+		code, _ := do("POST", "/create/tokens/other", "")
+		require.Equal(t, http.StatusCreated, code)
+		code, _ = do("POST", "/update/tokens/other?value=1", ciToken)
+		assert.Equal(t, http.StatusUnauthorized, code)
+	})
+
+	t.Run("Scopes and expiry are validated", func(t *testing.T) {
+		code, _ := do("POST", "/tokens/create/tokens/build", adminKey)
+		assert.Equal(t, http.StatusBadRequest, code)
+		code, _ = do("POST", "/tokens/create/tokens/build?scopes=admin", adminKey)
+		assert.Equal(t, http.StatusBadRequest, code)
+		code, _ = do("POST", "/tokens/create/tokens/build?scopes=set&expires_in=-5", adminKey)
+		assert.Equal(t, http.StatusBadRequest, code)
+
+		code, body := do("POST", "/tokens/create/tokens/build?scopes=set&expires_in=60", adminKey)
+		require.Equal(t, http.StatusCreated, code)
+		assert.InDelta(t, time.Now().Add(time.Minute).Unix(), body["expires_at"], 2)
+	})
+
+	t.Run("Expired tokens are dropped", func(t *testing.T) {
+		ctx := context.Background()
+		raw := Client.Get(ctx, "T:tokens:build").Val()
+		tokens, err := utils.DecodeTokenSet(raw)
+		require.NoError(t, err)
+		require.Len(t, tokens, 2)
+		tokens[1].ExpiresAt = time.Now().Add(-time.Second).Unix()
+		expired, _ := tokens.Encode()
+		require.NoError(t, Client.Set(ctx, "T:tokens:build", expired, 0).Err())
+
+		code, body := do("GET", "/tokens/list/tokens/build", adminKey)
+		require.Equal(t, http.StatusOK, code)
+		assert.Len(t, body["tokens"], 1)
+		code, _ = do("POST", "/tokens/create/tokens/build?scopes=set&expires_in=60", adminKey)
+		require.Equal(t, http.StatusCreated, code)
+		tokens, _ = utils.DecodeTokenSet(Client.Get(ctx, "T:tokens:build").Val())
+		assert.Len(t, tokens, 2, "the next write drops them")
+	})
+
+	t.Run("The owner lists and revokes tokens", func(t *testing.T) {
+		code, body := do("GET", "/tokens/list/tokens/build", adminKey)
+		require.Equal(t, http.StatusOK, code)
+		tokens := body["tokens"].([]interface{})
+		require.Len(t, tokens, 2)
+		var ci map[string]interface{}
+		for _, token := range tokens {
+			if token := token.(map[string]interface{}); token["id"] == ciID {
+				ci = token
+			}
+		}
+		require.NotNil(t, ci)
+		assert.Equal(t, "ci", ci["label"])
+		assert.NotContains(t, ci, "secret")
+
+		code, _ = do("POST", "/tokens/revoke/tokens/build?id="+ciID, adminKey)
+		assert.Equal(t, http.StatusOK, code)
+		code, _ = do("POST", "/tokens/revoke/tokens/build?id="+ciID, adminKey)
+		assert.Equal(t, http.StatusNotFound, code)
+		code, _ = do("POST", "/update/tokens/build?value=1", ciToken)
+		assert.Equal(t, http.StatusUnauthorized, code)
+	})
+
+	t.Run("Deleting the key revokes its tokens", func(t *testing.T) {
+		code, _ := do("POST", "/delete/tokens/build", adminKey)
+		require.Equal(t, http.StatusOK, code)
+		n, _ := Client.Exists(context.Background(), "T:tokens:build").Result()
+		assert.Zero(t, n)
+	})
+}
+
+func TestAdminKeysHashedAtRest(t *testing.T) {
+	r := setupTestRouter()
+	ctx := context.Background()
+
+	code, body := doRequest(r, "POST", "/create/hashed/counter", "")
+	require.Equal(t, http.StatusCreated, code)
+	adminKey := body["admin_key"].(string)
+	stored := Client.Get(ctx, "A:hashed:counter").Val()
+	assert.NotContains(t, stored, adminKey)
+	code, _ = doRequest(r, "POST", "/set/hashed/counter?value=3", adminKey)
+	assert.Equal(t, http.StatusOK, code)
+
+	t.Run("Legacy plaintext keys are upgraded on first use", func(t *testing.T) {
+		const legacy = "0e0d1c5e-7a58-4f7b-9b8e-5f7d0c1d8e2a"
+		require.NoError(t, Client.Set(ctx, "A:hashed:counter", legacy, 0).Err())
+		code, _ := doRequest(r, "POST", "/set/hashed/counter?value=4", "wrong")
+		assert.Equal(t, http.StatusUnauthorized, code)
+		assert.Equal(t, legacy, Client.Get(ctx, "A:hashed:counter").Val(), "a failed attempt changes nothing")
+
+		code, _ = doRequest(r, "POST", "/set/hashed/counter?value=4", legacy)
+		assert.Equal(t, http.StatusOK, code)
+		upgraded := Client.Get(ctx, "A:hashed:counter").Val()
+		assert.True(t, strings.HasPrefix(upgraded, "sha256$"), upgraded)
+
+		code, _ = doRequest(r, "POST", "/set/hashed/counter?value=5", legacy)
+		assert.Equal(t, http.StatusOK, code, "the key keeps working after the upgrade")
+	})
+}
+
+func TestRotateView(t *testing.T) {
+	r := setupTestRouter()
+
+	code, body := doRequest(r, "POST", "/create/rotate/counter?initializer=7", "")
+	require.Equal(t, http.StatusCreated, code)
+	oldKey := body["admin_key"].(string)
+	code, body = doRequest(r, "POST", "/tokens/create/rotate/counter?scopes=update", oldKey)
+	require.Equal(t, http.StatusCreated, code)
+	scopedToken := body["token"].(string)
+
+	code, _ = doRequest(r, "POST", "/rotate/rotate/counter", scopedToken)
+	assert.Equal(t, http.StatusForbidden, code, "scoped tokens can't rotate")
+
+	code, body = doRequest(r, "POST", "/rotate/rotate/counter", oldKey)
+	require.Equal(t, http.StatusOK, code)
+	newKey := body["admin_key"].(string)
+	assert.NotEqual(t, oldKey, newKey)
+
+	code, _ = doRequest(r, "POST", "/set/rotate/counter?value=1", oldKey)
+	assert.Equal(t, http.StatusUnauthorized, code, "the old key is dead")
+	code, _ = doRequest(r, "POST", "/update/rotate/counter?value=1", newKey)
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = doRequest(r, "POST", "/update/rotate/counter?value=1", scopedToken)
+	assert.Equal(t, http.StatusOK, code, "scoped tokens survive a plain rotation")
+
+	code, body = doRequest(r, "GET", "/info/rotate/counter", "")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, float64(9), body["value"], "rotating keeps the value")
+	assert.Equal(t, false, body["is_genuine"])
+
+	code, body = doRequest(r, "POST", "/rotate/rotate/counter?revoke_tokens=true", newKey)
+	require.Equal(t, http.StatusOK, code)
+	assert.NotEmpty(t, body["admin_key"])
+	code, _ = doRequest(r, "POST", "/update/rotate/counter?value=1", scopedToken)
+	assert.Equal(t, http.StatusUnauthorized, code)
+}
+
+func TestSignedHits(t *testing.T) {
+	r := setupTestRouter()
+
+	code, body := doRequest(r, "POST", "/create/signed/downloads", "")
+	require.Equal(t, http.StatusCreated, code)
+	adminKey := body["admin_key"].(string)
+	code, _ = doRequest(r, "GET", "/hit/signed/downloads", "")
+	assert.Equal(t, http.StatusOK, code, "hits are open until the owner opts in")
+
+	code, body = doRequest(r, "POST", "/settings/signed/downloads?require_signature=true", adminKey)
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, true, body["require_signature"])
+	assert.Equal(t, true, body["signing_key_set"])
+	assert.NotContains(t, body, "signing_key")
+
+	code, _ = doRequest(r, "GET", "/hit/signed/downloads", "")
+	assert.Equal(t, http.StatusForbidden, code)
+	code, _ = doRequest(r, "GET", "/hit/signed/downloads/shield", "")
+	assert.Equal(t, http.StatusForbidden, code)
+
+	code, body = doRequest(r, "POST", "/sign/signed/downloads?expires_in=60", adminKey)
+	require.Equal(t, http.StatusOK, code)
+	signedURL := body["url"].(string)
+	code, body = doRequest(r, "GET", signedURL, "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, float64(2), body["value"])
+	code, _ = doRequest(r, "GET", signedURL+"x", "")
+	assert.Equal(t, http.StatusForbidden, code, "a tampered signature is rejected")
+
+	t.Run("Owners can sign links themselves", func(t *testing.T) {
+		signingKey := utils.DeriveSigningKey(adminKey, "K:signed:downloads")
+		exp := time.Now().Add(time.Minute).Unix()
+		url := fmt.Sprintf("/hit/signed/downloads?exp=%d&sig=%s", exp, utils.SignHit(signingKey, "K:signed:downloads", exp))
+		code, _ := doRequest(r, "GET", url, "")
+		assert.Equal(t, http.StatusOK, code)
+
+		exp = time.Now().Add(-time.Minute).Unix()
+		url = fmt.Sprintf("/hit/signed/downloads?exp=%d&sig=%s", exp, utils.SignHit(signingKey, "K:signed:downloads", exp))
+		code, _ = doRequest(r, "GET", url, "")
+		assert.Equal(t, http.StatusForbidden, code, "expired links are rejected")
+	})
+
+	t.Run("Tokens with the hit scope skip the signature", func(t *testing.T) {
+		code, body := doRequest(r, "POST", "/tokens/create/signed/downloads?scopes=hit", adminKey)
+		require.Equal(t, http.StatusCreated, code)
+		code, _ = doRequest(r, "GET", "/hit/signed/downloads", body["token"].(string))
+		assert.Equal(t, http.StatusOK, code)
+		code, body = doRequest(r, "POST", "/tokens/create/signed/downloads?scopes=update", adminKey)
+		require.Equal(t, http.StatusCreated, code)
+		code, _ = doRequest(r, "GET", "/hit/signed/downloads", body["token"].(string))
+		assert.Equal(t, http.StatusForbidden, code)
+	})
+
+	t.Run("Rotating the admin key invalidates signed links", func(t *testing.T) {
+		code, _ := doRequest(r, "POST", "/rotate/signed/downloads", adminKey)
+		require.Equal(t, http.StatusOK, code)
+		code, _ = doRequest(r, "GET", signedURL, "")
+		assert.Equal(t, http.StatusForbidden, code)
+	})
+
+	t.Run("Turning it off reopens hits", func(t *testing.T) {
+		code, body := doRequest(r, "POST", "/create/signed/reopened", "")
+		require.Equal(t, http.StatusCreated, code)
+		adminKey := body["admin_key"].(string)
+		code, _ = doRequest(r, "POST", "/settings/signed/reopened?require_signature=true", adminKey)
+		require.Equal(t, http.StatusOK, code)
+		code, _ = doRequest(r, "POST", "/settings/signed/reopened?require_signature=false", adminKey)
+		require.Equal(t, http.StatusOK, code)
+		code, _ = doRequest(r, "GET", "/hit/signed/reopened", "")
+		assert.Equal(t, http.StatusOK, code)
+
+		code, _ = doRequest(r, "POST", "/settings/signed/reopened?require_signature=maybe", adminKey)
+		assert.Equal(t, http.StatusBadRequest, code)
+		code, _ = doRequest(r, "POST", "/settings/signed/reopened", adminKey)
+		assert.Equal(t, http.StatusBadRequest, code)
+	})
+}
+
+func TestAllowedOrigins(t *testing.T) {
+	r := setupTestRouter()
+	hit := func(path string, headers map[string]string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	code, body := doRequest(r, "POST", "/create/origins/visits", "")
+	require.Equal(t, http.StatusCreated, code)
+	adminKey := body["admin_key"].(string)
+	code, body = doRequest(r, "POST", "/settings/origins/visits?allowed_origins=https://Example.com,https://www.example.com/blog/", adminKey)
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []interface{}{"https://example.com", "https://www.example.com"}, body["allowed_origins"])
+
+	w := hit("/hit/origins/visits", map[string]string{"Origin": "https://example.com"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "https://example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Contains(t, w.Header().Values("Vary"), "Origin")
+
+	w = hit("/hit/origins/visits/shield", map[string]string{"Referer": "https://www.example.com/about"})
+	assert.Equal(t, http.StatusOK, w.Code, "the Referer stands in for a missing Origin")
+
+	w = hit("/hit/origins/visits", map[string]string{"Origin": "https://evil.example"})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+	w = hit("/hit/origins/visits", nil)
+	assert.Equal(t, http.StatusForbidden, w.Code, "requests that don't say where they're from are rejected")
+
+	w = hit("/get/origins/visits", map[string]string{"Origin": "https://evil.example"})
+	assert.Equal(t, http.StatusOK, w.Code, "reads aren't rejected")
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"), "but other sites can't read them from a browser")
+	w = hit("/get/origins/visits", map[string]string{"Origin": "https://example.com"})
+	assert.Equal(t, "https://example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.JSONEq(t, `{"value":2}`, w.Body.String())
+
+	for scope, lifted := range map[string]bool{"read": true, "update": false} {
+		code, body = doRequest(r, "POST", "/tokens/create/origins/visits?scopes="+scope, adminKey)
+		require.Equal(t, http.StatusCreated, code)
+		w = hit("/get/origins/visits?token="+body["token"].(string), map[string]string{"Origin": "https://evil.example"})
+		assert.Equal(t, lifted, w.Header().Get("Access-Control-Allow-Origin") != "", "a token with the %s scope", scope)
+	}
+
+	code, _ = doRequest(r, "POST", "/settings/origins/visits?allowed_origins=ftp://example.com", adminKey)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, body = doRequest(r, "POST", "/settings/origins/visits?allowed_origins=", adminKey)
+	require.Equal(t, http.StatusOK, code)
+	assert.Empty(t, body["allowed_origins"])
+	w = hit("/hit/origins/visits", map[string]string{"Origin": "https://evil.example"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "*", w.Header().Get("Access-Control-Allow-Origin"))
+}
+
 func TestInfoView(t *testing.T) {
 	r := setupTestRouter()
 
@@ -340,6 +814,86 @@ func TestInfoView(t *testing.T) {
 	})
 }
 
+func TestHistoryView(t *testing.T) {
+	r := setupTestRouter()
+
+	t.Run("Disabled by default", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/history/test/history_key", nil)
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusNotImplemented, w.Code)
+	})
+
+	prev := utils.History
+	defer utils.InitHistory(prev)
+	utils.InitHistory(utils.HistoryConfig{Enabled: true, HourlyRetention: time.Hour, DailyRetention: 24 * time.Hour})
+
+	createW := httptest.NewRecorder()
+	createReq, _ := http.NewRequest("POST", "/create/test/history_key", nil)
+	r.ServeHTTP(createW, createReq)
+	var createResponse map[string]interface{}
+	json.Unmarshal(createW.Body.Bytes(), &createResponse)
+	adminToken := createResponse["admin_key"].(string)
+
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/hit/test/history_key", nil)
+		r.ServeHTTP(w, req)
+	}
+	updateW := httptest.NewRecorder()
+	updateReq, _ := http.NewRequest("POST", "/update/test/history_key?value=4", nil)
+	updateReq.Header.Set("Authorization", "Bearer "+adminToken)
+	r.ServeHTTP(updateW, updateReq)
+	assert.Equal(t, http.StatusOK, updateW.Code)
+
+	t.Run("Current buckets include hits and updates", func(t *testing.T) {
+		for _, granularity := range []string{"hour", "day"} {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/history/test/history_key?granularity="+granularity, nil)
+			r.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusOK, w.Code)
+
+			var response struct {
+				Granularity string `json:"granularity"`
+				Points      []struct {
+					Time  string `json:"time"`
+					Value int64  `json:"value"`
+				} `json:"points"`
+			}
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+			assert.Equal(t, granularity, response.Granularity)
+			assert.NotEmpty(t, response.Points)
+			assert.Equal(t, int64(7), response.Points[len(response.Points)-1].Value)
+		}
+	})
+
+	t.Run("Bucket TTL follows retention", func(t *testing.T) {
+		ttl := Client.TTL(context.Background(), utils.HistoryBucketKey("K:test:history_key", "hour", time.Now())).Val()
+		assert.Greater(t, ttl, time.Duration(0))
+		assert.LessOrEqual(t, ttl, time.Hour)
+	})
+
+	t.Run("Invalid granularity", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/history/test/history_key?granularity=minute", nil)
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("Deleted with the key", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/delete/test/history_key", nil)
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		for _, granularity := range []string{"hour", "day"} {
+			bucket := utils.HistoryBucketKey("K:test:history_key", granularity, time.Now())
+			assert.Equal(t, int64(0), Client.Exists(context.Background(), bucket).Val(), bucket)
+		}
+	})
+}
+
 func TestStatsView(t *testing.T) {
 
 	// Initialize Gin
@@ -382,6 +936,10 @@ func TestDeleteView(t *testing.T) {
 		var createResponse map[string]interface{}
 		json.Unmarshal(createW.Body.Bytes(), &createResponse)
 		adminToken := createResponse["admin_key"].(string)
+		uniqueW := httptest.NewRecorder()
+		uniqueReq, _ := http.NewRequest("GET", "/unique/hit/test/delete_key", nil)
+		r.ServeHTTP(uniqueW, uniqueReq)
+		assert.Equal(t, http.StatusOK, uniqueW.Code)
 
 		// Now delete the key with the admin token
 		w := httptest.NewRecorder()
@@ -393,6 +951,7 @@ func TestDeleteView(t *testing.T) {
 
 		exists := Client.Exists(context.Background(), "abacus:test:delete_key").Val()
 		assert.Equal(t, int64(0), exists)
+		assert.Equal(t, int64(0), Client.Exists(context.Background(), "U:test:delete_key").Val(), "unique visitors are deleted too")
 	})
 
 }
@@ -636,3 +1195,294 @@ func TestStreamValueView(t *testing.T) {
 		}
 	})
 }
+
+func TestHitQuotas(t *testing.T) {
+	r := setupTestRouter()
+
+	code, body := doRequest(r, "POST", "/create/quotas/visits", "")
+	require.Equal(t, http.StatusCreated, code)
+	adminKey := body["admin_key"].(string)
+	code, body = doRequest(r, "POST", "/settings/quotas/visits?hit_quota=2/60s", adminKey)
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "2/60s", body["hit_quota"])
+
+	for want := 1.0; want <= 2; want++ {
+		code, body = doRequest(r, "GET", "/hit/quotas/visits", "")
+		require.Equal(t, http.StatusOK, code)
+		assert.Equal(t, map[string]interface{}{"value": want}, body)
+	}
+	code, body = doRequest(r, "GET", "/hit/quotas/visits", "")
+	assert.Equal(t, http.StatusOK, code, "hits over the quota still get an answer")
+	assert.Equal(t, map[string]interface{}{"value": 2.0, "counted": false}, body)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/hit/quotas/visits/shield", nil)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code, "badges keep rendering")
+	assert.Equal(t, "image/svg+xml", w.Header().Get("Content-Type"))
+	code, body = doRequest(r, "GET", "/get/quotas/visits", "")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 2.0, body["value"])
+
+	code, _ = doRequest(r, "POST", "/settings/quotas/visits?hit_quota=lots", adminKey)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, body = doRequest(r, "POST", "/settings/quotas/visits?hit_quota=", adminKey)
+	require.Equal(t, http.StatusOK, code)
+	assert.Nil(t, body["hit_quota"])
+	code, body = doRequest(r, "GET", "/hit/quotas/visits", "")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 3.0, body["value"], "clearing the quota lifts it")
+
+	t.Run("operator quotas", func(t *testing.T) {
+		utils.InitHitQuotas(utils.HitQuotaConfig{Key: utils.HitQuota{Limit: 1, Window: 60}})
+		t.Cleanup(func() { utils.InitHitQuotas(utils.HitQuotaConfig{}) })
+		code, _ := doRequest(r, "POST", "/create/quotas/operator", "")
+		require.Equal(t, http.StatusCreated, code)
+
+		_, body := doRequest(r, "GET", "/hit/quotas/operator", "")
+		assert.Equal(t, map[string]interface{}{"value": 1.0}, body)
+		_, body = doRequest(r, "GET", "/hit/quotas/operator", "")
+		assert.Equal(t, map[string]interface{}{"value": 1.0, "counted": false}, body)
+	})
+
+	t.Run("namespace quotas", func(t *testing.T) {
+		code, body := doRequest(r, "POST", "/namespace/create/quotasns", "")
+		require.Equal(t, http.StatusCreated, code)
+		nsToken := body["admin_key"].(string)
+
+		code, _ = doRequest(r, "POST", "/namespace/settings/quotasns?hit_quota=3/60s", "")
+		assert.Equal(t, http.StatusBadRequest, code)
+		code, _ = doRequest(r, "POST", "/namespace/settings/quotasns?hit_quota=3/60s", "not-the-token")
+		assert.Equal(t, http.StatusUnauthorized, code)
+		code, _ = doRequest(r, "POST", "/namespace/settings/quotas?hit_quota=3/60s", adminKey)
+		assert.Equal(t, http.StatusNotFound, code, "unclaimed namespaces have no settings")
+		code, body = doRequest(r, "POST", "/namespace/settings/quotasns?hit_quota=3/60s", nsToken)
+		require.Equal(t, http.StatusOK, code)
+		assert.Equal(t, map[string]interface{}{"namespace": "quotasns", "hit_quota": "3/60s"}, body)
+		code, body = doRequest(r, "GET", "/namespace/settings/quotasns", nsToken)
+		require.Equal(t, http.StatusOK, code)
+		assert.Equal(t, "3/60s", body["hit_quota"])
+
+		for _, key := range []string{"one", "two"} {
+			code, _ := doRequest(r, "POST", "/create/quotasns/"+key, nsToken)
+			require.Equal(t, http.StatusCreated, code)
+		}
+		counted := 0
+		for i := 0; i < 4; i++ {
+			_, body := doRequest(r, "GET", "/hit/quotasns/"+[]string{"one", "two"}[i%2], "")
+			if body["counted"] == nil {
+				counted++
+			}
+		}
+		assert.Equal(t, 3, counted, "the quota is shared by the namespace's keys")
+
+		// A hit the namespace refuses doesn't use up the key's own quota.
+		code, _ = doRequest(r, "POST", "/create/quotasns/three", nsToken)
+		require.Equal(t, http.StatusCreated, code)
+		code, _ = doRequest(r, "POST", "/settings/quotasns/three?hit_quota=5/60s", nsToken)
+		require.Equal(t, http.StatusOK, code)
+		_, body = doRequest(r, "GET", "/hit/quotasns/three", "")
+		assert.Equal(t, false, body["counted"])
+		quotaKey := utils.CreateQuotaKey("K:quotasns:three", utils.HitQuota{Limit: 5, Window: 60}, time.Now())
+		n, _ := Client.Exists(context.Background(), quotaKey).Result()
+		assert.Zero(t, n)
+	})
+}
+
+func TestAPIKeys(t *testing.T) {
+	t.Setenv("OPERATOR_TOKEN", "operator-secret")
+	tiers, err := middleware.ParseTiers("partner=10")
+	require.NoError(t, err)
+	require.NoError(t, middleware.InitTiers(middleware.TierConfig{Tiers: tiers}))
+	t.Cleanup(func() { _ = middleware.InitTiers(middleware.TierConfig{}) })
+	r := setupTestRouter()
+
+	code, _ := doRequest(r, "POST", "/ratelimit/keys/create?tier=partner", "")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, body := doRequest(r, "POST", "/create/apikeys/counter", "")
+	require.Equal(t, http.StatusCreated, code)
+	code, _ = doRequest(r, "POST", "/ratelimit/keys/create?tier=partner", body["admin_key"].(string))
+	assert.Equal(t, http.StatusUnauthorized, code, "a counter's token isn't the operator's")
+	code, _ = doRequest(r, "POST", "/ratelimit/keys/create?tier=gold", "operator-secret")
+	assert.Equal(t, http.StatusBadRequest, code, "unknown tier")
+
+	code, body = doRequest(r, "POST", "/ratelimit/keys/create?tier=partner&label=backend", "operator-secret")
+	require.Equal(t, http.StatusCreated, code)
+	id, key := body["id"].(string), body["key"].(string)
+	assert.Equal(t, "partner", body["tier"])
+	assert.True(t, strings.HasPrefix(key, id+"."))
+	raw, err := Store.Get(context.Background(), utils.CreateAPIKeyKey(id))
+	require.NoError(t, err)
+	assert.NotContains(t, raw, strings.TrimPrefix(key, id+"."), "only the secret's hash is stored")
+
+	code, body = doRequest(r, "GET", "/ratelimit/keys/list", "operator-secret")
+	require.Equal(t, http.StatusOK, code)
+	var listed []interface{}
+	for _, k := range body["keys"].([]interface{}) {
+		if k.(map[string]interface{})["id"] == id {
+			listed = append(listed, k)
+		}
+	}
+	require.Len(t, listed, 1)
+	assert.Equal(t, "backend", listed[0].(map[string]interface{})["label"])
+	assert.NotContains(t, listed[0], "secret")
+
+	// The key lifts its holder into the tier: ten times the policy.
+	limited := gin.New()
+	limited.GET("/limited", middleware.ResolveTier(Store), middleware.RateLimit(nil, middleware.Policy{Name: "test-apikeys", Limit: 1, Window: time.Minute}),
+		func(c *gin.Context) { c.Status(http.StatusOK) })
+	do := func(apiKey string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/limited", nil)
+		req.Header.Set(middleware.APIKeyHeader, apiKey)
+		limited.ServeHTTP(w, req)
+		return w
+	}
+	w := do(key)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `"test-apikeys";q=10;w=60`, w.Header().Get("RateLimit-Policy"))
+
+	code, _ = doRequest(r, "POST", "/ratelimit/keys/revoke?id="+id, "operator-secret")
+	require.Equal(t, http.StatusOK, code)
+	code, _ = doRequest(r, "POST", "/ratelimit/keys/revoke?id="+id, "operator-secret")
+	assert.Equal(t, http.StatusNotFound, code)
+	assert.Equal(t, http.StatusUnauthorized, do(key).Code, "revoked keys stop working")
+}
+
+func TestBotFiltering(t *testing.T) {
+	r := setupTestRouter()
+	hit := func(url string, headers map[string]string) (int, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", url, nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		r.ServeHTTP(w, req)
+		var body map[string]interface{}
+		_ = json.Unmarshal(w.Body.Bytes(), &body)
+		return w.Code, body
+	}
+	camo := map[string]string{"User-Agent": "github-camo (876de43e)"}
+
+	code, body := doRequest(r, "POST", "/create/bots/visits", "")
+	require.Equal(t, http.StatusCreated, code)
+	adminKey := body["admin_key"].(string)
+	_, body = hit("/hit/bots/visits", camo)
+	assert.Equal(t, map[string]interface{}{"value": 1.0}, body, "bots count until the owner filters them")
+
+	code, body = doRequest(r, "POST", "/settings/bots/visits?filter_bots=true", adminKey)
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, true, body["filter_bots"])
+
+	before := utils.HitsRejectedBot.Load()
+	code, body = hit("/hit/bots/visits", camo)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, map[string]interface{}{"value": 1.0, "counted": false}, body)
+	_, body = hit("/hit/bots/visits", map[string]string{"Sec-Purpose": "prefetch"})
+	assert.Equal(t, false, body["counted"], "prefetches aren't visits either")
+	assert.Equal(t, before+2, utils.HitsRejectedBot.Load())
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/hit/bots/visits/shield", nil)
+	req.Header.Set("User-Agent", "Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)")
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code, "unfurls still get a badge")
+	assert.Equal(t, "image/svg+xml", w.Header().Get("Content-Type"))
+
+	_, body = hit("/hit/bots/visits", map[string]string{"User-Agent": "Mozilla/5.0 (X11; Linux x86_64; rv:128.0) Gecko/20100101 Firefox/128.0"})
+	assert.Equal(t, map[string]interface{}{"value": 2.0}, body)
+	_, body = hit("/hit/bots/visits", map[string]string{"User-Agent": "github-camo (876de43e)", "Authorization": "Bearer " + adminKey})
+	assert.Equal(t, map[string]interface{}{"value": 3.0}, body, "a token with the hit scope is trusted")
+
+	code, _ = doRequest(r, "POST", "/settings/bots/visits?filter_bots=maybe", adminKey)
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestHitCooldown(t *testing.T) {
+	r := setupTestRouter()
+	hit := func(userAgent string) map[string]interface{} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/hit/cooldown/visits", nil)
+		req.Header.Set("User-Agent", userAgent)
+		r.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+		var body map[string]interface{}
+		_ = json.Unmarshal(w.Body.Bytes(), &body)
+		return body
+	}
+
+	code, _ := doRequest(r, "POST", "/create/cooldown/visits?dedupe=forever", "")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, body := doRequest(r, "POST", "/create/cooldown/visits?dedupe=30m", "")
+	require.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, "30m0s", body["cooldown"])
+	adminKey := body["admin_key"].(string)
+
+	before := utils.HitsRejectedCooldown.Load()
+	assert.Equal(t, map[string]interface{}{"value": 1.0}, hit("firefox"))
+	assert.Equal(t, map[string]interface{}{"value": 1.0, "counted": false}, hit("firefox"), "a refresh isn't a new visit")
+	assert.Equal(t, map[string]interface{}{"value": 2.0}, hit("safari"), "another visitor is")
+	assert.Equal(t, before+1, utils.HitsRejectedCooldown.Load())
+
+	// The window ends: the returning visitor counts again, unlike a unique hit.
+	cooldownKey := utils.CreateCooldownKey("K:cooldown:visits", "")
+	keys, err := Store.ScanPrefix(context.Background(), cooldownKey, 10)
+	require.NoError(t, err)
+	require.Len(t, keys, 2, "a marker per visitor")
+	ttl, err := Store.TTL(context.Background(), keys[0])
+	require.NoError(t, err)
+	assert.InDelta(t, (30 * time.Minute).Seconds(), ttl.Seconds(), 5)
+	require.NoError(t, Store.Del(context.Background(), keys...))
+	assert.Equal(t, map[string]interface{}{"value": 3.0}, hit("firefox"))
+
+	code, body = doRequest(r, "POST", "/settings/cooldown/visits?cooldown=", adminKey)
+	require.Equal(t, http.StatusOK, code)
+	assert.Nil(t, body["cooldown"])
+	assert.Equal(t, map[string]interface{}{"value": 4.0}, hit("firefox"), "no cooldown, every hit counts")
+	code, body = doRequest(r, "POST", "/settings/cooldown/visits?cooldown=1h", adminKey)
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "1h0m0s", body["cooldown"])
+	code, _ = doRequest(r, "POST", "/settings/cooldown/visits?cooldown=48h", adminKey)
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestEndpointBadge(t *testing.T) {
+	r := setupTestRouter()
+
+	code, _ := doRequest(r, "GET", "/get/endpoint/missing/endpoint", "")
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = doRequest(r, "POST", "/create/endpoint/visits?initializer=41", "")
+	require.Equal(t, http.StatusCreated, code)
+
+	code, body := doRequest(r, "GET", "/get/endpoint/visits/endpoint", "")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, map[string]interface{}{
+		"schemaVersion": 1.0, "label": "counter", "message": "41",
+		"color": "007ec6", "labelColor": "555", "style": "flat",
+	}, body)
+
+	code, body = doRequest(r, "GET", "/hit/endpoint/visits/endpoint?text=views&bgcolor=ff5500&style=flat-square&logo=github", "")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, map[string]interface{}{
+		"schemaVersion": 1.0, "label": "views", "message": "42",
+		"color": "ff5500", "labelColor": "555", "style": "flat-square", "namedLogo": "github",
+	}, body)
+	stored, err := Store.Get(context.Background(), "K:endpoint:visits")
+	require.NoError(t, err)
+	assert.Equal(t, "42", stored, "the endpoint hit counted")
+
+	_, body = doRequest(r, "GET", "/get/endpoint/visits/endpoint?style=plastic-simple", "")
+	assert.Equal(t, "", body["label"], "simple styles have no label")
+	assert.Equal(t, "plastic", body["style"])
+	_, body = doRequest(r, "GET", "/get/endpoint/visits/endpoint?style=for-the-badge", "")
+	assert.Equal(t, "flat", body["style"], "unknown styles fall back to flat, as for the shield")
+
+	code, body = doRequest(r, "GET", "/get/endpoint/visits/endpoint?bgcolor=nope", "")
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Contains(t, body["error"], "not a valid hex color")
+	code, _ = doRequest(r, "GET", "/hit/endpoint/visits/endpoint?bgcolor=nope", "")
+	assert.Equal(t, http.StatusBadRequest, code)
+	stored, err = Store.Get(context.Background(), "K:endpoint:visits")
+	require.NoError(t, err)
+	assert.Equal(t, "42", stored, "a rejected request isn't counted")
+}
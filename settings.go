@@ -0,0 +1,474 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"pkg.jsn.cam/abacus/middleware"
+	"pkg.jsn.cam/abacus/store"
+	"pkg.jsn.cam/abacus/utils"
+)
+
+// defaultSignedHitLifetime is how long /sign links last without ?expires_in=.
+const defaultSignedHitLifetime = 24 * time.Hour
+
+var errSettingsConflict = errors.New("settings changed concurrently")
+
+// keySettings returns dbKey's settings through the settings cache.
+func keySettings(dbKey string) (utils.KeySettings, error) {
+	return cachedSettings(utils.CreateSettingsKey(dbKey))
+}
+
+// namespaceSettings returns a claimed namespace's settings through the
+// settings cache. Unclaimed namespaces have none.
+func namespaceSettings(namespace string) (utils.KeySettings, error) {
+	return cachedSettings(utils.CreateNamespaceSettingsKey(namespace))
+}
+
+func cachedSettings(settingsKey string) (utils.KeySettings, error) {
+	raw, _, err := utils.SettingsCacheV.Fetch(settingsKey, func() (string, bool, error) {
+		return store.GetThrough(context.Background(), Store, settingsKey)
+	})
+	if err != nil {
+		return utils.KeySettings{}, err
+	}
+	return utils.DecodeKeySettings(raw)
+}
+
+// updateSettings applies change to the settings stored at settingsKey and
+// saves them, retrying if another write lands in between.
+func updateSettings(settingsKey string, change func(*utils.KeySettings)) (utils.KeySettings, error) {
+	ctx := context.Background()
+	defer utils.SettingsCacheV.Forget(settingsKey)
+	for attempt := 0; attempt < 3; attempt++ {
+		old, err := Store.Get(ctx, settingsKey)
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			return utils.KeySettings{}, err
+		}
+		settings, err := utils.DecodeKeySettings(old)
+		if err != nil {
+			return utils.KeySettings{}, err
+		}
+		change(&settings)
+		raw, err := settings.Encode()
+		if err != nil {
+			return utils.KeySettings{}, err
+		}
+		var saved bool
+		if old == "" {
+			saved, err = Store.SetNX(ctx, settingsKey, raw, 0)
+		} else {
+			saved, err = Store.CompareAndSwap(ctx, settingsKey, old, raw)
+		}
+		if err != nil {
+			return utils.KeySettings{}, err
+		}
+		if saved {
+			return settings, nil
+		}
+	}
+	return utils.KeySettings{}, errSettingsConflict
+}
+
+// clearOwnerData drops the scoped tokens and settings of dbKey, for when the
+// counter is deleted or created anew.
+func clearOwnerData(dbKey string) {
+	revokeAllTokens(dbKey)
+	settingsKey := utils.CreateSettingsKey(dbKey)
+	if err := Store.Del(context.Background(), settingsKey); err != nil {
+		log.Printf("Failed to delete settings for %s: %v", dbKey, err)
+	}
+	utils.SettingsCacheV.Forget(settingsKey)
+}
+
+// settingsJSON is the public view of s. The signing key stays private.
+func settingsJSON(s utils.KeySettings) gin.H {
+	origins := s.AllowedOrigins
+	if origins == nil {
+		origins = []string{}
+	}
+	return gin.H{"require_signature": s.RequireSignature, "signing_key_set": s.SigningKey != "", "allowed_origins": origins, "hit_quota": quotaJSON(s.Quota()), "filter_bots": s.FilterBots, "cooldown": cooldownJSON(s.CooldownPeriod())}
+}
+
+// quotaJSON is q as the API shows it: "100/1s", or null if there's none.
+func quotaJSON(q utils.HitQuota) any {
+	if q.IsZero() {
+		return nil
+	}
+	return q.String()
+}
+
+// cooldownJSON is d as the API shows it: "30m0s", or null if there's none.
+func cooldownJSON(d time.Duration) any {
+	if d <= 0 {
+		return nil
+	}
+	return d.String()
+}
+
+// SettingsView shows a counter's settings.
+func SettingsView(c *gin.Context) {
+	dbKey := tokenDBKey(c)
+	if dbKey == "" { // error is handled in CreateKey
+		return
+	}
+	settings, err := Store.Get(context.Background(), utils.CreateSettingsKey(dbKey))
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get data. Try again later."})
+		return
+	}
+	decoded, err := utils.DecodeKeySettings(settings)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get data. Try again later."})
+		return
+	}
+	c.JSON(http.StatusOK, settingsJSON(decoded))
+}
+
+// UpdateSettingsView changes the settings given as query parameters, e.g.
+// ?require_signature=true, leaving the rest as they are.
+func UpdateSettingsView(c *gin.Context) {
+	dbKey := tokenDBKey(c)
+	if dbKey == "" { // error is handled in CreateKey
+		return
+	}
+	var changes []func(*utils.KeySettings)
+	if raw, ok := c.GetQuery("require_signature"); ok {
+		require, err := strconv.ParseBool(raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "require_signature must be true or false"})
+			return
+		}
+		// The signing key comes from the token enabling signatures, so
+		// whoever holds it can sign links without calling /sign.
+		signingKey := utils.DeriveSigningKey(middleware.Token(c), dbKey)
+		changes = append(changes, func(s *utils.KeySettings) {
+			s.RequireSignature = require
+			if require && s.SigningKey == "" {
+				s.SigningKey = signingKey
+			}
+		})
+	}
+	if raw, ok := c.GetQuery("allowed_origins"); ok {
+		origins, err := utils.ParseAllowedOrigins(raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		changes = append(changes, func(s *utils.KeySettings) { s.AllowedOrigins = origins })
+	}
+	if raw, ok := c.GetQuery("hit_quota"); ok {
+		quota, err := parseHitQuota(raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, invalidHitQuota(err))
+			return
+		}
+		changes = append(changes, func(s *utils.KeySettings) { s.HitQuota = quota })
+	}
+	if raw, ok := c.GetQuery("filter_bots"); ok {
+		filter, err := strconv.ParseBool(raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "filter_bots must be true or false"})
+			return
+		}
+		changes = append(changes, func(s *utils.KeySettings) { s.FilterBots = filter })
+	}
+	if raw, ok := c.GetQuery("cooldown"); ok {
+		cooldown, err := utils.ParseHitCooldown(raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, invalidHitCooldown(err))
+			return
+		}
+		changes = append(changes, func(s *utils.KeySettings) { s.Cooldown = int64(cooldown / time.Second) })
+	}
+	if len(changes) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No settings given. Pass the ones to change as query parameters, e.g. ?require_signature=true"})
+		return
+	}
+
+	settings, err := updateSettings(utils.CreateSettingsKey(dbKey), func(s *utils.KeySettings) {
+		for _, change := range changes {
+			change(s)
+		}
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save settings. Try again later."})
+		return
+	}
+	c.JSON(http.StatusOK, settingsJSON(settings))
+}
+
+// parseHitQuota reads ?hit_quota= for the settings views; nil clears the
+// quota.
+func parseHitQuota(raw string) (*utils.HitQuota, error) {
+	quota, err := utils.ParseHitQuota(raw)
+	if err != nil || quota.IsZero() {
+		return nil, err
+	}
+	return &quota, nil
+}
+
+// invalidHitCooldown is the response to a cooldown ParseHitCooldown
+// rejected.
+func invalidHitCooldown(err error) gin.H {
+	return gin.H{"error": "Invalid cooldown: " + err.Error() + "."}
+}
+
+// invalidHitQuota is the response to a ?hit_quota= parseHitQuota rejected.
+func invalidHitQuota(err error) gin.H {
+	return gin.H{"error": "Invalid hit quota: " + err.Error() + ". Quotas look like 100/1s, for 100 hits a second."}
+}
+
+// namespaceOwner resolves the namespace named by the request and checks that
+// the request carries its admin token. Only claimed namespaces have an
+// owner. "" means a response has already been written.
+func namespaceOwner(c *gin.Context) string {
+	namespace := utils.CreateNamespace(c, c.Param("namespace"))
+	if namespace == "" { // error is handled in CreateNamespace
+		return ""
+	}
+	token := middleware.Token(c)
+	if token == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Token is required, " +
+			"please provide a token in the format of a Bearer token header or ?token=ADMIN_TOKEN"})
+		return ""
+	}
+	nsAdminKey := utils.CreateNamespaceAdminKey(namespace)
+	stored, err := Store.Get(context.Background(), nsAdminKey)
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "This namespace hasn't been claimed. Claim it with /namespace/create to manage its settings."})
+		return ""
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify token. Try again later."})
+		return ""
+	case !middleware.CheckToken(Store, nsAdminKey, stored, token):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "token is invalid"})
+		return ""
+	}
+	return namespace
+}
+
+// namespaceSettingsJSON is the public view of a namespace's settings, of
+// which only the hit quota applies.
+func namespaceSettingsJSON(namespace string, s utils.KeySettings) gin.H {
+	return gin.H{"namespace": namespace, "hit_quota": quotaJSON(s.Quota())}
+}
+
+// NamespaceSettingsView shows a claimed namespace's settings.
+func NamespaceSettingsView(c *gin.Context) {
+	namespace := namespaceOwner(c)
+	if namespace == "" {
+		return
+	}
+	raw, err := Store.Get(context.Background(), utils.CreateNamespaceSettingsKey(namespace))
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get data. Try again later."})
+		return
+	}
+	settings, err := utils.DecodeKeySettings(raw)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get data. Try again later."})
+		return
+	}
+	c.JSON(http.StatusOK, namespaceSettingsJSON(namespace, settings))
+}
+
+// UpdateNamespaceSettingsView changes a claimed namespace's settings, for now
+// just ?hit_quota=, shared by all of its keys.
+func UpdateNamespaceSettingsView(c *gin.Context) {
+	namespace := namespaceOwner(c)
+	if namespace == "" {
+		return
+	}
+	raw, ok := c.GetQuery("hit_quota")
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No settings given. Pass the ones to change as query parameters, e.g. ?hit_quota=1000/1s"})
+		return
+	}
+	quota, err := parseHitQuota(raw)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, invalidHitQuota(err))
+		return
+	}
+	settings, err := updateSettings(utils.CreateNamespaceSettingsKey(namespace), func(s *utils.KeySettings) { s.HitQuota = quota })
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save settings. Try again later."})
+		return
+	}
+	c.JSON(http.StatusOK, namespaceSettingsJSON(namespace, settings))
+}
+
+// SignView returns a signed hit link for a counter, valid for ?expires_in=
+// seconds (default a day). Sets up the counter's signing key if it has none.
+func SignView(c *gin.Context) {
+	namespace, key := utils.GetNamespaceKey(c)
+	dbKey := tokenDBKey(c)
+	if dbKey == "" { // error is handled in CreateKey
+		return
+	}
+	lifetime := defaultSignedHitLifetime
+	if raw := c.Query("expires_in"); raw != "" {
+		seconds, err := strconv.Atoi(raw)
+		if err != nil || seconds <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "expires_in must be a positive number of seconds"})
+			return
+		}
+		lifetime = time.Duration(seconds) * time.Second
+	}
+
+	settings, err := keySettings(dbKey)
+	if err == nil && settings.SigningKey == "" {
+		signingKey := utils.DeriveSigningKey(middleware.Token(c), dbKey)
+		settings, err = updateSettings(utils.CreateSettingsKey(dbKey), func(s *utils.KeySettings) {
+			if s.SigningKey == "" {
+				s.SigningKey = signingKey
+			}
+		})
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign. Try again later."})
+		return
+	}
+
+	exp := time.Now().Add(lifetime).Unix()
+	sig := utils.SignHit(settings.SigningKey, dbKey, exp)
+	query := "?exp=" + strconv.FormatInt(exp, 10) + "&sig=" + sig
+	c.JSON(http.StatusOK, gin.H{"sig": sig, "exp": exp, "url": "/hit/" + namespace + "/" + key + query})
+}
+
+// checkHitSettings applies dbKey's settings to a hit before it's counted.
+// false means a response has already been written.
+func checkHitSettings(c *gin.Context, dbKey string) bool {
+	settings, err := keySettings(dbKey)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get data. Try again later."})
+		return false
+	}
+	restrictCORS(c, settings)
+	if msg := hitRejection(c, dbKey, settings); msg != "" {
+		c.JSON(http.StatusForbidden, gin.H{"error": msg})
+		return false
+	}
+	return true
+}
+
+// hitRejection checks a hit against settings' allowed origins and signature
+// requirement, returning why it's refused or "" if it isn't. It's shared by
+// /hit and the WebSocket endpoint, which reply differently.
+func hitRejection(c *gin.Context, dbKey string, settings utils.KeySettings) string {
+	// Checks run only when set; most keys have no settings.
+	originOK := len(settings.AllowedOrigins) == 0 || settings.AllowsOrigin(utils.RequestOrigin(c))
+	signatureOK := !settings.RequireSignature ||
+		utils.VerifyHitSignature(settings.SigningKey, dbKey, c.Query("exp"), c.Query("sig"), time.Now())
+	if originOK && signatureOK {
+		return ""
+	}
+	// A token with the hit scope stands in for both, e.g. for a backend that
+	// has neither an Origin nor a signed link.
+	if middleware.Authorized(c, Store, dbKey, utils.ScopeHit) {
+		return ""
+	}
+	if !originOK {
+		utils.HitsRejectedOrigin.Add(1)
+		return "This key only accepts hits from its allowed origins."
+	}
+	utils.HitsRejectedSignature.Add(1)
+	return "This key only accepts signed hits. The signature is missing, invalid or expired."
+}
+
+// countsHit decides whether a hit that passed hitRejection is counted. It
+// isn't if dbKey filters bots and it's from one, or if the visitor's last
+// counted hit was within dbKey's cooldown, unless it carries a token with
+// the hit scope; nor if it's over a quota. c is the hit's request, or the
+// one a WebSocket was opened with, which then identifies the visitor.
+func countsHit(c *gin.Context, dbKey string) (bool, error) {
+	settings, err := keySettings(dbKey)
+	if err != nil {
+		return false, err
+	}
+	if settings.FilterBots && utils.IsBot(c.Request) && !middleware.Authorized(c, Store, dbKey, utils.ScopeHit) {
+		utils.HitsRejectedBot.Add(1)
+		return false, nil
+	}
+	var cooldownKey string
+	if cooldown := settings.CooldownPeriod(); cooldown > 0 {
+		cooldownKey = utils.CreateCooldownKey(dbKey, utils.VisitorHash(c))
+		first, err := Store.SetNX(context.Background(), cooldownKey, "1", cooldown)
+		if err != nil {
+			return false, err
+		}
+		if !first && !middleware.Authorized(c, Store, dbKey, utils.ScopeHit) {
+			utils.HitsRejectedCooldown.Add(1)
+			return false, nil
+		}
+	}
+	within, err := withinHitQuota(dbKey)
+	if err == nil && !within {
+		utils.HitsRejectedQuota.Add(1)
+		if cooldownKey != "" { // not counted, so it doesn't start a cooldown
+			_ = Store.Del(context.Background(), cooldownKey)
+		}
+	}
+	return within, err
+}
+
+// withinHitQuota charges a hit on dbKey to the quotas of the key and of its
+// namespace, each the stricter of the operator's and the owner's, if both
+// still have room, and reports whether they did. Neither is charged for a
+// hit the other refuses. Unset quotas cost nothing.
+func withinHitQuota(dbKey string) (bool, error) {
+	settings, err := keySettings(dbKey)
+	if err != nil {
+		return false, err
+	}
+	namespace := utils.NamespaceOf(dbKey)
+	nsSettings, err := namespaceSettings(namespace)
+	if err != nil {
+		return false, err
+	}
+	now := time.Now()
+	var windows []store.Window
+	for _, q := range []struct {
+		key   string
+		quota utils.HitQuota
+	}{
+		{dbKey, utils.HitQuotas.Key.Stricter(settings.Quota())},
+		{namespace, utils.HitQuotas.Namespace.Stricter(nsSettings.Quota())},
+	} {
+		if q.quota.IsZero() {
+			continue
+		}
+		windows = append(windows, store.Window{
+			Key:   utils.CreateQuotaKey(q.key, q.quota, now),
+			Limit: q.quota.Limit,
+			TTL:   time.Duration(q.quota.Window) * time.Second,
+		})
+	}
+	if len(windows) == 0 {
+		return true, nil
+	}
+	return Store.IncrWithinLimits(context.Background(), windows)
+}
+
+// restrictCORS narrows the allow-all CORS headers of the global cors
+// middleware to the key's allowed origins, so other sites' scripts can't
+// read its responses. Preflights are answered before the key is known and
+// stay permissive.
+func restrictCORS(c *gin.Context, settings utils.KeySettings) {
+	if len(settings.AllowedOrigins) == 0 {
+		return
+	}
+	c.Writer.Header().Add("Vary", "Origin")
+	if origin := c.GetHeader("Origin"); origin != "" && settings.AllowsOrigin(utils.RequestOrigin(c)) {
+		c.Header("Access-Control-Allow-Origin", origin)
+	} else {
+		c.Writer.Header().Del("Access-Control-Allow-Origin")
+	}
+}
@@ -0,0 +1,579 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"pkg.jsn.cam/abacus/utils"
+)
+
+// Records in the data bucket are [kind][expiresAt][payload]: a one-byte kind,
+// the expiry as big-endian unix nanoseconds (0 = never), then the value.
+// Strings carry their bytes; unique sets carry their cardinality as a decimal
+// string and keep their members in a nested bucket under membersBucket.
+const (
+	kindString byte = 's'
+	kindSet    byte = 'u'
+
+	headerLen = 9
+
+	// sweepInterval is how often expired records are reclaimed. Reads treat
+	// an expired record as missing long before the sweeper gets to it.
+	sweepInterval = time.Minute
+)
+
+var (
+	dataBucket    = []byte("data")
+	membersBucket = []byte("members")
+
+	errWrongType = errors.New("store: operation against a key holding the wrong kind of value")
+	errNotInt    = errors.New("store: value is not an integer")
+)
+
+type record struct {
+	kind      byte
+	expiresAt int64
+	payload   []byte
+}
+
+func decodeRecord(b []byte) (record, bool) {
+	if len(b) < headerLen {
+		return record{}, false
+	}
+	return record{kind: b[0], expiresAt: int64(binary.BigEndian.Uint64(b[1:headerLen])), payload: b[headerLen:]}, true
+}
+
+func (r record) encode() []byte {
+	b := make([]byte, headerLen+len(r.payload))
+	b[0] = r.kind
+	binary.BigEndian.PutUint64(b[1:headerLen], uint64(r.expiresAt))
+	copy(b[headerLen:], r.payload)
+	return b
+}
+
+func (r record) expired(now time.Time) bool {
+	return r.expiresAt != 0 && r.expiresAt <= now.UnixNano()
+}
+
+func (r record) ttl(now time.Time) time.Duration {
+	if r.expiresAt == 0 {
+		return TTLPersistent
+	}
+	return time.Duration(r.expiresAt - now.UnixNano()).Truncate(time.Second)
+}
+
+func expiresAt(now time.Time, ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return now.Add(ttl).UnixNano()
+}
+
+// BoltStore is a CounterStore kept in a single bbolt file. It trades Redis'
+// throughput and multi-instance sharing for zero external dependencies, which
+// is the right call for a self-hosted instance serving a handful of sites.
+//
+// Hot-path writes go through DB.Batch so concurrent hits share one commit
+// (and one fsync) instead of queueing for their own.
+type BoltStore struct {
+	db     *bolt.DB
+	opened time.Time
+
+	expiredKeys atomic.Int64
+	misses      atomic.Int64
+
+	stop      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+// OpenBolt opens (or creates) the database file at path and starts the
+// background expiry sweeper.
+func OpenBolt(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open bolt store %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(dataBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(membersBucket)
+		return err
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("init bolt store %s: %w", path, err)
+	}
+
+	s := &BoltStore{db: db, opened: time.Now(), stop: make(chan struct{})}
+	s.wg.Add(1)
+	go s.sweep()
+	return s, nil
+}
+
+// lookup returns the live record at key. Expired records read as missing.
+// The payload aliases bolt's mmap and is only valid inside tx.
+func lookup(tx *bolt.Tx, key string, now time.Time) (record, bool) {
+	r, ok := decodeRecord(tx.Bucket(dataBucket).Get([]byte(key)))
+	if !ok || r.expired(now) {
+		return record{}, false
+	}
+	return r, true
+}
+
+func put(tx *bolt.Tx, key string, r record) error {
+	return tx.Bucket(dataBucket).Put([]byte(key), r.encode())
+}
+
+func del(tx *bolt.Tx, key string) error {
+	if err := tx.Bucket(dataBucket).Delete([]byte(key)); err != nil {
+		return err
+	}
+	members := tx.Bucket(membersBucket)
+	if members.Bucket([]byte(key)) != nil {
+		return members.DeleteBucket([]byte(key))
+	}
+	return nil
+}
+
+// incrBy adds delta to the string at key, keeping its TTL. A missing key
+// starts at 0 with no expiry, as INCRBY does.
+func incrBy(tx *bolt.Tx, key string, delta int64, now time.Time) (int64, record, error) {
+	r, ok := lookup(tx, key, now)
+	var cur int64
+	if ok {
+		if r.kind != kindString {
+			return 0, r, errWrongType
+		}
+		n, err := strconv.ParseInt(string(r.payload), 10, 64)
+		if err != nil {
+			return 0, r, errNotInt
+		}
+		cur = n
+	} else {
+		r = record{kind: kindString}
+	}
+	cur += delta
+	r.payload = strconv.AppendInt(nil, cur, 10)
+	return cur, r, put(tx, key, r)
+}
+
+// incrHistory bumps key's history buckets by delta and resets their TTLs,
+// mirroring the INCRBY + EXPIRE pairs the Redis backend sends.
+func incrHistory(tx *bolt.Tx, key string, delta int64, now time.Time) error {
+	if !utils.History.Enabled {
+		return nil
+	}
+	bucketKeys, ttls := utils.HistoryBuckets(key, now)
+	for i, bucketKey := range bucketKeys {
+		_, r, err := incrBy(tx, bucketKey, delta, now)
+		if err != nil {
+			return err
+		}
+		r.expiresAt = expiresAt(now, time.Duration(ttls[i].(int64))*time.Second)
+		if err := put(tx, bucketKey, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *BoltStore) Get(_ context.Context, key string) (string, error) {
+	var val string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		r, ok := lookup(tx, key, time.Now())
+		if !ok {
+			s.misses.Add(1)
+			return ErrNotFound
+		}
+		if r.kind != kindString {
+			return errWrongType
+		}
+		val = string(r.payload)
+		return nil
+	})
+	return val, err
+}
+
+func (s *BoltStore) MGet(_ context.Context, keys ...string) ([]string, error) {
+	out := make([]string, len(keys))
+	err := s.db.View(func(tx *bolt.Tx) error {
+		now := time.Now()
+		for i, key := range keys {
+			r, ok := lookup(tx, key, now)
+			if !ok {
+				s.misses.Add(1)
+				continue
+			}
+			if r.kind == kindString {
+				out[i] = string(r.payload)
+			}
+		}
+		return nil
+	})
+	return out, err
+}
+
+func (s *BoltStore) Incr(_ context.Context, key string) (int64, error) {
+	var val int64
+	err := s.db.Batch(func(tx *bolt.Tx) error {
+		now := time.Now()
+		var err error
+		if val, _, err = incrBy(tx, key, 1, now); err != nil {
+			return err
+		}
+		return incrHistory(tx, key, 1, now)
+	})
+	return val, err
+}
+
+func (s *BoltStore) IncrByIfExists(_ context.Context, key string, delta int64) (int64, error) {
+	var val int64
+	found := true
+	err := s.db.Batch(func(tx *bolt.Tx) error {
+		now := time.Now()
+		if _, found = lookup(tx, key, now); !found {
+			// Not an error as far as Batch is concerned: returning one would
+			// make it re-run this function outside the batch for nothing.
+			return nil
+		}
+		var err error
+		if val, _, err = incrBy(tx, key, delta, now); err != nil {
+			return err
+		}
+		return incrHistory(tx, key, delta, now)
+	})
+	if err == nil && !found {
+		return 0, ErrNotFound
+	}
+	return val, err
+}
+
+func (s *BoltStore) IncrByMany(_ context.Context, deltas map[string]int64) error {
+	return s.db.Batch(func(tx *bolt.Tx) error {
+		now := time.Now()
+		for key, delta := range deltas {
+			if _, _, err := incrBy(tx, key, delta, now); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStore) IncrWithinLimits(_ context.Context, windows []Window) (bool, error) {
+	var counted bool
+	err := s.db.Batch(func(tx *bolt.Tx) error {
+		now := time.Now()
+		counted = false // Batch may run this more than once
+		for _, w := range windows {
+			r, ok := lookup(tx, w.Key, now)
+			if !ok {
+				continue
+			}
+			if r.kind != kindString {
+				return errWrongType
+			}
+			n, err := strconv.ParseInt(string(r.payload), 10, 64)
+			if err != nil {
+				return errNotInt
+			}
+			if n >= w.Limit {
+				return nil
+			}
+		}
+		for _, w := range windows {
+			val, r, err := incrBy(tx, w.Key, 1, now)
+			if err != nil {
+				return err
+			}
+			if val == 1 {
+				r.expiresAt = expiresAt(now, w.TTL)
+				if err := put(tx, w.Key, r); err != nil {
+					return err
+				}
+			}
+		}
+		counted = true
+		return nil
+	})
+	return counted, err
+}
+
+func (s *BoltStore) CreateWithAdmin(_ context.Context, key, adminKey string, initial int64, ttl time.Duration, adminToken string) (bool, error) {
+	var created bool
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		now := time.Now()
+		if _, exists := lookup(tx, key, now); exists {
+			return nil
+		}
+		counter := record{kind: kindString, expiresAt: expiresAt(now, ttl), payload: strconv.AppendInt(nil, initial, 10)}
+		if err := put(tx, key, counter); err != nil {
+			return err
+		}
+		if err := put(tx, adminKey, record{kind: kindString, payload: []byte(adminToken)}); err != nil {
+			return err
+		}
+		created = true
+		return nil
+	})
+	return created, err
+}
+
+func (s *BoltStore) SetXX(_ context.Context, key string, value int64, ttl time.Duration) (bool, error) {
+	var set bool
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		now := time.Now()
+		if _, exists := lookup(tx, key, now); !exists {
+			return nil
+		}
+		set = true
+		return put(tx, key, record{kind: kindString, expiresAt: expiresAt(now, ttl), payload: strconv.AppendInt(nil, value, 10)})
+	})
+	return set, err
+}
+
+func (s *BoltStore) SetNX(_ context.Context, key, value string, ttl time.Duration) (bool, error) {
+	var set bool
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		now := time.Now()
+		if _, exists := lookup(tx, key, now); exists {
+			return nil
+		}
+		set = true
+		return put(tx, key, record{kind: kindString, expiresAt: expiresAt(now, ttl), payload: []byte(value)})
+	})
+	return set, err
+}
+
+func (s *BoltStore) CompareAndSwap(_ context.Context, key, old, value string) (bool, error) {
+	var swapped bool
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		r, exists := lookup(tx, key, time.Now())
+		if !exists || r.kind != kindString || string(r.payload) != old {
+			return nil
+		}
+		swapped = true
+		r.payload = []byte(value)
+		return put(tx, key, r)
+	})
+	return swapped, err
+}
+
+// ScanPrefix seeks to prefix; keys are sorted, so the matches come next.
+func (s *BoltStore) ScanPrefix(_ context.Context, prefix string, limit int) ([]string, error) {
+	var found []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		now := time.Now()
+		cur := tx.Bucket(dataBucket).Cursor()
+		for k, v := cur.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)) && len(found) < limit; k, v = cur.Next() {
+			if r, ok := decodeRecord(v); ok && !r.expired(now) {
+				found = append(found, string(k))
+			}
+		}
+		return nil
+	})
+	return found, err
+}
+
+func (s *BoltStore) Del(_ context.Context, keys ...string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, key := range keys {
+			if err := del(tx, key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStore) TTL(_ context.Context, key string) (time.Duration, error) {
+	ttl := TTLMissing
+	err := s.db.View(func(tx *bolt.Tx) error {
+		now := time.Now()
+		if r, ok := lookup(tx, key, now); ok {
+			ttl = r.ttl(now)
+		}
+		return nil
+	})
+	return ttl, err
+}
+
+// Expire sets key's TTL. Like Redis, a non-positive TTL deletes the key.
+func (s *BoltStore) Expire(_ context.Context, key string, ttl time.Duration) error {
+	return s.db.Batch(func(tx *bolt.Tx) error {
+		now := time.Now()
+		r, ok := lookup(tx, key, now)
+		if !ok {
+			return nil
+		}
+		if ttl <= 0 {
+			return del(tx, key)
+		}
+		r.expiresAt = expiresAt(now, ttl)
+		return put(tx, key, r)
+	})
+}
+
+func (s *BoltStore) Info(_ context.Context, key, adminKey string) (KeyInfo, error) {
+	info := KeyInfo{TTL: TTLMissing}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		now := time.Now()
+		if r, ok := lookup(tx, key, now); ok {
+			if r.kind == kindString {
+				info.Value = string(r.payload)
+			}
+			info.TTL = r.ttl(now)
+		} else {
+			s.misses.Add(1)
+		}
+		_, info.HasAdmin = lookup(tx, adminKey, now)
+		return nil
+	})
+	return info, err
+}
+
+// AddUnique stores member exactly, so unlike the Redis backend's HyperLogLog
+// the count is precise. Members are hashes of fixed size, which keeps the
+// per-key cost predictable.
+func (s *BoltStore) AddUnique(_ context.Context, key, member string) (int64, error) {
+	var count int64
+	err := s.db.Batch(func(tx *bolt.Tx) error {
+		now := time.Now()
+		r, ok := lookup(tx, key, now)
+		if ok && r.kind != kindSet {
+			return errWrongType
+		}
+		if !ok {
+			// Clear out whatever an expired predecessor left behind.
+			if err := del(tx, key); err != nil {
+				return err
+			}
+			r = record{kind: kindSet, payload: []byte("0")}
+		}
+		n, err := strconv.ParseInt(string(r.payload), 10, 64)
+		if err != nil {
+			return errNotInt
+		}
+		set, err := tx.Bucket(membersBucket).CreateBucketIfNotExists([]byte(key))
+		if err != nil {
+			return err
+		}
+		if set.Get([]byte(member)) == nil {
+			if err := set.Put([]byte(member), nil); err != nil {
+				return err
+			}
+			n++
+		}
+		count = n
+		r.payload = strconv.AppendInt(nil, n, 10)
+		return put(tx, key, r)
+	})
+	return count, err
+}
+
+func (s *BoltStore) CountUnique(_ context.Context, key string) (int64, error) {
+	var count int64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		r, ok := lookup(tx, key, time.Now())
+		if !ok {
+			s.misses.Add(1)
+			return nil
+		}
+		if r.kind != kindSet {
+			return errWrongType
+		}
+		n, err := strconv.ParseInt(string(r.payload), 10, 64)
+		if err != nil {
+			return errNotInt
+		}
+		count = n
+		return nil
+	})
+	return count, err
+}
+
+func (s *BoltStore) ServerInfo(_ context.Context) (ServerInfo, error) {
+	return ServerInfo{
+		Uptime:         strconv.FormatInt(int64(time.Since(s.opened).Seconds()), 10),
+		Version:        "bbolt",
+		ExpiredKeys:    strconv.FormatInt(s.expiredKeys.Load(), 10),
+		KeyspaceMisses: strconv.FormatInt(s.misses.Load(), 10),
+	}, nil
+}
+
+// Close stops the sweeper and closes the database file.
+func (s *BoltStore) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.stop)
+		s.wg.Wait()
+		err = s.db.Close()
+	})
+	return err
+}
+
+func (s *BoltStore) sweep() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			if n, err := s.sweepOnce(time.Now()); err != nil {
+				log.Printf("bolt store: expiry sweep failed: %v", err)
+			} else if n > 0 {
+				s.expiredKeys.Add(int64(n))
+			}
+		}
+	}
+}
+
+// sweepOnce deletes every record that has expired by now. It scans the whole
+// bucket, which is fine at the sizes this backend is meant for.
+func (s *BoltStore) sweepOnce(now time.Time) (int, error) {
+	var expired []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(dataBucket).ForEach(func(k, v []byte) error {
+			if r, ok := decodeRecord(v); ok && r.expired(now) {
+				expired = append(expired, string(k))
+			}
+			return nil
+		})
+	})
+	if err != nil || len(expired) == 0 {
+		return 0, err
+	}
+	removed := 0
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		removed = 0
+		for _, key := range expired {
+			// Re-check: the key may have been rewritten since the scan.
+			if r, ok := decodeRecord(tx.Bucket(dataBucket).Get([]byte(key))); !ok || !r.expired(now) {
+				continue
+			}
+			if err := del(tx, key); err != nil {
+				return err
+			}
+			removed++
+		}
+		return nil
+	})
+	return removed, err
+}
+
+// compile-time check
+var _ CounterStore = (*BoltStore)(nil)
@@ -0,0 +1,247 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"pkg.jsn.cam/abacus/utils"
+)
+
+// RedisStore is the production CounterStore. Multi-key operations are
+// pipelined or scripted so each method costs one round trip.
+type RedisStore struct {
+	Client *redis.Client
+}
+
+// NewRedis wraps an existing client. The store takes ownership: Close closes
+// the client.
+func NewRedis(client *redis.Client) *RedisStore {
+	return &RedisStore{Client: client}
+}
+
+func (s *RedisStore) Get(ctx context.Context, key string) (string, error) {
+	v, err := s.Client.Get(ctx, key).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", ErrNotFound
+	}
+	return v, err
+}
+
+func (s *RedisStore) MGet(ctx context.Context, keys ...string) ([]string, error) {
+	vals, err := s.Client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]string, len(vals))
+	for i, v := range vals {
+		if str, ok := v.(string); ok {
+			out[i] = str
+		}
+	}
+	return out, nil
+}
+
+// Incr INCRs key and, when history is enabled, pipelines the bucket writes
+// behind it so the hot path stays one round trip. A failed bucket write never
+// fails the hit: only the INCR's own result is returned.
+func (s *RedisStore) Incr(ctx context.Context, key string) (int64, error) {
+	if !utils.History.Enabled {
+		return s.Client.Incr(ctx, key).Result()
+	}
+	bucketKeys, ttls := utils.HistoryBuckets(key, time.Now())
+	pipe := s.Client.Pipeline()
+	incrCmd := pipe.Incr(ctx, key)
+	for i, bucketKey := range bucketKeys {
+		pipe.IncrBy(ctx, bucketKey, 1)
+		pipe.Expire(ctx, bucketKey, time.Duration(ttls[i].(int64))*time.Second)
+	}
+	_, _ = pipe.Exec(ctx)
+	return incrCmd.Result()
+}
+
+// IncrByIfExists runs utils.IncrByIfExists: atomic exists-check + INCRBY,
+// plus the history buckets when enabled, in one round trip.
+func (s *RedisStore) IncrByIfExists(ctx context.Context, key string, delta int64) (int64, error) {
+	keys, args := []string{key}, []any{delta}
+	if utils.History.Enabled {
+		bucketKeys, ttls := utils.HistoryBuckets(key, time.Now())
+		keys, args = append(keys, bucketKeys...), append(args, ttls...)
+	}
+	val, err := utils.IncrByIfExists.Run(ctx, s.Client, keys, args...).Int64()
+	if errors.Is(err, redis.Nil) {
+		return 0, ErrNotFound
+	}
+	return val, err
+}
+
+func (s *RedisStore) IncrByMany(ctx context.Context, deltas map[string]int64) error {
+	pipe := s.Client.Pipeline()
+	for key, delta := range deltas {
+		pipe.IncrBy(ctx, key, delta)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// CreateWithAdmin runs utils.CreateWithAdmin, creating the counter and its
+// admin key atomically in one round trip.
+func (s *RedisStore) CreateWithAdmin(ctx context.Context, key, adminKey string, initial int64, ttl time.Duration, adminToken string) (bool, error) {
+	created, err := utils.CreateWithAdmin.Run(
+		ctx, s.Client,
+		[]string{key, adminKey},
+		initial, int(ttl.Seconds()), adminToken,
+	).Int()
+	return created == 1, err
+}
+
+func (s *RedisStore) SetXX(ctx context.Context, key string, value int64, ttl time.Duration) (bool, error) {
+	return s.Client.SetXX(ctx, key, value, ttl).Result()
+}
+
+// Del removes keys with a single variadic DEL.
+func (s *RedisStore) Del(ctx context.Context, keys ...string) error {
+	return s.Client.Del(ctx, keys...).Err()
+}
+
+func (s *RedisStore) TTL(ctx context.Context, key string) (time.Duration, error) {
+	return s.Client.TTL(ctx, key).Result()
+}
+
+func (s *RedisStore) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	return s.Client.Expire(ctx, key, ttl).Err()
+}
+
+func (s *RedisStore) SetNX(ctx context.Context, key, value string, ttl time.Duration) (bool, error) {
+	return s.Client.SetNX(ctx, key, value, ttl).Result()
+}
+
+// IncrWithinLimits runs utils.IncrWithinLimits so the windows are checked
+// and charged together, and a crash between an INCR and its PEXPIRE can't
+// leave a window that never expires.
+func (s *RedisStore) IncrWithinLimits(ctx context.Context, windows []Window) (bool, error) {
+	if len(windows) == 0 {
+		return true, nil
+	}
+	keys := make([]string, len(windows))
+	args := make([]any, 0, 2*len(windows))
+	for i, w := range windows {
+		keys[i] = w.Key
+		args = append(args, w.Limit, w.TTL.Milliseconds())
+	}
+	counted, err := utils.IncrWithinLimits.Run(ctx, s.Client, keys, args...).Int()
+	return counted == 1, err
+}
+
+// CompareAndSwap runs utils.CompareAndSwap so the check and the write are
+// atomic.
+func (s *RedisStore) CompareAndSwap(ctx context.Context, key, old, value string) (bool, error) {
+	swapped, err := utils.CompareAndSwap.Run(ctx, s.Client, []string{key}, old, value).Int()
+	return swapped == 1, err
+}
+
+// ScanPrefix walks SCAN MATCH prefix* until it has limit keys or the cursor
+// wraps.
+func (s *RedisStore) ScanPrefix(ctx context.Context, prefix string, limit int) ([]string, error) {
+	pattern := globEscaper.Replace(prefix) + "*"
+	var found []string
+	var cursor uint64
+	for {
+		keys, next, err := s.Client.Scan(ctx, cursor, pattern, 1000).Result()
+		if err != nil {
+			return nil, err
+		}
+		found = append(found, keys...)
+		if len(found) >= limit {
+			return found[:limit], nil
+		}
+		if next == 0 {
+			return found, nil
+		}
+		cursor = next
+	}
+}
+
+// globEscaper escapes the characters MATCH patterns treat specially.
+var globEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+
+// Info pipelines GET/EXISTS/TTL into one RTT instead of three.
+func (s *RedisStore) Info(ctx context.Context, key, adminKey string) (KeyInfo, error) {
+	pipe := s.Client.Pipeline()
+	getCmd := pipe.Get(ctx, key)
+	existsCmd := pipe.Exists(ctx, adminKey)
+	ttlCmd := pipe.TTL(ctx, key)
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		// Real transport failure. Don't fabricate exists=true.
+		return KeyInfo{}, err
+	}
+	// Re-check each cmd individually; pipeline Exec returns only the first error.
+	if err := existsCmd.Err(); err != nil && !errors.Is(err, redis.Nil) {
+		return KeyInfo{}, err
+	}
+	if err := ttlCmd.Err(); err != nil && !errors.Is(err, redis.Nil) {
+		return KeyInfo{}, err
+	}
+	return KeyInfo{Value: getCmd.Val(), HasAdmin: existsCmd.Val() != 0, TTL: ttlCmd.Val()}, nil
+}
+
+// AddUnique pipelines PFADD + PFCOUNT into one RTT.
+func (s *RedisStore) AddUnique(ctx context.Context, key, member string) (int64, error) {
+	pipe := s.Client.Pipeline()
+	pipe.PFAdd(ctx, key, member)
+	countCmd := pipe.PFCount(ctx, key)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	return countCmd.Val(), nil
+}
+
+func (s *RedisStore) CountUnique(ctx context.Context, key string) (int64, error) {
+	return s.Client.PFCount(ctx, key).Result()
+}
+
+// ServerInfo parses the Server and Stats sections of INFO.
+func (s *RedisStore) ServerInfo(ctx context.Context) (ServerInfo, error) {
+	infoStr, err := s.Client.Info(ctx).Result()
+	if err != nil {
+		return ServerInfo{}, err
+	}
+
+	infoDict := make(map[string]map[string]string)
+	sections := strings.Split(infoStr, "\r\n\r\n")
+
+	for _, section := range sections {
+		lines := strings.Split(section, "\r\n")
+		if len(lines) == 0 || len(lines[0]) < 2 {
+			continue
+		}
+		sectionName := lines[0][2:] // Remove "# " prefix
+
+		infoDict[sectionName] = make(map[string]string)
+		for _, line := range lines[1:] {
+			parts := strings.Split(line, ":")
+			if len(parts) == 2 {
+				key := strings.TrimSpace(parts[0])
+				value := strings.TrimSpace(parts[1])
+				infoDict[sectionName][key] = value
+			}
+		}
+	}
+
+	return ServerInfo{
+		Uptime:         infoDict["Server"]["uptime_in_seconds"],
+		Version:        infoDict["Server"]["redis_version"],
+		ExpiredKeys:    infoDict["Stats"]["expired_keys"],
+		KeyspaceMisses: infoDict["Stats"]["keyspace_misses"],
+	}, nil
+}
+
+func (s *RedisStore) Close() error {
+	return s.Client.Close()
+}
+
+// compile-time check
+var _ CounterStore = (*RedisStore)(nil)
@@ -0,0 +1,136 @@
+// Package store abstracts the database behind abacus's counters so handlers
+// don't talk to Redis directly. RedisStore is what production runs on;
+// BoltStore is an embedded on-disk alternative for small self-hosted
+// deployments that would rather ship one binary than run Redis next to it.
+//
+// Keys keep the prefix scheme documented in docs/DB.md (K:, A:, U:, H:, …)
+// regardless of backend, so the same utils.Create*Key helpers work for both.
+package store
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// ErrNotFound is returned when a key is missing (or has expired). It plays
+// the role redis.Nil used to play in the handlers.
+var ErrNotFound = errors.New("store: key not found")
+
+// TTL sentinels, matching the values Redis' TTL command reports.
+const (
+	TTLMissing    = time.Duration(-2) // key does not exist
+	TTLPersistent = time.Duration(-1) // key exists but never expires
+)
+
+// KeyInfo is everything /info needs about a counter, fetched in one call.
+type KeyInfo struct {
+	Value    string        // raw value, "" if the key is missing
+	HasAdmin bool          // an admin key exists, i.e. the counter isn't genuine
+	TTL      time.Duration // remaining lifetime, or one of the TTL sentinels
+}
+
+// Window is a fixed-window counter for IncrWithinLimits: Key holds the count
+// for the current window, which may reach Limit, and expires TTL after it's
+// created.
+type Window struct {
+	Key   string
+	Limit int64
+	TTL   time.Duration
+}
+
+// ServerInfo is the backend-level detail surfaced by /stats. Fields are
+// strings because that's what Redis INFO hands back; backends that don't
+// track something leave it empty.
+type ServerInfo struct {
+	Uptime         string // seconds
+	Version        string
+	ExpiredKeys    string
+	KeyspaceMisses string
+}
+
+// CounterStore is the storage contract used by the HTTP handlers, the Auth
+// middleware and the stats manager. Implementations must be safe for
+// concurrent use.
+//
+// Counters are int64 under K: keys. Incr and IncrByIfExists also write the
+// history buckets described by utils.History when it is enabled, so callers
+// never have to coordinate the two.
+type CounterStore interface {
+	// Get returns the value stored at key, or ErrNotFound.
+	Get(ctx context.Context, key string) (string, error)
+	// MGet returns the values of keys in order. Missing keys are "".
+	MGet(ctx context.Context, keys ...string) ([]string, error)
+	// Incr adds one to key, creating it at 0 first if needed.
+	Incr(ctx context.Context, key string) (int64, error)
+	// IncrByIfExists adds delta to key, or returns ErrNotFound if it's missing.
+	IncrByIfExists(ctx context.Context, key string, delta int64) (int64, error)
+	// IncrByMany adds each delta to its key, creating keys as needed. Used to
+	// flush batched stats.
+	IncrByMany(ctx context.Context, deltas map[string]int64) error
+	// IncrWithinLimits adds one to every window's key, giving it the window's
+	// TTL if this creates it, but only if each is still below its limit;
+	// otherwise it changes nothing. Reports whether it incremented. Made for
+	// hit quotas, so a hit one quota refuses doesn't use up another; unlike
+	// Incr it never touches history buckets.
+	IncrWithinLimits(ctx context.Context, windows []Window) (bool, error)
+	// CreateWithAdmin creates key with the given value and TTL and stores
+	// adminToken under adminKey. Reports false, touching nothing, if key
+	// already exists.
+	CreateWithAdmin(ctx context.Context, key, adminKey string, initial int64, ttl time.Duration, adminToken string) (bool, error)
+	// SetXX overwrites key with value and TTL only if it already exists.
+	SetXX(ctx context.Context, key string, value int64, ttl time.Duration) (bool, error)
+	// Del removes keys. Missing keys are ignored.
+	Del(ctx context.Context, keys ...string) error
+	// TTL returns the remaining lifetime of key, or a TTL sentinel.
+	TTL(ctx context.Context, key string) (time.Duration, error)
+	// Expire sets key's TTL. A no-op for missing keys.
+	Expire(ctx context.Context, key string, ttl time.Duration) error
+	// Info returns the value and TTL of key and whether adminKey exists.
+	Info(ctx context.Context, key, adminKey string) (KeyInfo, error)
+	// SetNX stores value at key with the given TTL (0 for none) unless key
+	// already exists, reporting whether it was stored.
+	SetNX(ctx context.Context, key, value string, ttl time.Duration) (bool, error)
+	// CompareAndSwap replaces key's value with value only if it is still old,
+	// keeping its TTL, and reports whether it did.
+	CompareAndSwap(ctx context.Context, key, old, value string) (bool, error)
+	// ScanPrefix returns up to limit keys starting with prefix, in no
+	// particular order. May scan the keyspace, so keep it off hot paths.
+	ScanPrefix(ctx context.Context, prefix string, limit int) ([]string, error)
+
+	// AddUnique records member in the distinct-member set at key and returns
+	// the set's cardinality. Cardinalities may be estimates (HyperLogLog).
+	AddUnique(ctx context.Context, key, member string) (int64, error)
+	// CountUnique returns the cardinality of the set at key, 0 if missing.
+	CountUnique(ctx context.Context, key string) (int64, error)
+
+	// ServerInfo reports backend details for /stats.
+	ServerInfo(ctx context.Context) (ServerInfo, error)
+	// Close releases the backend's resources.
+	Close() error
+}
+
+// GetThrough adapts Get to utils.GetCache's fill signature: (value, notFound,
+// error). Used by GetView and GetShieldView to keep the cache wiring in one
+// place.
+func GetThrough(ctx context.Context, s CounterStore, key string) (string, bool, error) {
+	v, err := s.Get(ctx, key)
+	if errors.Is(err, ErrNotFound) {
+		return "", true, nil
+	}
+	return v, false, err
+}
+
+// CountUniqueThrough is GetThrough for unique-visitor sets. A set that exists
+// always holds at least one member, so a cardinality of 0 is notFound.
+func CountUniqueThrough(ctx context.Context, s CounterStore, key string) (string, bool, error) {
+	n, err := s.CountUnique(ctx, key)
+	if err != nil {
+		return "", false, err
+	}
+	if n == 0 {
+		return "", true, nil
+	}
+	return strconv.FormatInt(n, 10), false, nil
+}
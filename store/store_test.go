@@ -0,0 +1,321 @@
+package store
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/require"
+
+	"pkg.jsn.cam/abacus/utils"
+)
+
+// backends runs fn against every CounterStore implementation so they can't
+// drift apart. Redis is exercised through miniredis.
+func backends(t *testing.T, fn func(t *testing.T, s CounterStore)) {
+	t.Run("redis", func(t *testing.T) {
+		mr := miniredis.RunT(t)
+		s := NewRedis(redis.NewClient(&redis.Options{Addr: mr.Addr()}))
+		defer s.Close()
+		fn(t, s)
+	})
+	t.Run("bolt", func(t *testing.T) {
+		s, err := OpenBolt(filepath.Join(t.TempDir(), "abacus.db"))
+		require.NoError(t, err)
+		defer s.Close()
+		fn(t, s)
+	})
+}
+
+func TestCounterLifecycle(t *testing.T) {
+	backends(t, func(t *testing.T, s CounterStore) {
+		ctx := context.Background()
+
+		_, err := s.Get(ctx, "K:ns:key")
+		require.ErrorIs(t, err, ErrNotFound)
+		ttl, err := s.TTL(ctx, "K:ns:key")
+		require.NoError(t, err)
+		require.Equal(t, TTLMissing, ttl)
+
+		created, err := s.CreateWithAdmin(ctx, "K:ns:key", "A:ns:key", 5, time.Hour, "secret")
+		require.NoError(t, err)
+		require.True(t, created)
+		created, err = s.CreateWithAdmin(ctx, "K:ns:key", "A:ns:key", 9, time.Hour, "other")
+		require.NoError(t, err)
+		require.False(t, created, "existing keys must not be overwritten")
+
+		token, err := s.Get(ctx, "A:ns:key")
+		require.NoError(t, err)
+		require.Equal(t, "secret", token)
+
+		val, err := s.Incr(ctx, "K:ns:key")
+		require.NoError(t, err)
+		require.Equal(t, int64(6), val)
+		val, err = s.IncrByIfExists(ctx, "K:ns:key", -4)
+		require.NoError(t, err)
+		require.Equal(t, int64(2), val)
+
+		info, err := s.Info(ctx, "K:ns:key", "A:ns:key")
+		require.NoError(t, err)
+		require.Equal(t, "2", info.Value)
+		require.True(t, info.HasAdmin)
+		require.Greater(t, info.TTL, 59*time.Minute)
+
+		set, err := s.SetXX(ctx, "K:ns:key", 42, 2*time.Hour)
+		require.NoError(t, err)
+		require.True(t, set)
+		raw, err := s.Get(ctx, "K:ns:key")
+		require.NoError(t, err)
+		require.Equal(t, "42", raw)
+
+		require.NoError(t, s.Del(ctx, "K:ns:key", "A:ns:key"))
+		_, err = s.Get(ctx, "K:ns:key")
+		require.ErrorIs(t, err, ErrNotFound)
+		info, err = s.Info(ctx, "K:ns:key", "A:ns:key")
+		require.NoError(t, err)
+		require.Equal(t, TTLMissing, info.TTL)
+		require.False(t, info.HasAdmin)
+	})
+}
+
+func TestMissingKeys(t *testing.T) {
+	backends(t, func(t *testing.T, s CounterStore) {
+		ctx := context.Background()
+
+		_, err := s.IncrByIfExists(ctx, "K:ns:missing", 3)
+		require.ErrorIs(t, err, ErrNotFound)
+		set, err := s.SetXX(ctx, "K:ns:missing", 3, time.Hour)
+		require.NoError(t, err)
+		require.False(t, set)
+		require.NoError(t, s.Expire(ctx, "K:ns:missing", time.Hour))
+		_, err = s.Get(ctx, "K:ns:missing")
+		require.ErrorIs(t, err, ErrNotFound, "Expire must not create keys")
+
+		// Incr creates the key without a TTL.
+		val, err := s.Incr(ctx, "K:ns:fresh")
+		require.NoError(t, err)
+		require.Equal(t, int64(1), val)
+		ttl, err := s.TTL(ctx, "K:ns:fresh")
+		require.NoError(t, err)
+		require.Equal(t, TTLPersistent, ttl)
+
+		vals, err := s.MGet(ctx, "K:ns:fresh", "K:ns:missing")
+		require.NoError(t, err)
+		require.Equal(t, []string{"1", ""}, vals)
+	})
+}
+
+func TestSetNXAndScanPrefix(t *testing.T) {
+	backends(t, func(t *testing.T, s CounterStore) {
+		ctx := context.Background()
+
+		set, err := s.SetNX(ctx, "N:ns", "token", 0)
+		require.NoError(t, err)
+		require.True(t, set)
+		set, err = s.SetNX(ctx, "N:ns", "other", 0)
+		require.NoError(t, err)
+		require.False(t, set, "existing keys must not be overwritten")
+		val, err := s.Get(ctx, "N:ns")
+		require.NoError(t, err)
+		require.Equal(t, "token", val)
+		ttl, err := s.TTL(ctx, "N:ns")
+		require.NoError(t, err)
+		require.Equal(t, TTLPersistent, ttl)
+
+		keys, err := s.ScanPrefix(ctx, "K:ns:", 10)
+		require.NoError(t, err)
+		require.Empty(t, keys)
+		_, err = s.Incr(ctx, "K:ns:key")
+		require.NoError(t, err)
+		_, err = s.Incr(ctx, "K:nsx:key")
+		require.NoError(t, err)
+		keys, err = s.ScanPrefix(ctx, "K:n*:", 10)
+		require.NoError(t, err)
+		require.Empty(t, keys, "the prefix is literal, not a pattern")
+
+		_, err = s.Incr(ctx, "K:ns:other")
+		require.NoError(t, err)
+		keys, err = s.ScanPrefix(ctx, "K:ns:", 10)
+		require.NoError(t, err)
+		require.ElementsMatch(t, []string{"K:ns:key", "K:ns:other"}, keys)
+		keys, err = s.ScanPrefix(ctx, "K:ns:", 1)
+		require.NoError(t, err)
+		require.Len(t, keys, 1)
+	})
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	backends(t, func(t *testing.T, s CounterStore) {
+		ctx := context.Background()
+		swapped, err := s.CompareAndSwap(ctx, "A:ns:key", "old", "new")
+		require.NoError(t, err)
+		require.False(t, swapped, "missing keys are never swapped")
+
+		_, err = s.SetNX(ctx, "A:ns:key", "old", time.Hour)
+		require.NoError(t, err)
+		swapped, err = s.CompareAndSwap(ctx, "A:ns:key", "stale", "new")
+		require.NoError(t, err)
+		require.False(t, swapped)
+		swapped, err = s.CompareAndSwap(ctx, "A:ns:key", "old", "new")
+		require.NoError(t, err)
+		require.True(t, swapped)
+
+		val, err := s.Get(ctx, "A:ns:key")
+		require.NoError(t, err)
+		require.Equal(t, "new", val)
+		ttl, err := s.TTL(ctx, "A:ns:key")
+		require.NoError(t, err)
+		require.InDelta(t, time.Hour, ttl, float64(2*time.Second), "the TTL is kept")
+	})
+}
+
+func TestIncrWithinLimits(t *testing.T) {
+	backends(t, func(t *testing.T, s CounterStore) {
+		ctx := context.Background()
+		key := Window{Key: "Q:ns:key:1", Limit: 3, TTL: time.Minute}
+		ns := Window{Key: "Q:ns:1", Limit: 2, TTL: time.Minute}
+		for i := 0; i < 2; i++ {
+			counted, err := s.IncrWithinLimits(ctx, []Window{key, ns})
+			require.NoError(t, err)
+			require.True(t, counted)
+		}
+		counted, err := s.IncrWithinLimits(ctx, []Window{key, ns})
+		require.NoError(t, err)
+		require.False(t, counted, "the namespace window is full")
+		val, err := s.Get(ctx, "Q:ns:key:1")
+		require.NoError(t, err)
+		require.Equal(t, "2", val, "a refused increment charges no window")
+
+		counted, err = s.IncrWithinLimits(ctx, []Window{key})
+		require.NoError(t, err)
+		require.True(t, counted)
+		counted, err = s.IncrWithinLimits(ctx, []Window{key})
+		require.NoError(t, err)
+		require.False(t, counted)
+
+		ttl, err := s.TTL(ctx, "Q:ns:key:1")
+		require.NoError(t, err)
+		require.InDelta(t, time.Minute, ttl, float64(2*time.Second), "the TTL is set on creation")
+
+		// Later increments don't push the expiry back.
+		require.NoError(t, s.Expire(ctx, "Q:ns:1", time.Second))
+		_, err = s.IncrWithinLimits(ctx, []Window{{Key: "Q:ns:1", Limit: 10, TTL: time.Minute}})
+		require.NoError(t, err)
+		ttl, err = s.TTL(ctx, "Q:ns:1")
+		require.NoError(t, err)
+		require.LessOrEqual(t, ttl, time.Second)
+	})
+}
+
+func TestIncrByMany(t *testing.T) {
+	backends(t, func(t *testing.T, s CounterStore) {
+		ctx := context.Background()
+		require.NoError(t, s.IncrByMany(ctx, map[string]int64{"stats:Total": 10, "stats:hit": 4}))
+		require.NoError(t, s.IncrByMany(ctx, map[string]int64{"stats:Total": 5}))
+
+		vals, err := s.MGet(ctx, "stats:Total", "stats:hit")
+		require.NoError(t, err)
+		require.Equal(t, []string{"15", "4"}, vals)
+	})
+}
+
+func TestUniqueCounts(t *testing.T) {
+	backends(t, func(t *testing.T, s CounterStore) {
+		ctx := context.Background()
+
+		n, err := s.CountUnique(ctx, "U:ns:key")
+		require.NoError(t, err)
+		require.Zero(t, n)
+
+		for _, member := range []string{"a", "b", "a", "c", "b"} {
+			n, err = s.AddUnique(ctx, "U:ns:key", member)
+			require.NoError(t, err)
+		}
+		require.Equal(t, int64(3), n)
+		n, err = s.CountUnique(ctx, "U:ns:key")
+		require.NoError(t, err)
+		require.Equal(t, int64(3), n)
+
+		val, notFound, err := CountUniqueThrough(ctx, s, "U:ns:key")
+		require.NoError(t, err)
+		require.False(t, notFound)
+		require.Equal(t, "3", val)
+
+		require.NoError(t, s.Del(ctx, "U:ns:key"))
+		_, notFound, err = CountUniqueThrough(ctx, s, "U:ns:key")
+		require.NoError(t, err)
+		require.True(t, notFound)
+	})
+}
+
+func TestIncrWritesHistory(t *testing.T) {
+	prev := utils.History
+	defer utils.InitHistory(prev)
+	utils.InitHistory(utils.HistoryConfig{Enabled: true, HourlyRetention: time.Hour, DailyRetention: 24 * time.Hour})
+
+	backends(t, func(t *testing.T, s CounterStore) {
+		ctx := context.Background()
+		_, err := s.Incr(ctx, "K:ns:key")
+		require.NoError(t, err)
+		_, err = s.IncrByIfExists(ctx, "K:ns:key", 4)
+		require.NoError(t, err)
+
+		now := time.Now()
+		hour := utils.HistoryBucketKey("K:ns:key", utils.GranularityHour, now)
+		day := utils.HistoryBucketKey("K:ns:key", utils.GranularityDay, now)
+		vals, err := s.MGet(ctx, hour, day)
+		require.NoError(t, err)
+		require.Equal(t, []string{"5", "5"}, vals)
+
+		ttl, err := s.TTL(ctx, hour)
+		require.NoError(t, err)
+		require.Greater(t, ttl, 59*time.Minute)
+		require.LessOrEqual(t, ttl, time.Hour)
+	})
+}
+
+// Expired records read as missing straight away; the sweeper reclaims them
+// later and counts them for /stats.
+func TestBoltExpiry(t *testing.T) {
+	s, err := OpenBolt(filepath.Join(t.TempDir(), "abacus.db"))
+	require.NoError(t, err)
+	defer s.Close()
+	ctx := context.Background()
+
+	created, err := s.CreateWithAdmin(ctx, "K:ns:key", "A:ns:key", 1, time.Millisecond, "secret")
+	require.NoError(t, err)
+	require.True(t, created)
+	time.Sleep(5 * time.Millisecond)
+
+	_, err = s.Get(ctx, "K:ns:key")
+	require.ErrorIs(t, err, ErrNotFound)
+	created, err = s.CreateWithAdmin(ctx, "K:ns:key", "A:ns:key", 7, 0, "fresh")
+	require.NoError(t, err)
+	require.True(t, created, "an expired key can be created again")
+
+	require.NoError(t, s.Expire(ctx, "K:ns:key", time.Millisecond))
+	time.Sleep(5 * time.Millisecond)
+	removed, err := s.sweepOnce(time.Now())
+	require.NoError(t, err)
+	require.Equal(t, 1, removed)
+}
+
+// Data must survive a close and reopen; that's the point of the backend.
+func TestBoltPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "abacus.db")
+	s, err := OpenBolt(path)
+	require.NoError(t, err)
+	_, err = s.Incr(context.Background(), "K:ns:key")
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	s, err = OpenBolt(path)
+	require.NoError(t, err)
+	defer s.Close()
+	val, err := s.Get(context.Background(), "K:ns:key")
+	require.NoError(t, err)
+	require.Equal(t, "1", val)
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/goccy/go-json"
+
+	"pkg.jsn.cam/abacus/store"
+	"pkg.jsn.cam/abacus/utils"
+)
+
+// MaxStreamKeys caps ?keys= on a multi-key stream.
+const MaxStreamKeys = 50
+
+// streamEvent is the payload of multi-key and namespace stream events.
+type streamEvent struct {
+	Key   string `json:"key"`
+	Value *int   `json:"value,omitempty"`
+}
+
+// StreamValueView serves /stream. Depending on the URL it streams one key
+// (/stream/:namespace/:key), a list of keys (/stream/:namespace?keys=a,b) or
+// every key in a namespace (/stream/:namespace/*).
+func StreamValueView(c *gin.Context) {
+	switch key := strings.Trim(c.Param("key"), "/"); {
+	case key == "*":
+		streamNamespace(c)
+		return
+	case key == "" && c.Query("keys") != "":
+		streamKeys(c)
+		return
+	}
+
+	namespace, key := utils.GetNamespaceKey(c)
+	if namespace == "" || key == "" {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	dbKey := utils.CreateKey(c, namespace, key, false)
+	if dbKey == "" {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	// Send initial value. ErrNotFound = key doesn't exist yet (legit, just
+	// stream future updates). Any other error gets logged so it isn't silently lost.
+	var initial []utils.KeyValue
+	initialVal, err := Store.Get(context.Background(), dbKey)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		log.Printf("StreamValueView initial GET for %s failed: %v", dbKey, err)
+	} else if count, convErr := strconv.Atoi(initialVal); convErr == nil {
+		initial = append(initial, utils.KeyValue{Key: dbKey, Value: count})
+	}
+
+	serveStream(c, utils.KeyClientPair{Key: dbKey}, dbKey, initial, valueEventID, func(id string, kv utils.KeyValue) bool {
+		if kv.Deleted {
+			return false
+		}
+		// Keep your exact format
+		return writeStream(c, fmt.Sprintf("id: %s\ndata: {\"value\":%d}\n\n", id, kv.Value))
+	})
+}
+
+// streamKeys serves /stream/:namespace?keys=a,b,c: one connection for
+// several counters, each change sent as a named event.
+func streamKeys(c *gin.Context) {
+	namespace := c.Param("namespace")
+	var dbKeys []string
+	seen := make(map[string]bool)
+	for _, key := range strings.Split(c.Query("keys"), ",") {
+		key = strings.TrimSpace(key)
+		if key == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		dbKey := utils.CreateKey(c, namespace, key, false)
+		if dbKey == "" {
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+		dbKeys = append(dbKeys, dbKey)
+	}
+	if len(dbKeys) == 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "keys must list at least one key, e.g. ?keys=a,b,c"})
+		return
+	}
+	if len(dbKeys) > MaxStreamKeys {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "A stream can follow at most " + strconv.Itoa(MaxStreamKeys) + " keys."})
+		return
+	}
+
+	// Current values for the keys that exist, in the order requested.
+	var initial []utils.KeyValue
+	vals, err := Store.MGet(context.Background(), dbKeys...)
+	if err != nil {
+		log.Printf("StreamValueView initial MGET for %s failed: %v", namespace, err)
+	}
+	for i, raw := range vals {
+		if count, convErr := strconv.Atoi(raw); convErr == nil {
+			initial = append(initial, utils.KeyValue{Key: dbKeys[i], Value: count})
+		}
+	}
+
+	serveStream(c, utils.KeyClientPair{Keys: dbKeys}, namespace, initial, namedEventID, namedEventWriter(c))
+}
+
+// streamNamespace serves /stream/:namespace/*: every change to any key in the
+// namespace. Only changes are sent; there's no initial snapshot.
+func streamNamespace(c *gin.Context) {
+	namespace := utils.CreateNamespace(c, c.Param("namespace"))
+	if namespace == "" {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	serveStream(c, utils.KeyClientPair{Namespace: namespace}, namespace+":*", nil, namedEventID, namedEventWriter(c))
+}
+
+// Event IDs let a reconnecting EventSource resume: the browser sends the last
+// one back as Last-Event-ID, and serveStream skips an initial value the client
+// already has. A counter's value is its own ID on a single-key stream; streams
+// covering several keys prefix it with the key, e.g. "visits:42". IDs are
+// compared for equality, so a counter that's set back to an earlier value is
+// still treated as unchanged.
+func valueEventID(kv utils.KeyValue) string {
+	return strconv.Itoa(kv.Value)
+}
+
+func namedEventID(kv utils.KeyValue) string {
+	return shortKey(kv.Key) + ":" + strconv.Itoa(kv.Value)
+}
+
+// shortKey strips the K:<namespace>: prefix from a db key.
+func shortKey(dbKey string) string {
+	return strings.TrimPrefix(dbKey, "K:"+utils.NamespaceOf(dbKey)+":")
+}
+
+// namedEventWriter formats events for multi-key and namespace streams:
+//
+//	id: a:5
+//	event: value
+//	data: {"key":"a","value":5}
+//
+//	event: delete
+//	data: {"key":"a"}
+//
+// Deletes carry no ID, so a reconnect resumes from the last value seen.
+func namedEventWriter(c *gin.Context) func(string, utils.KeyValue) bool {
+	return func(id string, kv utils.KeyValue) bool {
+		frame := "event: value\n"
+		ev := streamEvent{Key: shortKey(kv.Key)}
+		if kv.Deleted {
+			frame = "event: delete\n"
+		} else {
+			frame = "id: " + id + "\n" + frame
+			ev.Value = &kv.Value
+		}
+		data, err := json.Marshal(ev)
+		if err != nil {
+			return false
+		}
+		return writeStream(c, frame+"data: "+string(data)+"\n\n")
+	}
+}
+
+func writeStream(c *gin.Context, frame string) bool {
+	if _, err := c.Writer.WriteString(frame); err != nil {
+		log.Printf("Error writing to client: %v", err)
+		return false
+	}
+	c.Writer.Flush()
+	return true
+}
+
+// maxRateInterval reads ?max_rate=, the most updates per second a client
+// wants for any one key, as the interval between them. Zero means every
+// update.
+func maxRateInterval(c *gin.Context) (time.Duration, error) {
+	raw := c.Query("max_rate")
+	if raw == "" {
+		return 0, nil
+	}
+	rate, err := strconv.ParseFloat(raw, 64)
+	if err != nil || !(rate > 0) {
+		return 0, errors.New("max_rate must be a positive number of updates per second, e.g. ?max_rate=10")
+	}
+	return time.Duration(float64(time.Second) / rate), nil
+}
+
+// serveStream registers sub with the event server, writes initial, then
+// hands every update to write until the client disconnects or write returns
+// false. eventID names each value event (deletes get no ID); initial values
+// matching the request's Last-Event-ID are skipped. label identifies the
+// stream in logs.
+func serveStream(c *gin.Context, sub utils.KeyClientPair, label string, initial []utils.KeyValue, eventID func(utils.KeyValue) string, write func(string, utils.KeyValue) bool) {
+	interval, err := maxRateInterval(c)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	sub.Interval = interval
+
+	// Set SSE headers
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+
+	// Initialize client channel with a buffer to prevent blocking
+	clientChan := make(chan utils.KeyValue, 100)
+	sub.Client = clientChan
+
+	// Create a context that's canceled when the client disconnects
+	ctx := c.Request.Context()
+
+	// Add this client to the event server
+	utils.ValueEventServer.NewClients <- sub
+
+	// Track if cleanup has been done
+	var cleanupDone bool
+	var cleanupMutex sync.Mutex
+
+	// Ensure client is always removed when handler exits
+	defer func() {
+		cleanupMutex.Lock()
+		if !cleanupDone {
+			cleanupDone = true
+			cleanupMutex.Unlock()
+
+			// Signal the event server to remove this client
+			select {
+			case utils.ValueEventServer.ClosedClients <- utils.KeyClientPair{Client: clientChan}:
+				// Successfully sent cleanup signal
+			case <-time.After(500 * time.Millisecond):
+				// Timed out waiting to send cleanup signal
+				log.Printf("Warning: Timed out sending cleanup signal for %s", label)
+			}
+		} else {
+			cleanupMutex.Unlock()
+		}
+	}()
+
+	// Monitor for client disconnection in a separate goroutine
+	go func() {
+		<-ctx.Done() // Wait for context cancellation (client disconnected)
+
+		cleanupMutex.Lock()
+		if !cleanupDone {
+			cleanupDone = true
+			cleanupMutex.Unlock()
+
+			log.Printf("Client disconnected for %s, cleaning up", label)
+
+			// Signal the event server to remove this client
+			select {
+			case utils.ValueEventServer.ClosedClients <- utils.KeyClientPair{Client: clientChan}:
+				// Successfully sent cleanup signal
+			case <-time.After(500 * time.Millisecond):
+				// Timed out waiting to send cleanup signal
+				log.Printf("Warning: Timed out sending cleanup signal for %s after disconnect", label)
+			}
+		} else {
+			cleanupMutex.Unlock()
+		}
+	}()
+
+	// Flush headers now so the client sees the stream open even when there's
+	// nothing to send yet (missing keys, namespace streams).
+	c.Writer.WriteHeaderNow()
+	c.Writer.Flush()
+
+	send := func(kv utils.KeyValue) bool {
+		if kv.Deleted {
+			return write("", kv)
+		}
+		return write(eventID(kv), kv)
+	}
+
+	if retry := utils.SSE.Retry; retry > 0 {
+		if !writeStream(c, "retry: "+strconv.FormatInt(retry.Milliseconds(), 10)+"\n\n") {
+			return
+		}
+	}
+	lastEventID := c.GetHeader("Last-Event-ID")
+	for _, kv := range initial {
+		if lastEventID != "" && eventID(kv) == lastEventID {
+			continue // the client already has this value
+		}
+		if !send(kv) {
+			return
+		}
+	}
+
+	// Heartbeats keep proxies from cutting quiet streams and surface dead
+	// peers as write errors; the timers reclaim long-lived and idle ones.
+	cfg := utils.SSE
+	heartbeat, stopHeartbeat := tickEvery(cfg.Heartbeat)
+	defer stopHeartbeat()
+	lifetime, stopLifetime := fireAfter(cfg.MaxLifetime)
+	defer stopLifetime()
+	var idle <-chan time.Time
+	var idleTimer *time.Timer
+	if cfg.IdleTimeout > 0 {
+		idleTimer = time.NewTimer(cfg.IdleTimeout)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+
+	// Stream updates
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-ctx.Done():
+			return false
+		case kv, ok := <-clientChan:
+			if !ok {
+				return false
+			}
+			if idleTimer != nil {
+				idleTimer.Reset(cfg.IdleTimeout)
+			}
+			return send(kv)
+		case <-heartbeat:
+			if !writeStream(c, ": ping\n\n") {
+				utils.SSEHeartbeatCloses.Add(1)
+				return false
+			}
+			return true
+		case <-lifetime:
+			utils.SSELifetimeCloses.Add(1)
+			log.Printf("Closing stream for %s: max lifetime reached", label)
+			return false
+		case <-idle:
+			utils.SSEIdleCloses.Add(1)
+			log.Printf("Closing stream for %s: idle for %s", label, cfg.IdleTimeout)
+			return false
+		}
+	})
+}
+
+// tickEvery returns a channel ticking every d, or a nil channel (never ready)
+// when d is zero.
+func tickEvery(d time.Duration) (<-chan time.Time, func()) {
+	if d <= 0 {
+		return nil, func() {}
+	}
+	t := time.NewTicker(d)
+	return t.C, t.Stop
+}
+
+// fireAfter returns a channel firing once after d, or a nil channel when d
+// is zero.
+func fireAfter(d time.Duration) (<-chan time.Time, func()) {
+	if d <= 0 {
+		return nil, func() {}
+	}
+	t := time.NewTimer(d)
+	return t.C, func() { t.Stop() }
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"bufio"
 	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -361,6 +363,316 @@ func TestStreamConcurrencyStress(t *testing.T) {
 	time.Sleep(200 * time.Millisecond)
 }
 
+// sseEvent is one parsed SSE frame.
+type sseEvent struct {
+	id   string
+	name string
+	data string
+}
+
+// readSSE parses frames from body onto the returned channel until body closes.
+func readSSE(body io.Reader) <-chan sseEvent {
+	events := make(chan sseEvent, 20)
+	go func() {
+		defer close(events)
+		scanner := bufio.NewScanner(body)
+		var ev sseEvent
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case line == "":
+				if ev.data != "" {
+					events <- ev
+				}
+				ev = sseEvent{}
+			case strings.HasPrefix(line, "id: "):
+				ev.id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "event: "):
+				ev.name = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				ev.data = strings.TrimPrefix(line, "data: ")
+			}
+		}
+	}()
+	return events
+}
+
+func nextSSE(t *testing.T, events <-chan sseEvent) sseEvent {
+	t.Helper()
+	select {
+	case ev := <-events:
+		return ev
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timeout waiting for event")
+		return sseEvent{}
+	}
+}
+
+// One connection can follow several keys; every event names its key.
+func TestStreamMultipleKeys(t *testing.T) {
+	router := setupTestRouter()
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	for _, key := range []string{"first", "second"} {
+		resp, err := http.Post(server.URL+"/create/multikey/"+key+"?initializer=10", "", nil)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+	}
+
+	resp, err := http.Get(server.URL + "/stream/multikey?keys=first,second,third")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	events := readSSE(resp.Body)
+
+	// Initial values for the keys that exist.
+	assert.Equal(t, sseEvent{"first:10", "value", `{"key":"first","value":10}`}, nextSSE(t, events))
+	assert.Equal(t, sseEvent{"second:10", "value", `{"key":"second","value":10}`}, nextSSE(t, events))
+
+	require.Eventually(t, func() bool { return countClientsForKey("K:multikey:third") == 1 }, time.Second, 10*time.Millisecond)
+	hit, err := http.Get(server.URL + "/hit/multikey/second")
+	require.NoError(t, err)
+	hit.Body.Close()
+	assert.Equal(t, sseEvent{"second:11", "value", `{"key":"second","value":11}`}, nextSSE(t, events))
+
+	hit, err = http.Get(server.URL + "/hit/multikey/third")
+	require.NoError(t, err)
+	hit.Body.Close()
+	assert.Equal(t, sseEvent{"third:1", "value", `{"key":"third","value":1}`}, nextSSE(t, events))
+
+	resp.Body.Close()
+	require.Eventually(t, func() bool {
+		return countClientsForKey("K:multikey:first") == 0 && countClientsForKey("K:multikey:third") == 0
+	}, time.Second, 10*time.Millisecond, "every key the client followed must be cleaned up")
+}
+
+func TestStreamMultipleKeysValidation(t *testing.T) {
+	router := setupTestRouter()
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/stream/multikey?keys=ok1,x", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	keys := make([]string, MaxStreamKeys+1)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key%d", i)
+	}
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/stream/multikey?keys="+strings.Join(keys, ","), nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	for _, rate := range []string{"0", "-1", "fast", "NaN"} {
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/stream/multikey?keys=first&max_rate="+rate, nil))
+		assert.Equal(t, http.StatusBadRequest, w.Code, rate)
+	}
+}
+
+// /stream/:namespace/* follows every key in the namespace, including keys
+// created after the client connected, and reports deletions.
+func TestStreamNamespace(t *testing.T) {
+	router := setupTestRouter()
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/stream/wholens/*")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	events := readSSE(resp.Body)
+	require.Eventually(t, func() bool {
+		return utils.ValueEventServer.CountClientsForNamespace("wholens") == 1
+	}, time.Second, 10*time.Millisecond)
+
+	create, err := http.Post(server.URL+"/create/wholens/counter", "", nil)
+	require.NoError(t, err)
+	var created map[string]any
+	require.NoError(t, json.NewDecoder(create.Body).Decode(&created))
+	create.Body.Close()
+	assert.Equal(t, sseEvent{"counter:0", "value", `{"key":"counter","value":0}`}, nextSSE(t, events))
+
+	hit, err := http.Get(server.URL + "/hit/othernamespace/counter")
+	require.NoError(t, err)
+	hit.Body.Close()
+	hit, err = http.Get(server.URL + "/hit/wholens/counter")
+	require.NoError(t, err)
+	hit.Body.Close()
+	assert.Equal(t, sseEvent{"counter:1", "value", `{"key":"counter","value":1}`}, nextSSE(t, events))
+
+	req, _ := http.NewRequest("POST", server.URL+"/delete/wholens/counter", nil)
+	req.Header.Set("Authorization", "Bearer "+created["admin_key"].(string))
+	del, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	del.Body.Close()
+	assert.Equal(t, sseEvent{"", "delete", `{"key":"counter"}`}, nextSSE(t, events))
+
+	resp.Body.Close()
+	require.Eventually(t, func() bool {
+		return utils.ValueEventServer.CountClientsForNamespace("wholens") == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+// A reconnecting client sends back the last ID it saw; the current value is
+// only repeated if it changed since.
+func TestStreamResumesFromLastEventID(t *testing.T) {
+	router := setupTestRouter()
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	for _, key := range []string{"one", "two"} {
+		resp, err := http.Post(server.URL+"/create/resume/"+key+"?initializer=5", "", nil)
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	stream := func(path, lastEventID string) (*http.Response, <-chan sseEvent) {
+		req, err := http.NewRequest("GET", server.URL+path, nil)
+		require.NoError(t, err)
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		return resp, readSSE(resp.Body)
+	}
+	hit := func(key string) {
+		resp, err := http.Get(server.URL + "/hit/resume/" + key)
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	// Unchanged since the last ID: nothing until the next hit.
+	resp, events := stream("/stream/resume/one", "5")
+	require.Eventually(t, func() bool { return countClientsForKey("K:resume:one") == 1 }, time.Second, 10*time.Millisecond)
+	hit("one")
+	assert.Equal(t, sseEvent{"6", "", `{"value":6}`}, nextSSE(t, events))
+	resp.Body.Close()
+
+	// Changed since: the current value comes first.
+	resp, events = stream("/stream/resume/one", "5")
+	assert.Equal(t, sseEvent{"6", "", `{"value":6}`}, nextSSE(t, events))
+	resp.Body.Close()
+
+	// Multi-key streams only skip the key named in the ID.
+	hit("two")
+	resp, events = stream("/stream/resume?keys=one,two", "two:6")
+	assert.Equal(t, sseEvent{"one:6", "value", `{"key":"one","value":6}`}, nextSSE(t, events))
+	hit("two")
+	assert.Equal(t, sseEvent{"two:7", "value", `{"key":"two","value":7}`}, nextSSE(t, events))
+	resp.Body.Close()
+}
+
+func TestStreamSendsRetryHint(t *testing.T) {
+	router := setupTestRouter()
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/stream/retryhint/missing")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("retry: %d\n", utils.SSE.Retry.Milliseconds()), line)
+}
+
+func TestStreamHeartbeat(t *testing.T) {
+	prev := utils.SSE
+	defer utils.InitSSE(prev)
+	utils.InitSSE(utils.SSEConfig{Heartbeat: 20 * time.Millisecond})
+
+	router := setupTestRouter()
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/stream/heartbeat/quiet")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, ": ping\n", line)
+}
+
+// Streams past their max lifetime or idle timeout are closed by the server
+// and cleaned up; updates push the idle deadline back.
+func TestStreamLifetimeAndIdleTimeout(t *testing.T) {
+	prev := utils.SSE
+	defer utils.InitSSE(prev)
+
+	router := setupTestRouter()
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	utils.InitSSE(utils.SSEConfig{MaxLifetime: 100 * time.Millisecond})
+	closes := utils.SSELifetimeCloses.Load()
+	resp, err := http.Get(server.URL + "/stream/timeouts/lifetime")
+	require.NoError(t, err)
+	_, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err, "the server ends the stream cleanly")
+	assert.Equal(t, closes+1, utils.SSELifetimeCloses.Load())
+	require.Eventually(t, func() bool { return countClientsForKey("K:timeouts:lifetime") == 0 }, time.Second, 10*time.Millisecond)
+
+	utils.InitSSE(utils.SSEConfig{IdleTimeout: 300 * time.Millisecond})
+	closes = utils.SSEIdleCloses.Load()
+	start := time.Now()
+	resp, err = http.Get(server.URL + "/stream/timeouts/idle")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	events := readSSE(resp.Body)
+	require.Eventually(t, func() bool { return countClientsForKey("K:timeouts:idle") == 1 }, time.Second, 10*time.Millisecond)
+	time.Sleep(200 * time.Millisecond)
+	hit, err := http.Get(server.URL + "/hit/timeouts/idle")
+	require.NoError(t, err)
+	hit.Body.Close()
+	assert.Equal(t, `{"value":1}`, nextSSE(t, events).data)
+
+	select {
+	case _, open := <-events:
+		assert.False(t, open, "no further events expected")
+	case <-time.After(2 * time.Second):
+		t.Fatal("idle stream was never closed")
+	}
+	assert.Greater(t, time.Since(start), 450*time.Millisecond, "the hit must reset the idle timer")
+	assert.Equal(t, closes+1, utils.SSEIdleCloses.Load())
+}
+
+// Streams past the per-IP cap get a 429 until one of the client's streams
+// closes.
+func TestStreamAdmission(t *testing.T) {
+	prev := utils.SSE
+	defer utils.InitSSE(prev)
+	utils.InitSSE(utils.SSEConfig{MaxPerIP: 2})
+
+	router := setupTestRouter()
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	var open []*http.Response
+	for range 2 {
+		resp, err := http.Get(server.URL + "/stream/admission/key")
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		open = append(open, resp)
+	}
+
+	resp, err := http.Get(server.URL + "/stream/admission/key")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "30", resp.Header.Get("Retry-After"))
+
+	open[0].Body.Close()
+	require.Eventually(t, func() bool {
+		_, fromIP := utils.ValueEventServer.OpenConnections("127.0.0.1")
+		return fromIP == 1
+	}, time.Second, 10*time.Millisecond)
+	resp, err = http.Get(server.URL + "/stream/admission/key")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	open[1].Body.Close()
+}
+
 func countClientsForKey(key string) int {
 	return utils.ValueEventServer.CountClientsForKey(key)
 }
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"pkg.jsn.cam/abacus/store"
+	"pkg.jsn.cam/abacus/utils"
+)
+
+// maxTokenLabelLength caps ?label= on /tokens/create.
+const maxTokenLabelLength = 64
+
+// tokenDBKey resolves the counter named by the request. Auth has already
+// validated it, so like DeleteView this skips validation.
+func tokenDBKey(c *gin.Context) string {
+	namespace, key := utils.GetNamespaceKey(c)
+	if namespace == "" || key == "" {
+		return ""
+	}
+	return utils.CreateKey(c, namespace, key, true)
+}
+
+// CreateTokenView mints a scoped token for a counter, e.g.
+// /tokens/create/ns/key?scopes=update&expires_in=86400&label=ci. Only the
+// admin token can mint; the token is shown once.
+func CreateTokenView(c *gin.Context) {
+	dbKey := tokenDBKey(c)
+	if dbKey == "" { // error is handled in CreateKey
+		return
+	}
+	scopes, err := utils.ParseScopes(c.Query("scopes"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var ttl time.Duration
+	if raw := c.Query("expires_in"); raw != "" {
+		seconds, err := strconv.Atoi(raw)
+		if err != nil || seconds <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "expires_in must be a positive number of seconds"})
+			return
+		}
+		ttl = time.Duration(seconds) * time.Second
+	}
+	label := c.Query("label")
+	if len(label) > maxTokenLabelLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "label must be at most " + strconv.Itoa(maxTokenLabelLength) + " characters"})
+		return
+	}
+
+	token, err := utils.NewScopedToken(scopes, label, ttl)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token. Try again later."})
+		return
+	}
+	hashed := token
+	hashed.Secret, err = utils.HashToken(token.Secret)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token. Try again later."})
+		return
+	}
+	err = updateTokens(dbKey, func(tokens utils.TokenSet) (utils.TokenSet, error) {
+		if len(tokens) >= utils.MaxScopedTokens {
+			return nil, errTooManyTokens
+		}
+		return append(tokens, hashed), nil
+	})
+	switch {
+	case errors.Is(err, errTooManyTokens):
+		c.JSON(http.StatusConflict, gin.H{"error": "A key can have at most " + strconv.Itoa(utils.MaxScopedTokens) + " tokens. Revoke one first."})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create token. Try again later."})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"id": token.ID, "token": token.Token(), "scopes": token.Scopes, "label": token.Label, "expires_at": token.ExpiresAt})
+}
+
+// ListTokensView lists a counter's live scoped tokens, oldest first. Secrets
+// are never returned.
+func ListTokensView(c *gin.Context) {
+	dbKey := tokenDBKey(c)
+	if dbKey == "" { // error is handled in CreateKey
+		return
+	}
+	raw, err := Store.Get(context.Background(), utils.CreateTokenKey(dbKey))
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get data. Try again later."})
+		return
+	}
+	stored, err := utils.DecodeTokenSet(raw)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get data. Try again later."})
+		return
+	}
+	tokens := stored.Live(time.Now())
+	for i := range tokens {
+		tokens[i].Secret = ""
+	}
+	slices.SortFunc(tokens, func(a, b utils.ScopedToken) int {
+		return cmp.Or(cmp.Compare(a.CreatedAt, b.CreatedAt), strings.Compare(a.ID, b.ID))
+	})
+	c.JSON(http.StatusOK, gin.H{"tokens": tokens})
+}
+
+// RevokeTokenView deletes one scoped token, /tokens/revoke/ns/key?id=ID.
+func RevokeTokenView(c *gin.Context) {
+	id := c.Query("id")
+	if id == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "id is required, please provide the token's id in the fmt of ?id=TOKEN_ID"})
+		return
+	}
+	dbKey := tokenDBKey(c)
+	if dbKey == "" { // error is handled in CreateKey
+		return
+	}
+	err := updateTokens(dbKey, func(tokens utils.TokenSet) (utils.TokenSet, error) {
+		i := tokens.Find(id)
+		if i < 0 {
+			return nil, errTokenNotFound
+		}
+		return slices.Delete(tokens, i, i+1), nil
+	})
+	switch {
+	case errors.Is(err, errTokenNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Token not found"})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke token. Try again later."})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "message": "Revoked token: " + id})
+}
+
+// revokeAllTokens deletes every scoped token of dbKey. Called when the key is
+// deleted or created, so tokens never outlive the counter they were minted
+// for and carry over to someone else's.
+func revokeAllTokens(dbKey string) {
+	if err := Store.Del(context.Background(), utils.CreateTokenKey(dbKey)); err != nil {
+		log.Printf("Failed to revoke tokens for %s: %v", dbKey, err)
+	}
+}
+
+var (
+	errTooManyTokens = errors.New("too many tokens")
+	errTokenNotFound = errors.New("token not found")
+	errTokenConflict = errors.New("tokens changed concurrently")
+)
+
+// updateTokens applies change to dbKey's live scoped tokens and saves them,
+// retrying if another write lands in between. Expired tokens are dropped on
+// the way. An error from change is returned as is, and nothing is saved.
+func updateTokens(dbKey string, change func(utils.TokenSet) (utils.TokenSet, error)) error {
+	ctx := context.Background()
+	tokenKey := utils.CreateTokenKey(dbKey)
+	for attempt := 0; attempt < 3; attempt++ {
+		old, err := Store.Get(ctx, tokenKey)
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			return err
+		}
+		tokens, err := utils.DecodeTokenSet(old)
+		if err != nil {
+			return err
+		}
+		tokens, err = change(tokens.Live(time.Now()))
+		if err != nil {
+			return err
+		}
+		raw, err := tokens.Encode()
+		if err != nil {
+			return err
+		}
+		var saved bool
+		if old == "" {
+			saved, err = Store.SetNX(ctx, tokenKey, raw, 0)
+		} else {
+			saved, err = Store.CompareAndSwap(ctx, tokenKey, old, raw)
+		}
+		if err != nil {
+			return err
+		}
+		if saved {
+			return nil
+		}
+	}
+	return errTokenConflict
+}
@@ -0,0 +1,60 @@
+package utils
+
+import (
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/google/uuid"
+)
+
+// APIKey is the record of a rate limit API key issued through
+// /ratelimit/keys, stored under L:{id}. Like a scoped token, the key handed
+// out is "{id}.{secret}" and only a hash of the secret is kept.
+type APIKey struct {
+	ID        string `json:"id"`
+	Secret    string `json:"secret,omitempty"`
+	Tier      string `json:"tier"`
+	Label     string `json:"label,omitempty"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// NewAPIKey issues a key for tier. Secret is plaintext until the caller
+// hashes it for the store.
+func NewAPIKey(tier, label string) (APIKey, error) {
+	id, err := GenerateRandomString(12)
+	if err != nil {
+		return APIKey{}, err
+	}
+	return APIKey{ID: id, Secret: uuid.New().String(), Tier: tier, Label: label, CreatedAt: time.Now().Unix()}, nil
+}
+
+// Key is what the client sends: "{id}.{secret}".
+func (k APIKey) Key() string {
+	return k.ID + "." + k.Secret
+}
+
+// Encode serializes k for the store.
+func (k APIKey) Encode() (string, error) {
+	data, err := json.Marshal(k)
+	return string(data), err
+}
+
+// DecodeAPIKey parses a stored API key record.
+func DecodeAPIKey(raw string) (APIKey, error) {
+	var k APIKey
+	err := json.Unmarshal([]byte(raw), &k)
+	return k, err
+}
+
+// APIKeyPrefix is shared by every API key record.
+const APIKeyPrefix = "L:"
+
+// CreateAPIKeyKey maps an API key id to its record.
+func CreateAPIKeyKey(id string) string {
+	return APIKeyPrefix + id
+}
+
+// APIKeyCacheV caches API key records for the rate limiter, which looks one
+// up on every request that sends a key. Revoking forgets the record here;
+// other instances stop accepting it within the TTL.
+var APIKeyCacheV = NewGetCache(30*time.Second, 10_000)
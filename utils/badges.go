@@ -42,7 +42,21 @@ func getOrCreateGenerator(fontPath string, fontSize float64) (*badge.Generator,
 	return actualGen.(*badge.Generator), nil
 }
 
-func GenerateBadge(c *gin.Context, count int64) ([]byte, error) {
+// BadgeOptions are how a badge looks, from the query parameters every badge
+// endpoint shares.
+type BadgeOptions struct {
+	Text      string // ?text=, the label on the left
+	Color     string // ?bgcolor=, behind the count, as #RGB or #RRGGBB
+	TextColor string // ?textcolor=
+	Style     string // ?style=, lowercased
+	FontSize  float64
+	Font      string // ?font=, lowercased
+	Logo      string // ?logo=, for shields.io endpoint badges only
+}
+
+// ParseBadgeOptions reads and validates a badge's query parameters, filling
+// in the defaults.
+func ParseBadgeOptions(c *gin.Context) (BadgeOptions, error) {
 	bgColor := c.DefaultQuery("bgcolor", "007ec6")
 	textColor := c.DefaultQuery("textcolor", "fff")
 	text := c.DefaultQuery("text", "counter")
@@ -53,13 +67,13 @@ func GenerateBadge(c *gin.Context, count int64) ([]byte, error) {
 	// Validate and parse background color
 	bgColor, err := badge.ValidateColor(bgColor)
 	if err != nil {
-		return nil, err // Return validation error directly
+		return BadgeOptions{}, err // Return validation error directly
 	}
 
 	// Validate and parse text color
 	textColor, err = badge.ValidateColor(textColor)
 	if err != nil {
-		return nil, err // Return validation error directly
+		return BadgeOptions{}, err // Return validation error directly
 	}
 
 	// Parse font size
@@ -67,17 +81,26 @@ func GenerateBadge(c *gin.Context, count int64) ([]byte, error) {
 	if err != nil || fontSize <= 3 {
 		fontSize = 11 // Fallback to default if invalid
 	}
+	logo := strings.TrimSpace(c.Query("logo"))
+	return BadgeOptions{Text: text, Color: bgColor, TextColor: textColor, Style: style, FontSize: fontSize, Font: font, Logo: logo}, nil
+}
+
+func GenerateBadge(c *gin.Context, count int64) ([]byte, error) {
+	opts, err := ParseBadgeOptions(c)
+	if err != nil {
+		return nil, err
+	}
 
 	// Get font path and font family
-	filePath, fontFamily, err := lib.GetFontFilePath(font)
+	filePath, fontFamily, err := lib.GetFontFilePath(opts.Font)
 	if err != nil {
 		log.Printf("Error: Failed to get font file path: %v", err)
 		// Return a more specific error if font path fails
-		return nil, fmt.Errorf("font error: failed to find font '%s': %w", font, err)
+		return nil, fmt.Errorf("font error: failed to find font '%s': %w", opts.Font, err)
 	}
 
 	// Use the cached generator
-	generator, err := getOrCreateGenerator(filePath, fontSize)
+	generator, err := getOrCreateGenerator(filePath, opts.FontSize)
 	if err != nil {
 		log.Printf("Error: Failed to get/create badge generator: %v", err)
 		// Ensure errors from generator creation/retrieval are returned
@@ -85,8 +108,8 @@ func GenerateBadge(c *gin.Context, count int64) ([]byte, error) {
 	}
 
 	// Adjust padding based on font size to maintain proportions
-	paddingH := fontSize * 0.75
-	paddingV := fontSize * 0.45
+	paddingH := opts.FontSize * 0.75
+	paddingV := opts.FontSize * 0.45
 	generator.SetPadding(paddingH, paddingV) // Apply padding settings
 
 	// Convert count to string for badge
@@ -94,41 +117,81 @@ func GenerateBadge(c *gin.Context, count int64) ([]byte, error) {
 
 	// Create Params struct
 	badgeParams := badge.Params{
-		LeftText:   text, // Use 'text' parsed from query
+		LeftText:   opts.Text, // Use 'text' parsed from query
 		RightText:  countString,
-		Color:      bgColor,
-		TextColor:  textColor,
-		FontSize:   fontSize,   // Pass the specific fontSize
-		FontFamily: fontFamily, // Pass the specific fontFamily
+		Color:      opts.Color,
+		TextColor:  opts.TextColor,
+		FontSize:   opts.FontSize, // Pass the specific fontSize
+		FontFamily: fontFamily,    // Pass the specific fontFamily
 	}
 
-	if badge.IsSimpleStyle(style) {
+	if badge.IsSimpleStyle(opts.Style) {
 		badgeParams.LeftText = "" // Empty LeftText for simple styles
-		switch style {
+		switch opts.Style {
 		case "plastic-simple":
-			return generator.GeneratePlasticSimple(countString, bgColor, textColor)
+			return generator.GeneratePlasticSimple(countString, opts.Color, opts.TextColor)
 		case "flat-square-simple":
-			return generator.GenerateFlatSquareSimple(countString, bgColor, textColor)
+			return generator.GenerateFlatSquareSimple(countString, opts.Color, opts.TextColor)
 		case "flat-simple":
-			return generator.GenerateFlatSimple(countString, bgColor, textColor)
+			return generator.GenerateFlatSimple(countString, opts.Color, opts.TextColor)
 		default:
 			// Fallback for unknown simple styles
-			log.Printf("Unknown simple badge style '%s', defaulting to flat-simple", style)
-			return generator.GenerateFlatSimple(countString, bgColor, textColor)
+			log.Printf("Unknown simple badge style '%s', defaulting to flat-simple", opts.Style)
+			return generator.GenerateFlatSimple(countString, opts.Color, opts.TextColor)
 		}
 	}
 
 	// Regular badge styles
-	switch style {
+	switch opts.Style {
 	case "plastic":
-		return generator.GeneratePlastic(text, countString, bgColor, textColor)
+		return generator.GeneratePlastic(opts.Text, countString, opts.Color, opts.TextColor)
 	case "flat-square":
-		return generator.GenerateFlatSquare(text, countString, bgColor, textColor)
+		return generator.GenerateFlatSquare(opts.Text, countString, opts.Color, opts.TextColor)
 	case "flat":
-		return generator.GenerateFlat(text, countString, bgColor, textColor)
+		return generator.GenerateFlat(opts.Text, countString, opts.Color, opts.TextColor)
 	default:
 		// Fallback for unknown regular styles
-		log.Printf("Unknown badge style '%s', defaulting to flat", style)
-		return generator.GenerateFlat(text, countString, bgColor, textColor)
+		log.Printf("Unknown badge style '%s', defaulting to flat", opts.Style)
+		return generator.GenerateFlat(opts.Text, countString, opts.Color, opts.TextColor)
+	}
+}
+
+// badgeLabelColor is the background of the label of every badge above.
+const badgeLabelColor = "555"
+
+// EndpointBadge is the JSON shields.io draws an endpoint badge from
+// (https://shields.io/badges/endpoint-badge).
+type EndpointBadge struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	Label         string `json:"label"`
+	Message       string `json:"message"`
+	Color         string `json:"color"`
+	LabelColor    string `json:"labelColor"`
+	Style         string `json:"style"`
+	NamedLogo     string `json:"namedLogo,omitempty"`
+}
+
+// GenerateEndpointBadge describes the badge GenerateBadge would draw for
+// count as shields.io endpoint JSON, from the same options plus Logo, one of
+// shields.io's named logos. shields.io has no say in fonts or text colours,
+// so those are left out; the -simple styles become their plain ones with an
+// empty label.
+func GenerateEndpointBadge(opts BadgeOptions, count int64) EndpointBadge {
+	label := opts.Text
+	if badge.IsSimpleStyle(opts.Style) {
+		label = ""
+	}
+	style := strings.TrimSuffix(opts.Style, "-simple")
+	if style != "plastic" && style != "flat-square" {
+		style = "flat" // as GenerateBadge falls back to
+	}
+	return EndpointBadge{
+		SchemaVersion: 1,
+		Label:         label,
+		Message:       strconv.FormatInt(count, 10),
+		Color:         strings.TrimPrefix(opts.Color, "#"),
+		LabelColor:    badgeLabelColor,
+		Style:         style,
+		NamedLogo:     opts.Logo,
 	}
 }
@@ -0,0 +1,58 @@
+package utils
+
+import (
+	_ "embed"
+	"net/http"
+	"os"
+	"strings"
+)
+
+//go:embed bots.txt
+var bundledBotList string
+
+// botPatterns are the lowercase User-Agent substrings IsBot looks for: the
+// bundled list unless InitBotList replaced it.
+var botPatterns = parseBotList(bundledBotList)
+
+// parseBotList reads a list in the format of bots.txt: a pattern per line,
+// with blank lines and # comments skipped.
+func parseBotList(raw string) []string {
+	var patterns []string
+	for _, line := range strings.Split(raw, "\n") {
+		line = strings.ToLower(strings.TrimSpace(line))
+		if line != "" && !strings.HasPrefix(line, "#") {
+			patterns = append(patterns, line)
+		}
+	}
+	return patterns
+}
+
+// InitBotList replaces the bundled bot list with the one at path, so it can
+// be kept up to date without a release. It returns the number of patterns.
+func InitBotList(path string) (int, error) {
+	raw, err := os.ReadFile(path) // #nosec G304 -- path comes from the operator
+	if err != nil {
+		return 0, err
+	}
+	botPatterns = parseBotList(string(raw))
+	return len(botPatterns), nil
+}
+
+// IsBot reports whether r comes from a crawler, link unfurler or the like
+// rather than a person: its User-Agent matches the bot list, or it's a
+// browser fetching ahead of a click (Purpose: prefetch, Sec-Purpose and
+// their older forms).
+func IsBot(r *http.Request) bool {
+	for _, header := range []string{"Sec-Purpose", "Purpose", "X-Purpose", "X-Moz"} {
+		if purpose := strings.ToLower(r.Header.Get(header)); strings.Contains(purpose, "prefetch") || strings.Contains(purpose, "preview") {
+			return true
+		}
+	}
+	ua := strings.ToLower(r.UserAgent())
+	for _, pattern := range botPatterns {
+		if strings.Contains(ua, pattern) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,62 @@
+package utils
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsBot(t *testing.T) {
+	isBot := func(headers map[string]string) bool {
+		r := httptest.NewRequest("GET", "/hit/ns/key", nil)
+		for k, v := range headers {
+			r.Header.Set(k, v)
+		}
+		return IsBot(r)
+	}
+	for _, ua := range []string{
+		"github-camo (876de43e)",
+		"Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)",
+		"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)",
+		"Mozilla/5.0 (compatible; Discordbot/2.0; +https://discordapp.com)",
+		"facebookexternalhit/1.1",
+		"Mozilla/5.0 AppleWebKit/537.36 (KHTML, like Gecko; compatible; GPTBot/1.2; +https://openai.com/gptbot)",
+	} {
+		require.True(t, isBot(map[string]string{"User-Agent": ua}), ua)
+	}
+	for _, ua := range []string{
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Safari/537.36",
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 17_5 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.5 Mobile/15E148 Safari/604.1",
+		"Mozilla/5.0 (Linux; Android 12; CUBOT X50) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Mobile Safari/537.36",
+		"curl/8.5.0",
+		"",
+	} {
+		require.False(t, isBot(map[string]string{"User-Agent": ua}), ua)
+	}
+
+	browser := "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Safari/537.36"
+	require.True(t, isBot(map[string]string{"User-Agent": browser, "Sec-Purpose": "prefetch;prerender"}))
+	require.True(t, isBot(map[string]string{"User-Agent": browser, "Purpose": "prefetch"}))
+	require.True(t, isBot(map[string]string{"User-Agent": browser, "X-Purpose": "preview"}))
+}
+
+func TestInitBotList(t *testing.T) {
+	t.Cleanup(func() { botPatterns = parseBotList(bundledBotList) })
+	path := filepath.Join(t.TempDir(), "bots.txt")
+	require.NoError(t, os.WriteFile(path, []byte("# ours\n\nExampleBot\n"), 0o600))
+
+	n, err := InitBotList(path)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("User-Agent", "examplebot/1.0")
+	require.True(t, IsBot(r))
+	r.Header.Set("User-Agent", "github-camo (876de43e)")
+	require.False(t, IsBot(r), "the list is replaced, not extended")
+
+	_, err = InitBotList(filepath.Join(t.TempDir(), "missing.txt"))
+	require.Error(t, err)
+}
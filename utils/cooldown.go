@@ -0,0 +1,36 @@
+package utils
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// MaxHitCooldown caps KeySettings.Cooldown, which is also how long each
+// visitor's marker lives.
+const MaxHitCooldown = 24 * time.Hour
+
+// ParseHitCooldown validates a cooldown such as "30m", a whole number of
+// seconds. An empty or zero one clears it.
+func ParseHitCooldown(raw string) (time.Duration, error) {
+	if raw == "" || raw == "0" {
+		return 0, nil
+	}
+	cooldown, err := time.ParseDuration(raw)
+	switch {
+	case err != nil || cooldown < 0:
+		return 0, errors.New("expected a duration such as 30m or 1h")
+	case cooldown%time.Second != 0:
+		return 0, errors.New("it must be a whole number of seconds")
+	case cooldown > MaxHitCooldown:
+		return 0, errors.New("it can be at most 24h")
+	}
+	return cooldown, nil
+}
+
+// CreateCooldownKey maps a counter key and a visitor (see VisitorHash) to the
+// marker of the visitor's last counted hit, D:{namespace}:{key}:{visitor}.
+func CreateCooldownKey(key, visitor string) string {
+	key = strings.TrimPrefix(key, "K:")
+	return "D:" + key + ":" + visitor
+}
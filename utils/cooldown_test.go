@@ -0,0 +1,28 @@
+package utils
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseHitCooldown(t *testing.T) {
+	d, err := ParseHitCooldown("30m")
+	require.NoError(t, err)
+	require.Equal(t, 30*time.Minute, d)
+
+	for _, raw := range []string{"", "0", "0s"} {
+		d, err := ParseHitCooldown(raw)
+		require.NoError(t, err, raw)
+		require.Zero(t, d, "%q clears the cooldown", raw)
+	}
+	for _, raw := range []string{"30", "soon", "-1m", "1.5s", "25h"} {
+		_, err := ParseHitCooldown(raw)
+		require.Error(t, err, raw)
+	}
+}
+
+func TestCreateCooldownKey(t *testing.T) {
+	require.Equal(t, "D:ns:key:0123abcd", CreateCooldownKey("K:ns:key", "0123abcd"))
+}
@@ -0,0 +1,126 @@
+package utils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	GranularityHour = "hour"
+	GranularityDay  = "day"
+
+	// Bucket suffixes. Hourly and daily stamps have different lengths so the
+	// two series can share the H: prefix without colliding.
+	hourBucketLayout = "2006010215"
+	dayBucketLayout  = "20060102"
+
+	// MaxHistoryPoints caps a single /history query. One MGET of ~750 keys is
+	// still a cheap call; anything larger is almost certainly a client bug.
+	MaxHistoryPoints = 750
+)
+
+// HistoryConfig controls the optional per-key time series. When enabled,
+// every increment also bumps an hourly and a daily bucket, each with its own
+// retention, so a counter's trend can be read back via /history.
+type HistoryConfig struct {
+	Enabled         bool
+	HourlyRetention time.Duration
+	DailyRetention  time.Duration
+}
+
+// History is the global config read by the hit/update paths. Disabled by
+// default; main re-initializes it from the HISTORY_* env vars. It isn't
+// guarded: set it once at startup, before serving.
+var History = HistoryConfig{HourlyRetention: 7 * 24 * time.Hour, DailyRetention: 365 * 24 * time.Hour}
+
+// InitHistory replaces the global history config.
+func InitHistory(cfg HistoryConfig) {
+	History = cfg
+}
+
+// HistoryBucketKey returns the bucket key for dbKey at t, e.g.
+// H:<ns>:<key>:2026101715 for an hour or H:<ns>:<key>:20261017 for a day.
+// Buckets are always UTC so every instance agrees on the boundaries.
+func HistoryBucketKey(dbKey, granularity string, t time.Time) string {
+	layout := hourBucketLayout
+	if granularity == GranularityDay {
+		layout = dayBucketLayout
+	}
+	return "H:" + strings.TrimPrefix(dbKey, "K:") + ":" + t.UTC().Format(layout)
+}
+
+// HistoryBuckets returns the bucket keys touched by a write at t, alongside
+// their retention in whole seconds (the shape EXPIRE and Lua ARGV want).
+func HistoryBuckets(dbKey string, t time.Time) ([]string, []any) {
+	return []string{
+		HistoryBucketKey(dbKey, GranularityHour, t),
+		HistoryBucketKey(dbKey, GranularityDay, t),
+	}, []any{
+		int64(History.HourlyRetention.Seconds()),
+		int64(History.DailyRetention.Seconds()),
+	}
+}
+
+// AllHistoryBuckets returns every bucket key of dbKey that can still exist at
+// now given the retention, for deleting a counter's history without scanning
+// for it.
+func AllHistoryBuckets(dbKey string, now time.Time) []string {
+	var keys []string
+	for _, series := range []struct {
+		granularity string
+		step        time.Duration
+		retention   time.Duration
+	}{
+		{GranularityHour, time.Hour, History.HourlyRetention},
+		{GranularityDay, 24 * time.Hour, History.DailyRetention},
+	} {
+		for t := now.UTC().Truncate(series.step); !t.Before(now.Add(-series.retention - series.step)); t = t.Add(-series.step) {
+			keys = append(keys, HistoryBucketKey(dbKey, series.granularity, t))
+		}
+	}
+	return keys
+}
+
+// HistoryRange returns the start of every bucket between from and to
+// (inclusive), oldest first. Errors if the granularity is unknown, the range
+// is inverted, or it would exceed MaxHistoryPoints.
+func HistoryRange(granularity string, from, to time.Time) ([]time.Time, error) {
+	var step time.Duration
+	switch granularity {
+	case GranularityHour:
+		step = time.Hour
+	case GranularityDay:
+		step = 24 * time.Hour
+	default:
+		return nil, fmt.Errorf("granularity must be %q or %q", GranularityHour, GranularityDay)
+	}
+	from, to = from.UTC().Truncate(step), to.UTC().Truncate(step)
+	if to.Before(from) {
+		return nil, fmt.Errorf("from must be before to")
+	}
+	n := int(to.Sub(from)/step) + 1
+	if n > MaxHistoryPoints {
+		return nil, fmt.Errorf("range covers %d points, the maximum is %d", n, MaxHistoryPoints)
+	}
+	points := make([]time.Time, n)
+	for i := range points {
+		points[i] = from.Add(time.Duration(i) * step)
+	}
+	return points, nil
+}
+
+// ParseHistoryTime accepts RFC 3339, a bare YYYY-MM-DD date, or unix seconds.
+func ParseHistoryTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.DateOnly, s); err == nil {
+		return t, nil
+	}
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	return time.Time{}, fmt.Errorf("%q is not an RFC 3339 timestamp, YYYY-MM-DD date or unix time", s)
+}
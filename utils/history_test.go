@@ -0,0 +1,74 @@
+package utils
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Hourly and daily buckets share the H: prefix but must never collide, and
+// must be computed in UTC regardless of the caller's zone.
+func TestHistoryBucketKey(t *testing.T) {
+	ts := time.Date(2026, 10, 17, 3, 45, 0, 0, time.FixedZone("EDT", -4*3600))
+
+	require.Equal(t, "H:ns:key:2026101707", HistoryBucketKey("K:ns:key", GranularityHour, ts))
+	require.Equal(t, "H:ns:key:20261017", HistoryBucketKey("K:ns:key", GranularityDay, ts))
+}
+
+func TestHistoryBucketsCarryRetention(t *testing.T) {
+	prev := History
+	defer InitHistory(prev)
+	InitHistory(HistoryConfig{Enabled: true, HourlyRetention: 2 * time.Hour, DailyRetention: 48 * time.Hour})
+
+	keys, ttls := HistoryBuckets("K:ns:key", time.Date(2026, 1, 2, 3, 0, 0, 0, time.UTC))
+	require.Equal(t, []string{"H:ns:key:2026010203", "H:ns:key:20260102"}, keys)
+	require.Equal(t, []any{int64(7200), int64(172800)}, ttls)
+}
+
+func TestAllHistoryBuckets(t *testing.T) {
+	prev := History
+	defer InitHistory(prev)
+	InitHistory(HistoryConfig{Enabled: true, HourlyRetention: 2 * time.Hour, DailyRetention: 48 * time.Hour})
+
+	keys := AllHistoryBuckets("K:ns:key", time.Date(2026, 1, 3, 1, 30, 0, 0, time.UTC))
+	require.Equal(t, []string{
+		"H:ns:key:2026010301", "H:ns:key:2026010300", "H:ns:key:2026010223",
+		"H:ns:key:20260103", "H:ns:key:20260102", "H:ns:key:20260101",
+	}, keys)
+}
+
+func TestHistoryRange(t *testing.T) {
+	from := time.Date(2026, 1, 1, 22, 30, 0, 0, time.UTC)
+	to := time.Date(2026, 1, 2, 1, 10, 0, 0, time.UTC)
+
+	points, err := HistoryRange(GranularityHour, from, to)
+	require.NoError(t, err)
+	require.Len(t, points, 4, "22:00, 23:00, 00:00 and 01:00")
+	require.Equal(t, time.Date(2026, 1, 1, 22, 0, 0, 0, time.UTC), points[0])
+	require.Equal(t, time.Date(2026, 1, 2, 1, 0, 0, 0, time.UTC), points[3])
+
+	points, err = HistoryRange(GranularityDay, from, to)
+	require.NoError(t, err)
+	require.Len(t, points, 2)
+
+	_, err = HistoryRange("minute", from, to)
+	require.Error(t, err)
+
+	_, err = HistoryRange(GranularityHour, to, from)
+	require.Error(t, err, "inverted ranges must be rejected")
+
+	_, err = HistoryRange(GranularityHour, from, from.Add(MaxHistoryPoints*time.Hour))
+	require.Error(t, err, "ranges above MaxHistoryPoints must be rejected")
+}
+
+func TestParseHistoryTime(t *testing.T) {
+	want := time.Date(2026, 10, 17, 0, 0, 0, 0, time.UTC)
+	for _, in := range []string{"2026-10-17T00:00:00Z", "2026-10-17", "1792195200"} {
+		got, err := ParseHistoryTime(in)
+		require.NoError(t, err, in)
+		require.True(t, want.Equal(got), "%s parsed to %s", in, got)
+	}
+	_, err := ParseHistoryTime("yesterday")
+	require.Error(t, err)
+}
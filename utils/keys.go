@@ -2,6 +2,7 @@ package utils
 
 import (
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"log"
 	"math/big"
@@ -33,35 +34,41 @@ func truncateString(s string) string {
 }
 
 func convertReserved(c *gin.Context, input string) string {
+	resolved, err := resolveReserved(c, input)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return ""
+	}
+	return resolved
+}
+
+// resolveReserved expands :HOST: and :PATH: from the request headers.
+func resolveReserved(c *gin.Context, input string) (string, error) {
 	input = strings.Trim(input, "/")
 	if input == ":HOST:" {
 		origin := c.Request.Header.Get("Origin")
 		if origin == "" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Origin header is required if :HOST: is used"})
-			return ""
+			return "", errors.New("Origin header is required if :HOST: is used")
 		}
 		// Added validation for Origin header
 		if !validateURL(origin) {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid Origin header format"})
-			return ""
+			return "", errors.New("Invalid Origin header format")
 		}
-		return truncateString(origin)
+		return truncateString(origin), nil
 	} else if input == ":PATH:" {
 		path := c.Request.Header.Get("Referer")
 		if path == "" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Referer header is required if :PATH: is used"})
-			return ""
+			return "", errors.New("Referer header is required if :PATH: is used")
 		}
 		// Added validation for Referer header
 		if !validateURL(path) {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid Referer header format"})
-			return ""
+			return "", errors.New("Invalid Referer header format")
 		}
 		// todo: should we split and only store the actual PATH part? Changing this may break existing clients.
-		return truncateString(path)
+		return truncateString(path), nil
 	}
 
-	return input
+	return input, nil
 }
 
 func CreateRawAdminKey(c *gin.Context) string {
@@ -74,26 +81,56 @@ func CreateRawAdminKey(c *gin.Context) string {
 	return "A:" + namespace + ":" + key
 
 }
+
+// CreateNamespaceAdminKey returns the key holding namespace's admin token.
+func CreateNamespaceAdminKey(namespace string) string {
+	return "N:" + namespace
+}
+
+// CreateNamespaceMarkerKey returns the key marking namespace as having had
+// counters in it, which /namespace/create checks before looking for them.
+func CreateNamespaceMarkerKey(namespace string) string {
+	return "M:" + namespace
+}
+
 func CreateKey(c *gin.Context, namespace, key string, skipValidation bool) string {
-	namespace = convertReserved(c, namespace)
-	if namespace == "" {
-		return ""
-	}
-	key = convertReserved(c, key)
-	if key == "" {
-		return ""
-	}
-	if skipValidation == false {
-		if err := validate(namespace); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid namespace: " + err.Error()})
+	if skipValidation {
+		namespace = convertReserved(c, namespace)
+		if namespace == "" {
 			return ""
 		}
-		if err := validate(key); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid key: " + err.Error()})
+		key = convertReserved(c, key)
+		if key == "" {
 			return ""
 		}
+		return "K:" + namespace + ":" + key
 	}
-	return "K:" + namespace + ":" + key
+	dbKey, err := ResolveKey(c, namespace, key)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return ""
+	}
+	return dbKey
+}
+
+// ResolveKey is CreateKey for callers that can't write an HTTP error, such as
+// the WebSocket endpoint: it returns the validation error instead.
+func ResolveKey(c *gin.Context, namespace, key string) (string, error) {
+	namespace, err := resolveReserved(c, namespace)
+	if err != nil {
+		return "", err
+	}
+	key, err = resolveReserved(c, key)
+	if err != nil {
+		return "", err
+	}
+	if err := validate(namespace); err != nil {
+		return "", errors.New("Invalid namespace: " + err.Error())
+	}
+	if err := validate(key); err != nil {
+		return "", errors.New("Invalid key: " + err.Error())
+	}
+	return "K:" + namespace + ":" + key, nil
 }
 
 // validate checks if the namespace/key meet the validation criteria.
@@ -130,6 +167,14 @@ func CreateAdminKey(key string) string {
 	return "A:" + key
 }
 
+// CreateUniqueKey maps a counter key to its unique-visitor HyperLogLog
+// sibling. U: lives next to K: so the raw hit count and the distinct-visitor
+// count for the same namespace/key can be read side by side.
+func CreateUniqueKey(key string) string {
+	key = strings.TrimPrefix(key, "K:")
+	return "U:" + key
+}
+
 func LoadEnv() {
 	// check if env was loaded via some other format
 	if os.Getenv("API_ANALYTICS_ENABLED") != "" {
@@ -183,3 +228,26 @@ func validateURL(input string) bool {
 
 	return hasValidProtocol && !containsInvalidChars
 }
+
+// CreateNamespace validates a bare namespace, as used by namespace-wide
+// streams. Like CreateKey, it writes the error response itself and returns "".
+func CreateNamespace(c *gin.Context, namespace string) string {
+	namespace, err := ResolveNamespace(c, namespace)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return ""
+	}
+	return namespace
+}
+
+// ResolveNamespace is CreateNamespace returning the error instead of writing it.
+func ResolveNamespace(c *gin.Context, namespace string) (string, error) {
+	namespace, err := resolveReserved(c, namespace)
+	if err != nil {
+		return "", err
+	}
+	if err := validate(namespace); err != nil {
+		return "", errors.New("Invalid namespace: " + err.Error())
+	}
+	return namespace, nil
+}
@@ -13,6 +13,44 @@ import (
 var (
 	SSEClientDrops  atomic.Int64
 	SSEMessageDrops atomic.Int64
+	// SSECoalesced counts updates replaced by a newer value for the same key
+	// before they were sent.
+	SSECoalesced atomic.Int64
+)
+
+// SSE connections closed by the server rather than the client: a heartbeat
+// write failed (the peer was already gone), the connection hit
+// SSEConfig.MaxLifetime, or it saw no update for SSEConfig.IdleTimeout.
+var (
+	SSEHeartbeatCloses atomic.Int64
+	SSELifetimeCloses  atomic.Int64
+	SSEIdleCloses      atomic.Int64
+)
+
+// SSE connections refused by ValueEvent.Admit.
+var (
+	SSERejectedPerIP  atomic.Int64
+	SSERejectedGlobal atomic.Int64
+)
+
+// Hits not counted because of a counter's settings or quota: refused, over
+// the quota, filtered out as bots or repeated within the cooldown.
+var (
+	HitsRejectedSignature atomic.Int64
+	HitsRejectedOrigin    atomic.Int64
+	HitsRejectedQuota     atomic.Int64
+	HitsRejectedBot       atomic.Int64
+	HitsRejectedCooldown  atomic.Int64
+)
+
+// Rate limit decisions by who made them: the in-process first-line filter
+// turning a client away before Redis was asked, Redis, or the in-process
+// limiter standing in for Redis after it failed. In-memory-only rate
+// limiting counts every decision as local.
+var (
+	RateLimitDecisionsLocal    atomic.Int64
+	RateLimitDecisionsRedis    atomic.Int64
+	RateLimitDecisionsFallback atomic.Int64
 )
 
 // RedisTimingHook records per-command latency into the Prometheus histogram
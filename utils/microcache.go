@@ -2,12 +2,10 @@ package utils
 
 import (
 	"context"
-	"errors"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/redis/go-redis/v9"
 	"golang.org/x/sync/singleflight"
 )
 
@@ -153,6 +151,20 @@ func (c *GetCache) Fetch(key string, fill func() (string, bool, error)) (string,
 	return r.val, r.notFound, nil
 }
 
+// Forget drops key's entry, so this instance's next Fetch refills it. For
+// writers that can't wait out the TTL; other instances still can.
+func (c *GetCache) Forget(key string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	if _, ok := c.entries[key]; ok {
+		delete(c.entries, key)
+		c.size.Add(-1)
+	}
+	c.mu.Unlock()
+}
+
 // lookup returns (value, notFound, hit). hit=false if absent OR expired.
 func (c *GetCache) lookup(key string) (string, bool, bool) {
 	c.mu.RLock()
@@ -209,17 +221,6 @@ func (c *GetCache) sweep() {
 	}
 }
 
-// RedisGetThrough is a convenience wrapper that calls Client.Get and adapts
-// the result to Fetch's fill signature. Returns (value, notFound, error).
-// Used by GetView and GetShieldView to keep the cache wiring in one place.
-func RedisGetThrough(ctx context.Context, client *redis.Client, key string) (string, bool, error) {
-	v, err := client.Get(ctx, key).Result()
-	if errors.Is(err, redis.Nil) {
-		return "", true, nil
-	}
-	return v, false, err
-}
-
 // ===== Global cache instance =====
 //
 // Initialized with a tiny default at package load so handlers don't have
@@ -81,6 +81,25 @@ func TestGetCache_NegativeCachingWorks(t *testing.T) {
 	require.Equal(t, int64(1), calls.Load(), "second call for missing key must hit cached not-found, not re-query")
 }
 
+func TestGetCache_ForgetForcesRefill(t *testing.T) {
+	c := NewGetCache(time.Minute, 100)
+	defer c.Stop()
+
+	var calls atomic.Int64
+	fill := func() (string, bool, error) {
+		calls.Add(1)
+		return "v", false, nil
+	}
+	_, _, err := c.Fetch("k", fill)
+	require.NoError(t, err)
+	c.Forget("k")
+	c.Forget("never-cached")
+	require.Equal(t, 0, c.Size())
+	_, _, err = c.Fetch("k", fill)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), calls.Load())
+}
+
 // THE singleflight invariant. N concurrent Fetch calls for the same key
 // must collapse to exactly ONE fill() invocation. This is what protects
 // the cache stampede on TTL expiry under load.
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"log"
 	"net/http"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -95,13 +96,21 @@ func InitPrometheus(ctx context.Context, addr string, main, rl *redis.Client) {
 	Prom.registry.MustRegister(prometheus.NewGaugeFunc(
 		prometheus.GaugeOpts{Name: "abacus_sse_clients_total", Help: "Connected SSE clients across all keys."},
 		func() float64 {
-			ValueEventServer.Mu.RLock()
-			defer ValueEventServer.Mu.RUnlock()
-			n := 0
-			for _, m := range ValueEventServer.TotalClients {
-				n += len(m)
-			}
-			return float64(n)
+			return float64(ValueEventServer.CountClients())
+		},
+	))
+	Prom.registry.MustRegister(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{Name: "abacus_sse_clients_per_ip_max", Help: "Most SSE connections currently open from a single IP."},
+		func() float64 {
+			current, _ := ValueEventServer.MaxConnectionsPerIP()
+			return float64(current)
+		},
+	))
+	Prom.registry.MustRegister(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{Name: "abacus_sse_clients_per_ip_peak", Help: "Most SSE connections ever open at once from a single IP since startup."},
+		func() float64 {
+			_, peak := ValueEventServer.MaxConnectionsPerIP()
+			return float64(peak)
 		},
 	))
 	Prom.registry.MustRegister(prometheus.NewGaugeFunc(
@@ -116,6 +125,14 @@ func InitPrometheus(ctx context.Context, addr string, main, rl *redis.Client) {
 		prometheus.GaugeOpts{Name: "abacus_sse_message_queue_depth", Help: "Pending items in the SSE broadcast channel."},
 		func() float64 { return float64(len(ValueEventServer.Message)) },
 	))
+	Prom.registry.MustRegister(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{Name: "abacus_sse_pending_updates", Help: "Stream updates held back for subscribers that limit their update rate."},
+		func() float64 { return float64(ValueEventServer.PendingUpdates()) },
+	))
+	Prom.registry.MustRegister(prometheus.NewCounterFunc(
+		prometheus.CounterOpts{Name: "abacus_sse_coalesced_total", Help: "SSE updates replaced by a newer value for the same key before being sent (cumulative)."},
+		func() float64 { return float64(SSECoalesced.Load()) },
+	))
 	Prom.registry.MustRegister(prometheus.NewGaugeFunc(
 		prometheus.GaugeOpts{Name: "abacus_stats_paths_tracked", Help: "Unique request paths the stats manager is tracking."},
 		func() float64 {
@@ -197,6 +214,78 @@ func InitPrometheus(ctx context.Context, addr string, main, rl *redis.Client) {
 		},
 	))
 
+	// Cross-instance stream relay. All zero unless the bridge is enabled.
+	Prom.registry.MustRegister(prometheus.NewCounterFunc(
+		prometheus.CounterOpts{Name: "abacus_stream_pubsub_published_total", Help: "Stream updates published to other instances (cumulative)."},
+		func() float64 { return float64(StreamBridgePublished.Load()) },
+	))
+	Prom.registry.MustRegister(prometheus.NewCounterFunc(
+		prometheus.CounterOpts{Name: "abacus_stream_pubsub_received_total", Help: "Stream updates received from other instances (cumulative)."},
+		func() float64 { return float64(StreamBridgeReceived.Load()) },
+	))
+	Prom.registry.MustRegister(prometheus.NewCounterFunc(
+		prometheus.CounterOpts{Name: "abacus_stream_pubsub_drops_total", Help: "Stream updates that could not be published (queue full or Redis error, cumulative)."},
+		func() float64 { return float64(StreamBridgeDrops.Load()) },
+	))
+	for reason, n := range map[string]*atomic.Int64{
+		"per_ip": &SSERejectedPerIP,
+		"global": &SSERejectedGlobal,
+	} {
+		Prom.registry.MustRegister(prometheus.NewCounterFunc(
+			prometheus.CounterOpts{
+				Name:        "abacus_sse_rejected_total",
+				Help:        "SSE connections refused with 429 by the per-IP or global cap (cumulative).",
+				ConstLabels: prometheus.Labels{"reason": reason},
+			},
+			func() float64 { return float64(n.Load()) },
+		))
+	}
+	for reason, n := range map[string]*atomic.Int64{
+		"heartbeat": &SSEHeartbeatCloses,
+		"lifetime":  &SSELifetimeCloses,
+		"idle":      &SSEIdleCloses,
+	} {
+		Prom.registry.MustRegister(prometheus.NewCounterFunc(
+			prometheus.CounterOpts{
+				Name:        "abacus_sse_server_closes_total",
+				Help:        "SSE connections closed by the server: failed heartbeat, max lifetime reached, or idle timeout (cumulative).",
+				ConstLabels: prometheus.Labels{"reason": reason},
+			},
+			func() float64 { return float64(n.Load()) },
+		))
+	}
+	for reason, n := range map[string]*atomic.Int64{
+		"signature": &HitsRejectedSignature,
+		"origin":    &HitsRejectedOrigin,
+		"quota":     &HitsRejectedQuota,
+		"bot":       &HitsRejectedBot,
+		"cooldown":  &HitsRejectedCooldown,
+	} {
+		Prom.registry.MustRegister(prometheus.NewCounterFunc(
+			prometheus.CounterOpts{
+				Name:        "abacus_hits_rejected_total",
+				Help:        "Hits not counted because of the counter's settings or quota, by reason (cumulative).",
+				ConstLabels: prometheus.Labels{"reason": reason},
+			},
+			func() float64 { return float64(n.Load()) },
+		))
+	}
+
+	for path, n := range map[string]*atomic.Int64{
+		"local":    &RateLimitDecisionsLocal,
+		"redis":    &RateLimitDecisionsRedis,
+		"fallback": &RateLimitDecisionsFallback,
+	} {
+		Prom.registry.MustRegister(prometheus.NewCounterFunc(
+			prometheus.CounterOpts{
+				Name:        "abacus_ratelimit_decisions_total",
+				Help:        "Rate limit decisions by the path that made them: local (in-process filter or in-memory mode), redis, or fallback (in-process after a Redis error) (cumulative).",
+				ConstLabels: prometheus.Labels{"path": path},
+			},
+			func() float64 { return float64(n.Load()) },
+		))
+	}
+
 	registerPoolGauges("main", main)
 	registerPoolGauges("ratelimit", rl)
 
@@ -0,0 +1,112 @@
+package utils
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HitQuota caps how fast a counter, or all the counters of a namespace, can
+// be hit: Limit hits per Window seconds. The zero value is no quota.
+type HitQuota struct {
+	Limit  int64 `json:"limit"`
+	Window int64 `json:"window"`
+}
+
+// IsZero reports whether q is no quota.
+func (q HitQuota) IsZero() bool {
+	return q.Limit <= 0 || q.Window <= 0
+}
+
+// String formats q the way ParseHitQuota reads it, e.g. "100/1s", or "" for
+// no quota.
+func (q HitQuota) String() string {
+	if q.IsZero() {
+		return ""
+	}
+	return strconv.FormatInt(q.Limit, 10) + "/" + strconv.FormatInt(q.Window, 10) + "s"
+}
+
+// Stricter returns whichever of q and o allows fewer hits per second. An
+// unset quota never wins.
+func (q HitQuota) Stricter(o HitQuota) HitQuota {
+	switch {
+	case q.IsZero():
+		return o
+	case o.IsZero():
+		return q
+	case o.Limit*q.Window < q.Limit*o.Window:
+		return o
+	}
+	return q
+}
+
+// ParseRate reads a rate written as LIMIT/WINDOW, e.g. "100/1s", with the
+// window a whole number of seconds.
+func ParseRate(raw string) (uint64, time.Duration, error) {
+	rawLimit, rawWindow, ok := strings.Cut(raw, "/")
+	if !ok {
+		return 0, 0, errors.New("expected LIMIT/WINDOW")
+	}
+	limit, err := strconv.ParseUint(rawLimit, 10, 32)
+	if err != nil || limit == 0 {
+		return 0, 0, errors.New("the limit must be a positive number")
+	}
+	window, err := time.ParseDuration(rawWindow)
+	if err != nil || window < time.Second || window%time.Second != 0 {
+		return 0, 0, errors.New("the window must be a whole number of seconds, e.g. 10s")
+	}
+	return limit, window, nil
+}
+
+// MaxHitQuotaWindow caps HitQuota.Window, which is also how long its
+// counters live.
+const MaxHitQuotaWindow = 24 * time.Hour
+
+// ParseHitQuota validates a quota such as "100/1s". An empty one clears it.
+func ParseHitQuota(raw string) (HitQuota, error) {
+	if raw == "" {
+		return HitQuota{}, nil
+	}
+	limit, window, err := ParseRate(raw)
+	if err != nil {
+		return HitQuota{}, err
+	}
+	if window > MaxHitQuotaWindow {
+		return HitQuota{}, errors.New("the window can be at most 24h")
+	}
+	return HitQuota{Limit: int64(limit), Window: int64(window / time.Second)}, nil // #nosec G115 -- limit fits in 32 bits
+}
+
+// HitQuotaConfig holds the operator's quotas, applied to every counter and
+// namespace. Owners can set stricter ones, never looser.
+type HitQuotaConfig struct {
+	Key       HitQuota
+	Namespace HitQuota
+}
+
+// HitQuotas is set once at startup by InitHitQuotas.
+var HitQuotas HitQuotaConfig
+
+// InitHitQuotas installs the operator's quotas. Zero values leave counters
+// and namespaces without a quota unless their owner sets one.
+func InitHitQuotas(cfg HitQuotaConfig) {
+	HitQuotas = cfg
+}
+
+// CreateQuotaKey maps a counter key, or a bare namespace, to the counter of
+// quota q for the window containing now: Q:{namespace}:{key}:{window} or
+// Q:{namespace}:{window}, with window the index of the window since the
+// epoch.
+func CreateQuotaKey(key string, q HitQuota, now time.Time) string {
+	key = strings.TrimPrefix(key, "K:")
+	return "Q:" + key + ":" + strconv.FormatInt(now.Unix()/q.Window, 10)
+}
+
+// CreateNamespaceSettingsKey maps a claimed namespace to its settings record,
+// S:{namespace}. Key settings always have a colon after the namespace, so the
+// two never collide.
+func CreateNamespaceSettingsKey(namespace string) string {
+	return "S:" + namespace
+}
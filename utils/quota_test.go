@@ -0,0 +1,47 @@
+package utils
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseHitQuota(t *testing.T) {
+	q, err := ParseHitQuota("100/1s")
+	require.NoError(t, err)
+	require.Equal(t, HitQuota{Limit: 100, Window: 1}, q)
+	require.Equal(t, "100/1s", q.String())
+
+	q, err = ParseHitQuota("5000/1h")
+	require.NoError(t, err)
+	require.Equal(t, "5000/3600s", q.String())
+
+	q, err = ParseHitQuota("")
+	require.NoError(t, err)
+	require.True(t, q.IsZero(), "an empty quota clears it")
+	require.Empty(t, q.String())
+
+	for _, raw := range []string{"100", "0/1s", "x/1s", "100/", "100/0s", "100/500ms", "100/48h"} {
+		_, err := ParseHitQuota(raw)
+		require.Error(t, err, raw)
+	}
+}
+
+func TestHitQuotaStricter(t *testing.T) {
+	perSecond := HitQuota{Limit: 100, Window: 1}
+	perMinute := HitQuota{Limit: 600, Window: 60} // 10 a second
+	require.Equal(t, perMinute, perSecond.Stricter(perMinute))
+	require.Equal(t, perMinute, perMinute.Stricter(perSecond))
+	require.Equal(t, perSecond, perSecond.Stricter(HitQuota{}), "an unset quota never wins")
+	require.Equal(t, perSecond, HitQuota{}.Stricter(perSecond))
+}
+
+func TestCreateQuotaKey(t *testing.T) {
+	now := time.Unix(1_699_999_980, 0) // the start of a minute
+	perMinute := HitQuota{Limit: 10, Window: 60}
+	require.Equal(t, "Q:ns:key:28333333", CreateQuotaKey("K:ns:key", perMinute, now))
+	require.Equal(t, "Q:ns:28333333", CreateQuotaKey("ns", perMinute, now))
+	require.Equal(t, CreateQuotaKey("K:ns:key", perMinute, now), CreateQuotaKey("K:ns:key", perMinute, now.Add(59*time.Second)), "same window")
+	require.NotEqual(t, CreateQuotaKey("K:ns:key", perMinute, now), CreateQuotaKey("K:ns:key", perMinute, now.Add(60*time.Second)), "next window")
+}
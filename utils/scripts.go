@@ -6,11 +6,59 @@ import "github.com/redis/go-redis/v9"
 // already exists. Returns the new value, or nil (redis.Nil) if the key was
 // missing. Collapses the prior EXISTS+INCRBY pair into one RTT and removes
 // the TOCTOU window between them.
+//
+// Any further KEYS are history buckets (see HistoryBuckets): each is bumped
+// by the same amount and given a TTL of ARGV[i] seconds, but only when the
+// counter exists, so a failed update never leaves orphan buckets behind.
 var IncrByIfExists = redis.NewScript(`
 if redis.call("EXISTS", KEYS[1]) == 0 then
   return nil
 end
-return redis.call("INCRBY", KEYS[1], ARGV[1])
+local v = redis.call("INCRBY", KEYS[1], ARGV[1])
+for i = 2, #KEYS do
+  redis.call("INCRBY", KEYS[i], ARGV[1])
+  redis.call("EXPIRE", KEYS[i], ARGV[i])
+end
+return v
+`)
+
+// CompareAndSwap sets KEYS[1] to ARGV[2] only if it currently holds ARGV[1],
+// keeping its TTL. Returns 1 if swapped, 0 if the value had changed (or the
+// key is gone).
+var CompareAndSwap = redis.NewScript(`
+if redis.call("GET", KEYS[1]) ~= ARGV[1] then
+  return 0
+end
+redis.call("SET", KEYS[1], ARGV[2], "KEEPTTL")
+return 1
+`)
+
+// IncrWithinLimits increments every KEYS[i], expiring it after ARGV[2i]
+// milliseconds if that created it, but only if each is still below its limit
+// ARGV[2i-1]; otherwise it changes nothing. Returns 1 if it incremented, 0 if
+// not, so no window is charged for a hit another refuses.
+var IncrWithinLimits = redis.NewScript(`
+for i, key in ipairs(KEYS) do
+  if tonumber(redis.call("GET", key) or "0") >= tonumber(ARGV[2 * i - 1]) then
+    return 0
+  end
+end
+for i, key in ipairs(KEYS) do
+  if redis.call("INCR", key) == 1 then
+    redis.call("PEXPIRE", key, ARGV[2 * i])
+  end
+end
+return 1
+`)
+
+// IncrWithTTL increments KEYS[1] and, if that created it, expires it after
+// ARGV[1] milliseconds. Returns the new value.
+var IncrWithTTL = redis.NewScript(`
+local v = redis.call("INCR", KEYS[1])
+if v == 1 then
+  redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+return v
 `)
 
 // CreateWithAdmin atomically creates the counter key and writes the admin key
@@ -0,0 +1,189 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/goccy/go-json"
+)
+
+// KeySettings are the owner-controlled options of a counter, stored as JSON
+// under S:{namespace}:{key}. Counters without a record get the zero value,
+// which changes nothing.
+type KeySettings struct {
+	// RequireSignature makes /hit reject hits without a valid signature (see
+	// SignHit) unless they carry a token with the hit scope.
+	RequireSignature bool `json:"require_signature,omitempty"`
+	// SigningKey is the hex HMAC secret hits are signed with, derived from an
+	// admin token by DeriveSigningKey. Never returned by the API.
+	SigningKey string `json:"signing_key,omitempty"`
+	// AllowedOrigins, when set, limits hits to requests whose Origin (or
+	// Referer) is one of these, e.g. "https://example.com", and narrows the
+	// key's CORS responses to them.
+	AllowedOrigins []string `json:"allowed_origins,omitempty"`
+	// HitQuota caps how fast the key can be hit, on top of the operator's
+	// HitQuotas. A claimed namespace's record, S:{namespace}, only uses this
+	// field, for all of its keys together.
+	HitQuota *HitQuota `json:"hit_quota,omitempty"`
+	// FilterBots stops hits from crawlers, link unfurlers and prefetches
+	// (see IsBot) from being counted. They still get the current value.
+	FilterBots bool `json:"filter_bots,omitempty"`
+	// Cooldown, in seconds, stops a visitor's hits from being counted again
+	// until that long after the last one that was, so refreshing a page
+	// doesn't count twice. Zero counts every hit.
+	Cooldown int64 `json:"cooldown,omitempty"`
+}
+
+// CooldownPeriod is s.Cooldown as a duration.
+func (s KeySettings) CooldownPeriod() time.Duration {
+	return time.Duration(s.Cooldown) * time.Second
+}
+
+// Quota is s.HitQuota, or no quota if it's unset.
+func (s KeySettings) Quota() HitQuota {
+	if s.HitQuota == nil {
+		return HitQuota{}
+	}
+	return *s.HitQuota
+}
+
+// MaxAllowedOrigins caps KeySettings.AllowedOrigins.
+const MaxAllowedOrigins = 20
+
+// AllowsOrigin reports whether a request from origin may hit the key. Every
+// origin may when there's no allowlist; none may when origin is unknown.
+func (s KeySettings) AllowsOrigin(origin string) bool {
+	if len(s.AllowedOrigins) == 0 {
+		return true
+	}
+	return origin != "" && slices.Contains(s.AllowedOrigins, origin)
+}
+
+// ParseAllowedOrigins validates a comma-separated origin list, normalizing
+// each entry to scheme://host[:port]. An empty list clears the allowlist.
+func ParseAllowedOrigins(raw string) ([]string, error) {
+	var origins []string
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		origin := originOf(entry)
+		if origin == "" {
+			return nil, errors.New("Invalid origin " + strconv.Quote(entry) + ". Origins look like https://example.com")
+		}
+		if !slices.Contains(origins, origin) {
+			origins = append(origins, origin)
+		}
+	}
+	if len(origins) > MaxAllowedOrigins {
+		return nil, errors.New("A key can allow at most " + strconv.Itoa(MaxAllowedOrigins) + " origins.")
+	}
+	return origins, nil
+}
+
+// RequestOrigin is the origin a request came from: its Origin header, or
+// failing that the origin of its Referer. "" if neither says.
+func RequestOrigin(c *gin.Context) string {
+	if origin := c.GetHeader("Origin"); origin != "" && origin != "null" {
+		return originOf(origin)
+	}
+	return originOf(c.GetHeader("Referer"))
+}
+
+// originOf returns the lowercased scheme://host[:port] of an http(s) URL, or
+// "" if raw isn't one.
+func originOf(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ""
+	}
+	return strings.ToLower(u.Scheme + "://" + u.Host)
+}
+
+// DecodeKeySettings parses a stored settings record. An empty record is the
+// zero value.
+func DecodeKeySettings(raw string) (KeySettings, error) {
+	var s KeySettings
+	if raw == "" {
+		return s, nil
+	}
+	err := json.Unmarshal([]byte(raw), &s)
+	return s, err
+}
+
+// Encode serializes s for the store.
+func (s KeySettings) Encode() (string, error) {
+	data, err := json.Marshal(s)
+	return string(data), err
+}
+
+// CreateSettingsKey maps a counter key to its settings record.
+func CreateSettingsKey(key string) string {
+	key = strings.TrimPrefix(key, "K:")
+	return "S:" + key
+}
+
+// SettingsCacheV caches settings records in front of the hit path, so
+// counters without settings (nearly all of them) cost a map lookup rather
+// than a Redis GET per hit. Writers Forget the key; other instances pick up
+// changes within the TTL.
+var SettingsCacheV = NewGetCache(5*time.Second, 100_000)
+
+// DeriveSigningKey derives a counter's hit-signing secret from an admin
+// token: HMAC-SHA256(token, "abacus-hit-signing:{namespace}:{key}"), hex
+// encoded. Owners holding the token can derive it themselves and sign links
+// without calling /sign.
+func DeriveSigningKey(adminToken, dbKey string) string {
+	mac := hmac.New(sha256.New, []byte(adminToken))
+	mac.Write([]byte("abacus-hit-signing:"))
+	mac.Write([]byte(strings.TrimPrefix(dbKey, "K:")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignHit returns the signature of a hit on dbKey valid until exp (unix
+// seconds): base64url(HMAC-SHA256(secret, "{namespace}:{key}:{exp}")), with
+// secret the decoded signing key.
+func SignHit(signingKey, dbKey string, exp int64) string {
+	secret, _ := hex.DecodeString(signingKey)
+	var sum [sha256.Size]byte
+	return base64.RawURLEncoding.EncodeToString(hitMAC(secret, dbKey, strconv.FormatInt(exp, 10), sum[:0]))
+}
+
+// VerifyHitSignature reports whether sig signs a hit on dbKey valid until
+// exp, and exp hasn't passed. Runs on every hit to a key that requires
+// signatures, so it sticks to stack buffers.
+func VerifyHitSignature(signingKey, dbKey, exp, sig string, now time.Time) bool {
+	expires, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || now.Unix() > expires {
+		return false
+	}
+	var secret, got, want [sha256.Size]byte
+	if len(signingKey) != hex.EncodedLen(sha256.Size) || len(sig) != base64.RawURLEncoding.EncodedLen(sha256.Size) {
+		return false
+	}
+	if _, err := hex.Decode(secret[:], []byte(signingKey)); err != nil {
+		return false
+	}
+	if _, err := base64.RawURLEncoding.Decode(got[:], []byte(sig)); err != nil {
+		return false
+	}
+	return hmac.Equal(hitMAC(secret[:], dbKey, exp, want[:0]), got[:])
+}
+
+func hitMAC(secret []byte, dbKey, exp string, buf []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strings.TrimPrefix(dbKey, "K:")))
+	mac.Write([]byte{':'})
+	mac.Write([]byte(exp))
+	return mac.Sum(buf)
+}
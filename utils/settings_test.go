@@ -0,0 +1,30 @@
+package utils
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHitSignatures(t *testing.T) {
+	const dbKey = "K:ns:downloads"
+	signingKey := DeriveSigningKey("admin-token", dbKey)
+	require.Equal(t, signingKey, DeriveSigningKey("admin-token", dbKey))
+	require.NotEqual(t, signingKey, DeriveSigningKey("admin-token", "K:ns:other"), "each key gets its own secret")
+
+	now := time.Now()
+	exp := now.Add(time.Hour).Unix()
+	sig := SignHit(signingKey, dbKey, exp)
+	expStr := strconv.FormatInt(exp, 10)
+	require.True(t, VerifyHitSignature(signingKey, dbKey, expStr, sig, now))
+
+	require.False(t, VerifyHitSignature(signingKey, "K:ns:other", expStr, sig, now), "bound to the key")
+	require.False(t, VerifyHitSignature(signingKey, dbKey, strconv.FormatInt(exp+1, 10), sig, now), "bound to the expiry")
+	require.False(t, VerifyHitSignature(DeriveSigningKey("rotated", dbKey), dbKey, expStr, sig, now))
+	require.False(t, VerifyHitSignature(signingKey, dbKey, expStr, sig, now.Add(2*time.Hour)), "expired")
+	require.False(t, VerifyHitSignature(signingKey, dbKey, expStr, sig[1:], now))
+	require.False(t, VerifyHitSignature(signingKey, dbKey, "", "", now))
+	require.False(t, VerifyHitSignature("", dbKey, expStr, sig, now), "a key without a signing key accepts nothing")
+}
@@ -1,8 +1,11 @@
 package utils
 
 import (
+	"errors"
 	"log"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -10,112 +13,342 @@ type ValueEvent struct {
 	Message       chan KeyValue
 	NewClients    chan KeyClientPair
 	ClosedClients chan KeyClientPair
-	TotalClients  map[string]map[chan int]bool
-	Mu            sync.RWMutex
+	// TotalClients maps a db key to the clients subscribed to it directly,
+	// whether alone or as part of a multi-key stream.
+	TotalClients map[string]map[chan KeyValue]bool
+	// NamespaceClients maps a namespace to the clients streaming every key
+	// in it.
+	NamespaceClients map[string]map[chan KeyValue]bool
+	Mu               sync.RWMutex
+
+	// subscriptions remembers what each client registered for, so closing a
+	// client only needs its channel. Only touched by listen.
+	subscriptions map[chan KeyValue]KeyClientPair
+
+	// bridge, when set, relays updates to and from other instances.
+	bridge atomic.Pointer[StreamBridge]
+
+	// throttles holds the state of clients that take at most one update per
+	// key per interval, and waiting those of them with updates held back.
+	// Only touched by listen.
+	throttles map[chan KeyValue]*throttle
+	waiting   map[chan KeyValue]*throttle
+	// pending counts the updates held back across all clients.
+	pending atomic.Int64
+
+	// Open connections admitted by Admit, per client IP and in total. These
+	// are counted from admission to Release, independent of listen.
+	admitMu   sync.Mutex
+	openByIP  map[string]int
+	open      int
+	peakPerIP int
 }
 
+// Admission errors returned by Admit.
+var (
+	ErrTooManyStreamsPerIP = errors.New("too many open streams from this IP")
+	ErrTooManyStreams      = errors.New("too many open streams on this server")
+)
+
+// KeyValue is a change to Key: its new Value, or Deleted when it was removed.
 type KeyValue struct {
-	Key   string
-	Value int
+	Key     string
+	Value   int
+	Deleted bool
+
+	scope deliveryScope
 }
 
+// deliveryScope narrows which subscribers an update reaches. Relayed updates
+// arrive once per matching pub/sub subscription (key channel and namespace
+// pattern separately), so each copy must only reach its own audience.
+type deliveryScope uint8
+
+const (
+	scopeAll deliveryScope = iota
+	scopeKeys
+	scopeNamespace
+)
+
+// KeyClientPair registers Client for updates, or unregisters it on
+// ClosedClients (where only Client matters). Set Key for a single-key stream,
+// Keys for a multi-key one, or Namespace for every key in a namespace.
+//
+// Interval, if set, coalesces updates to hot keys: the client gets at most
+// one update per key per Interval, carrying the latest value. SSE's
+// CoalesceWindow is the least every client gets.
 type KeyClientPair struct {
-	Key    string
-	Client chan int
+	Key       string
+	Keys      []string
+	Namespace string
+	Interval  time.Duration
+	Client    chan KeyValue
+}
+
+func (p KeyClientPair) dbKeys() []string {
+	if p.Key == "" {
+		return p.Keys
+	}
+	return append([]string{p.Key}, p.Keys...)
+}
+
+// NamespaceOf returns the namespace part of a K: db key.
+func NamespaceOf(dbKey string) string {
+	ns, _, _ := strings.Cut(strings.TrimPrefix(dbKey, "K:"), ":")
+	return ns
 }
 
 func NewValueEventServer() *ValueEvent {
 	event := &ValueEvent{
 		// Use buffered channels to prevent blocking
-		Message:       make(chan KeyValue, 20000),
-		NewClients:    make(chan KeyClientPair, 5000),
-		ClosedClients: make(chan KeyClientPair, 5000),
-		TotalClients:  make(map[string]map[chan int]bool),
+		Message:          make(chan KeyValue, 20000),
+		NewClients:       make(chan KeyClientPair, 5000),
+		ClosedClients:    make(chan KeyClientPair, 5000),
+		TotalClients:     make(map[string]map[chan KeyValue]bool),
+		NamespaceClients: make(map[string]map[chan KeyValue]bool),
+		subscriptions:    make(map[chan KeyValue]KeyClientPair),
+		throttles:        make(map[chan KeyValue]*throttle),
+		waiting:          make(map[chan KeyValue]*throttle),
+		openByIP:         make(map[string]int),
 	}
 	go event.listen()
 	return event
 }
 
+// throttleTick is how often held-back updates are checked for being due.
+const throttleTick = 10 * time.Millisecond
+
 func (v *ValueEvent) listen() {
+	var flush *time.Ticker
+	var flushC <-chan time.Time
 	for {
 		select {
 		case newClient := <-v.NewClients:
-			v.Mu.Lock()
-			if _, exists := v.TotalClients[newClient.Key]; !exists {
-				v.TotalClients[newClient.Key] = make(map[chan int]bool)
-			}
-			v.TotalClients[newClient.Key][newClient.Client] = true
-			v.Mu.Unlock()
-			log.Printf("Client added for key %s. Total clients: %d", newClient.Key, len(v.TotalClients[newClient.Key]))
+			v.addClient(newClient)
 
 		case closedClient := <-v.ClosedClients:
-			v.Mu.Lock()
-			if clients, exists := v.TotalClients[closedClient.Key]; exists {
-				if _, ok := clients[closedClient.Client]; ok {
-					delete(clients, closedClient.Client)
-
-					// Close channel safely
-					close(closedClient.Client)
-
-					log.Printf("Removed client for key %s", closedClient.Key)
-
-					// Clean up key map if no more clients
-					if len(clients) == 0 {
-						delete(v.TotalClients, closedClient.Key)
-						log.Printf("No more clients for key %s, removed key entry", closedClient.Key)
-					}
-				}
-			}
-			v.Mu.Unlock()
+			v.removeClient(closedClient.Client)
 
 		case keyValue := <-v.Message:
-			// First, get a snapshot of clients under read lock
-			v.Mu.RLock()
-			clients, exists := v.TotalClients[keyValue.Key]
-			if !exists || len(clients) == 0 {
-				v.Mu.RUnlock()
+			v.broadcast(keyValue)
+
+		case now := <-flushC:
+			v.flushThrottled(now)
+		}
+		// Tick only while updates are held back.
+		if len(v.waiting) > 0 && flush == nil {
+			flush = time.NewTicker(throttleTick)
+			flushC = flush.C
+		} else if len(v.waiting) == 0 && flush != nil {
+			flush.Stop()
+			flush, flushC = nil, nil
+		}
+	}
+}
+
+// broadcast sends keyValue to every client subscribed to it.
+func (v *ValueEvent) broadcast(keyValue KeyValue) {
+	// First, get a snapshot of clients under read lock
+	v.Mu.RLock()
+	var clientChannels []chan KeyValue
+	if keyValue.scope != scopeNamespace {
+		for clientChan := range v.TotalClients[keyValue.Key] {
+			clientChannels = append(clientChannels, clientChan)
+		}
+	}
+	if keyValue.scope != scopeKeys {
+		for clientChan := range v.NamespaceClients[NamespaceOf(keyValue.Key)] {
+			clientChannels = append(clientChannels, clientChan)
+		}
+	}
+	v.Mu.RUnlock()
+	if len(clientChannels) == 0 {
+		return
+	}
+
+	// Send messages without holding the lock, holding back updates that
+	// throttled clients aren't due yet.
+	now := time.Now()
+	for _, clientChan := range clientChannels {
+		if t := v.throttles[clientChan]; t != nil && !t.admit(v, keyValue, now) {
+			v.waiting[clientChan] = t
+			continue
+		}
+		v.send(clientChan, keyValue)
+	}
+}
+
+// send hands kv to client without blocking, scheduling the client's removal
+// if it has fallen too far behind. Reports whether kv was sent.
+func (v *ValueEvent) send(client chan KeyValue, kv KeyValue) bool {
+	select {
+	case client <- kv:
+		return true
+	default:
+	}
+	// Channel full, client is slow - schedule its removal
+	SSEClientDrops.Add(1)
+	select {
+	case v.ClosedClients <- KeyClientPair{Key: kv.Key, Client: client}:
+		// Client scheduled for removal
+	default:
+		// If ClosedClients channel is full, try again later
+		go func() {
+			time.Sleep(200 * time.Millisecond)
+			select {
+			case v.ClosedClients <- KeyClientPair{Key: kv.Key, Client: client}:
+				// Success on retry
+			default:
+				log.Printf("Failed to remove client for key %s even after retry", kv.Key)
+			}
+		}()
+	}
+	return false
+}
+
+// throttle is the state of a client taking at most one update per key per
+// interval: when each key may next be sent, and the latest value held back
+// for keys that aren't due yet.
+type throttle struct {
+	interval time.Duration
+	next     map[string]time.Time
+	held     map[string]KeyValue
+}
+
+// admit reports whether kv can be sent to the client now, holding it back
+// otherwise. Deletes always go straight through, dropping a value held back
+// for the key, so the client still sees them in order.
+func (t *throttle) admit(v *ValueEvent, kv KeyValue, now time.Time) bool {
+	_, held := t.held[kv.Key]
+	if kv.Deleted {
+		if held {
+			delete(t.held, kv.Key)
+			v.pending.Add(-1)
+		}
+		delete(t.next, kv.Key)
+		return true
+	}
+	if now.Before(t.next[kv.Key]) {
+		if held {
+			SSECoalesced.Add(1)
+		} else {
+			v.pending.Add(1)
+		}
+		t.held[kv.Key] = kv
+		return false
+	}
+	t.next[kv.Key] = now.Add(t.interval)
+	return true
+}
+
+// flushThrottled sends the held-back updates that are due.
+func (v *ValueEvent) flushThrottled(now time.Time) {
+	for client, t := range v.waiting {
+		for key, kv := range t.held {
+			if now.Before(t.next[key]) {
 				continue
 			}
+			delete(t.held, key)
+			v.pending.Add(-1)
+			t.next[key] = now.Add(t.interval)
+			if !v.send(client, kv) {
+				break // being removed
+			}
+		}
+		// Keys past their interval with nothing held are as good as new.
+		for key, next := range t.next {
+			if _, held := t.held[key]; !held && now.After(next) {
+				delete(t.next, key)
+			}
+		}
+		if len(t.held) == 0 {
+			delete(v.waiting, client)
+		}
+	}
+}
+
+// PendingUpdates returns the number of updates held back for throttled
+// clients.
+func (v *ValueEvent) PendingUpdates() int {
+	return int(v.pending.Load())
+}
 
-			// Create a safe copy of client channels
-			clientChannels := make([]chan int, 0, len(clients))
-			for clientChan := range clients {
-				clientChannels = append(clientChannels, clientChan)
+func (v *ValueEvent) addClient(p KeyClientPair) {
+	bridge := v.bridge.Load()
+	v.Mu.Lock()
+	defer v.Mu.Unlock()
+
+	if _, exists := v.subscriptions[p.Client]; exists {
+		return
+	}
+	v.subscriptions[p.Client] = p
+	if interval := max(p.Interval, SSE.CoalesceWindow); interval > 0 {
+		v.throttles[p.Client] = &throttle{interval: interval, next: make(map[string]time.Time), held: make(map[string]KeyValue)}
+	}
+	for _, key := range p.dbKeys() {
+		if _, exists := v.TotalClients[key]; !exists {
+			v.TotalClients[key] = make(map[chan KeyValue]bool)
+			if bridge != nil {
+				bridge.hint(bridgeHint{key: key})
 			}
-			v.Mu.RUnlock()
-
-			// Send messages without holding the lock
-			// Use non-blocking sends for better performance
-			var failedClients []chan int
-			for _, clientChan := range clientChannels {
-				select {
-				case clientChan <- keyValue.Value:
-					// Message sent successfully
-				default:
-					// Channel full, client is slow - mark for removal
-					SSEClientDrops.Add(1)
-					failedClients = append(failedClients, clientChan)
-				}
+		}
+		v.TotalClients[key][p.Client] = true
+		log.Printf("Client added for key %s. Total clients: %d", key, len(v.TotalClients[key]))
+	}
+	if p.Namespace != "" {
+		if _, exists := v.NamespaceClients[p.Namespace]; !exists {
+			v.NamespaceClients[p.Namespace] = make(map[chan KeyValue]bool)
+			if bridge != nil {
+				bridge.hint(bridgeHint{namespace: p.Namespace})
 			}
+		}
+		v.NamespaceClients[p.Namespace][p.Client] = true
+		log.Printf("Client added for namespace %s. Total clients: %d", p.Namespace, len(v.NamespaceClients[p.Namespace]))
+	}
+}
+
+// removeClient unregisters client from everything it subscribed to and
+// closes it. Unknown (already removed) clients are ignored.
+func (v *ValueEvent) removeClient(client chan KeyValue) {
+	bridge := v.bridge.Load()
+	v.Mu.Lock()
+	defer v.Mu.Unlock()
+
+	p, exists := v.subscriptions[client]
+	if !exists {
+		return
+	}
+	delete(v.subscriptions, client)
+	if t := v.throttles[client]; t != nil {
+		v.pending.Add(-int64(len(t.held)))
+		delete(v.throttles, client)
+		delete(v.waiting, client)
+	}
+	// Close channel safely: it's in no map any more, so no sender can find it.
+	close(client)
 
-			// Schedule removal of failed clients
-			for _, failedClient := range failedClients {
-				select {
-				case v.ClosedClients <- KeyClientPair{Key: keyValue.Key, Client: failedClient}:
-					// Client scheduled for removal
-				default:
-					// If ClosedClients channel is full, try again later
-					go func(key string, client chan int) {
-						time.Sleep(200 * time.Millisecond)
-						select {
-						case v.ClosedClients <- KeyClientPair{Key: key, Client: client}:
-							// Success on retry
-						default:
-							log.Printf("Failed to remove client for key %s even after retry", key)
-						}
-					}(keyValue.Key, failedClient)
-				}
+	for _, key := range p.dbKeys() {
+		clients := v.TotalClients[key]
+		delete(clients, client)
+		log.Printf("Removed client for key %s", key)
+		// Clean up key map if no more clients
+		if len(clients) == 0 {
+			delete(v.TotalClients, key)
+			if bridge != nil {
+				bridge.hint(bridgeHint{key: key})
 			}
+			log.Printf("No more clients for key %s, removed key entry", key)
+		}
+	}
+	if p.Namespace != "" {
+		clients := v.NamespaceClients[p.Namespace]
+		delete(clients, client)
+		if len(clients) == 0 {
+			delete(v.NamespaceClients, p.Namespace)
+			if bridge != nil {
+				bridge.hint(bridgeHint{namespace: p.Namespace})
+			}
+			log.Printf("No more clients for namespace %s, removed namespace entry", p.Namespace)
 		}
 	}
 }
@@ -130,6 +363,111 @@ func (v *ValueEvent) CountClientsForKey(key string) int {
 	return 0
 }
 
+func (v *ValueEvent) CountClientsForNamespace(namespace string) int {
+	v.Mu.RLock()
+	defer v.Mu.RUnlock()
+	return len(v.NamespaceClients[namespace])
+}
+
+// CountClients returns the number of connected clients, counting a
+// multi-key or namespace stream once.
+func (v *ValueEvent) CountClients() int {
+	v.Mu.RLock()
+	defer v.Mu.RUnlock()
+	return len(v.subscriptions)
+}
+
+// Admit reserves a connection slot for ip, enforcing SSE.MaxPerIP and
+// SSE.MaxConnections. Every successful Admit must be paired with a Release.
+func (v *ValueEvent) Admit(ip string) error {
+	cfg := SSE
+	v.admitMu.Lock()
+	defer v.admitMu.Unlock()
+
+	if cfg.MaxConnections > 0 && v.open >= cfg.MaxConnections {
+		SSERejectedGlobal.Add(1)
+		return ErrTooManyStreams
+	}
+	if cfg.MaxPerIP > 0 && v.openByIP[ip] >= cfg.MaxPerIP {
+		SSERejectedPerIP.Add(1)
+		return ErrTooManyStreamsPerIP
+	}
+	v.open++
+	v.openByIP[ip]++
+	if n := v.openByIP[ip]; n > v.peakPerIP {
+		v.peakPerIP = n
+	}
+	return nil
+}
+
+// Release frees a slot taken by Admit.
+func (v *ValueEvent) Release(ip string) {
+	v.admitMu.Lock()
+	defer v.admitMu.Unlock()
+
+	if v.openByIP[ip] <= 1 {
+		delete(v.openByIP, ip)
+	} else {
+		v.openByIP[ip]--
+	}
+	if v.open > 0 {
+		v.open--
+	}
+}
+
+// OpenConnections returns the number of admitted connections, in total and
+// from ip.
+func (v *ValueEvent) OpenConnections(ip string) (total, fromIP int) {
+	v.admitMu.Lock()
+	defer v.admitMu.Unlock()
+	return v.open, v.openByIP[ip]
+}
+
+// MaxConnectionsPerIP returns the most connections currently open from a
+// single IP, and the most ever open at once since startup.
+func (v *ValueEvent) MaxConnectionsPerIP() (current, peak int) {
+	v.admitMu.Lock()
+	defer v.admitMu.Unlock()
+	for _, n := range v.openByIP {
+		current = max(current, n)
+	}
+	return current, v.peakPerIP
+}
+
+// SSEConfig tunes the /stream endpoints.
+type SSEConfig struct {
+	// Retry is sent as the SSE retry: hint, the delay browsers wait before
+	// reconnecting a dropped stream. Zero leaves it to the browser.
+	Retry time.Duration
+	// Heartbeat is how often a ": ping" comment is sent, so proxies don't cut
+	// quiet streams and dead peers are noticed. Zero disables it.
+	Heartbeat time.Duration
+	// MaxLifetime closes connections older than this; browsers reconnect
+	// and resume. Zero means no limit.
+	MaxLifetime time.Duration
+	// IdleTimeout closes connections that got no update for this long.
+	// Heartbeats don't count. Zero means no limit.
+	IdleTimeout time.Duration
+	// MaxPerIP caps open streams from one client IP. Zero means no limit.
+	MaxPerIP int
+	// MaxConnections caps open streams on this instance. Zero means no limit.
+	MaxConnections int
+	// CoalesceWindow is the least interval between updates to one key on
+	// any stream, however hot the key; subscribers can ask for a longer one
+	// (KeyClientPair.Interval). Zero sends every update unless asked.
+	CoalesceWindow time.Duration
+}
+
+// SSE is the global config read by the /stream handlers; main re-initializes
+// it from the SSE_* env vars. It isn't guarded: set it once at startup,
+// before serving.
+var SSE = SSEConfig{Retry: 5 * time.Second, Heartbeat: 15 * time.Second, MaxLifetime: time.Hour, MaxPerIP: 20, MaxConnections: 20000}
+
+// InitSSE replaces the global SSE config.
+func InitSSE(cfg SSEConfig) {
+	SSE = cfg
+}
+
 // Global event server
 var ValueEventServer *ValueEvent
 
@@ -137,39 +475,32 @@ func init() {
 	ValueEventServer = NewValueEventServer()
 }
 
-// When you want to update a value and notify clients for a specific key
-func SetStream(dbKey string, newValue int) {
+// deliver queues kv for the local clients of its key.
+func (v *ValueEvent) deliver(kv KeyValue) {
 	// Use a non-blocking send with default case to prevent blocking
 	select {
-	case ValueEventServer.Message <- KeyValue{Key: dbKey, Value: newValue}:
+	case v.Message <- kv:
 		// Message sent successfully
 	default:
 		SSEMessageDrops.Add(1)
-		log.Printf("Warning: Message channel full, update for key %s dropped", dbKey)
+		log.Printf("Warning: Message channel full, update for key %s dropped", kv.Key)
 	}
 }
 
-func CloseStream(dbKey string) {
-	// First collect all channels to be closed while holding the lock
-	var channelsToClose []chan int
-
-	ValueEventServer.Mu.Lock()
-	if clients, exists := ValueEventServer.TotalClients[dbKey]; exists {
-		// Create a copy of all channels we need to close
-		for clientChan := range clients {
-			channelsToClose = append(channelsToClose, clientChan)
-		}
-		// Remove the entry from the map
-		delete(ValueEventServer.TotalClients, dbKey)
-	}
-	ValueEventServer.Mu.Unlock()
-
-	// Now close the channels after releasing the lock
-	for _, ch := range channelsToClose {
-		close(ch)
+// When you want to update a value and notify clients for a specific key.
+// With a StreamBridge attached, clients on other instances are notified too.
+func SetStream(dbKey string, newValue int) {
+	ValueEventServer.deliver(KeyValue{Key: dbKey, Value: newValue})
+	if b := ValueEventServer.bridge.Load(); b != nil {
+		b.Publish(dbKey, newValue)
 	}
+}
 
-	if len(channelsToClose) > 0 {
-		log.Printf("Closed all streams for key %s (%d clients)", dbKey, len(channelsToClose))
+// CloseStream tells dbKey's subscribers it was deleted. Single-key streams
+// end on it; multi-key and namespace streams report it and carry on.
+func CloseStream(dbKey string) {
+	ValueEventServer.deliver(KeyValue{Key: dbKey, Deleted: true})
+	if b := ValueEventServer.bridge.Load(); b != nil {
+		b.PublishClose(dbKey)
 	}
 }
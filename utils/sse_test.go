@@ -0,0 +1,86 @@
+package utils
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdmitCaps(t *testing.T) {
+	prev := SSE
+	defer InitSSE(prev)
+	InitSSE(SSEConfig{MaxPerIP: 2, MaxConnections: 3})
+	v := NewValueEventServer()
+
+	require.NoError(t, v.Admit("1.1.1.1"))
+	require.NoError(t, v.Admit("1.1.1.1"))
+	require.ErrorIs(t, v.Admit("1.1.1.1"), ErrTooManyStreamsPerIP)
+	require.NoError(t, v.Admit("2.2.2.2"))
+	require.ErrorIs(t, v.Admit("3.3.3.3"), ErrTooManyStreams)
+
+	current, peak := v.MaxConnectionsPerIP()
+	require.Equal(t, 2, current)
+	require.Equal(t, 2, peak)
+
+	v.Release("1.1.1.1")
+	v.Release("1.1.1.1")
+	total, fromIP := v.OpenConnections("1.1.1.1")
+	require.Equal(t, 1, total)
+	require.Zero(t, fromIP)
+	require.NoError(t, v.Admit("3.3.3.3"))
+
+	current, peak = v.MaxConnectionsPerIP()
+	require.Equal(t, 1, current)
+	require.Equal(t, 2, peak, "the peak survives the connections closing")
+}
+
+// A burst on one key reaches a throttled subscriber as its first and latest
+// values, while deletes keep their place between values. Other subscribers
+// still get every update.
+func TestThrottledClients(t *testing.T) {
+	v := NewValueEventServer()
+	throttled := make(chan KeyValue, 100)
+	unthrottled := make(chan KeyValue, 2000)
+	v.NewClients <- KeyClientPair{Keys: []string{"K:ns:hot", "K:ns:other"}, Interval: 50 * time.Millisecond, Client: throttled}
+	v.NewClients <- KeyClientPair{Key: "K:ns:hot", Client: unthrottled}
+	require.Eventually(t, func() bool { return v.CountClients() == 2 }, time.Second, 5*time.Millisecond)
+
+	coalesced := SSECoalesced.Load()
+	for i := 1; i <= 1000; i++ {
+		v.deliver(KeyValue{Key: "K:ns:hot", Value: i})
+	}
+	v.deliver(KeyValue{Key: "K:ns:other", Value: 1})
+	v.deliver(KeyValue{Key: "K:ns:other", Deleted: true})
+	v.deliver(KeyValue{Key: "K:ns:other", Value: 2})
+	v.deliver(KeyValue{Key: "K:ns:other", Value: 3})
+
+	receive := func(c chan KeyValue, n int) []KeyValue {
+		var got []KeyValue
+		for len(got) < n {
+			select {
+			case kv := <-c:
+				got = append(got, kv)
+			case <-time.After(time.Second):
+				t.Fatalf("only got %v", got)
+			}
+		}
+		return got
+	}
+	got := receive(throttled, 6)
+	require.Equal(t, []KeyValue{
+		{Key: "K:ns:hot", Value: 1},
+		{Key: "K:ns:other", Value: 1},
+		{Key: "K:ns:other", Deleted: true},
+		{Key: "K:ns:other", Value: 2},
+	}, got[:4])
+	require.ElementsMatch(t, []KeyValue{{Key: "K:ns:hot", Value: 1000}, {Key: "K:ns:other", Value: 3}}, got[4:])
+	require.Equal(t, int64(998), SSECoalesced.Load()-coalesced)
+	require.Eventually(t, func() bool { return v.PendingUpdates() == 0 }, time.Second, 5*time.Millisecond)
+	require.Len(t, receive(unthrottled, 1000), 1000)
+
+	// Past the interval, the next update goes straight through again.
+	time.Sleep(60 * time.Millisecond)
+	v.deliver(KeyValue{Key: "K:ns:hot", Value: 1001})
+	require.Equal(t, KeyValue{Key: "K:ns:hot", Value: 1001}, <-throttled)
+}
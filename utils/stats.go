@@ -9,7 +9,6 @@ import (
 	"time"
 
 	"github.com/goccy/go-json"
-	"github.com/redis/go-redis/v9"
 )
 
 const (
@@ -25,19 +24,25 @@ var (
 	StatsManager *StatManager
 )
 
+// StatsSink is where StatManager flushes its counts. store.CounterStore
+// satisfies it; it's declared here so utils doesn't import store.
+type StatsSink interface {
+	IncrByMany(ctx context.Context, deltas map[string]int64) error
+}
+
 // StatManager handles collecting and saving statistics
 type StatManager struct {
-	stats     *sync.Map     // Thread-safe map for path stats
-	pathCount atomic.Int64  // Number of unique paths being tracked
-	client    *redis.Client // Redis client for persistence
-	saveMutex sync.Mutex    // Mutex for thread-safe saves
+	stats     *sync.Map    // Thread-safe map for path stats
+	pathCount atomic.Int64 // Number of unique paths being tracked
+	sink      StatsSink    // Backing store for persistence
+	saveMutex sync.Mutex   // Mutex for thread-safe saves
 }
 
 // NewStatsManager creates a new stats manager
-func NewStatsManager(client *redis.Client) *StatManager {
+func NewStatsManager(sink StatsSink) *StatManager {
 	sm := &StatManager{
-		stats:  &sync.Map{},
-		client: client,
+		stats: &sync.Map{},
+		sink:  sink,
 	}
 
 	// Start background save timer
@@ -113,7 +118,7 @@ func (sm *StatManager) periodicHealthCheck() {
 	}
 }
 
-// saveStats saves current stats to Redis
+// saveStats saves current stats to the backing store
 func (sm *StatManager) saveStats(force bool) {
 	// Skip if total count is low and not forced
 	totalCount := atomic.LoadInt64(&Total)
@@ -131,9 +136,7 @@ func (sm *StatManager) saveStats(force bool) {
 		return // Nothing to save
 	}
 
-	ctx := context.Background()
-	pipe := sm.client.Pipeline()
-	pipe.IncrBy(ctx, "stats:Total", totalCopy)
+	deltas := map[string]int64{"stats:Total": totalCopy}
 
 	// Collect all path stats atomically
 	pathStats := make(map[string]int64)
@@ -143,13 +146,12 @@ func (sm *StatManager) saveStats(force bool) {
 		count := atomic.SwapInt64(value.(*int64), 0)
 		if count > 0 {
 			pathStats[path] = count
-			pipe.IncrBy(ctx, "stats:"+path, count)
+			deltas["stats:"+path] = count
 		}
 		return true
 	})
 
-	// Execute Redis pipeline
-	_, err := pipe.Exec(ctx)
+	err := sm.sink.IncrByMany(context.Background(), deltas)
 	if err != nil {
 		// On error, restore the values
 		log.Printf("Error saving stats: %v", err)
@@ -199,7 +201,7 @@ func (sm *StatManager) logStats() {
 }
 
 // InitializeStatsManager creates global stats manager
-func InitializeStatsManager(client *redis.Client) *StatManager {
-	StatsManager = NewStatsManager(client)
+func InitializeStatsManager(sink StatsSink) *StatManager {
+	StatsManager = NewStatsManager(sink)
 	return StatsManager
 }
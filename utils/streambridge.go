@@ -0,0 +1,326 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// StreamChannelPrefix + dbKey is the pub/sub channel a key's updates are
+	// relayed on, e.g. abacus:stream:K:ns:key.
+	StreamChannelPrefix = "abacus:stream:"
+
+	// Payloads are "<origin>|<value>" or "<origin>|close". The origin lets an
+	// instance ignore its own publishes, which it has already delivered.
+	streamCloseValue = "close"
+
+	// maxPublishBatch caps how many PUBLISHes share one pipeline.
+	maxPublishBatch = 256
+
+	// bridgeReconcileInterval is how often the subscription set is re-derived
+	// from ValueEvent's client map, repairing any hint dropped under load.
+	bridgeReconcileInterval = 30 * time.Second
+)
+
+// Bridge counters. Read by the Prometheus counter funcs in prometheus.go.
+var (
+	StreamBridgePublished atomic.Int64
+	StreamBridgeReceived  atomic.Int64
+	StreamBridgeDrops     atomic.Int64
+)
+
+type bridgeMessage struct {
+	key    string
+	value  int
+	closed bool
+}
+
+// bridgeHint names a key, or a namespace, whose local client count may have
+// crossed zero.
+type bridgeHint struct {
+	key       string
+	namespace string
+}
+
+// channel is the channel (for a key) or pattern (for a namespace) to
+// subscribe to.
+func (h bridgeHint) channel() string {
+	if h.namespace != "" {
+		return StreamChannelPrefix + "K:" + h.namespace + ":*"
+	}
+	return StreamChannelPrefix + h.key
+}
+
+// StreamBridge relays SetStream/CloseStream between instances over Redis
+// pub/sub, so a /stream client sees every change to its key no matter which
+// machine served the write.
+//
+// Only keys with local clients are subscribed, plus a pattern per namespace
+// with namespace-wide clients. ValueEvent hints the bridge whenever a key or
+// namespace gains its first client or loses its last one, and the bridge works
+// out the rest from the client maps themselves, so hints can be coalesced or
+// dropped without leaving a subscription behind for good.
+type StreamBridge struct {
+	client *redis.Client
+	events *ValueEvent
+	origin string
+	pubsub *redis.PubSub
+
+	outbox chan bridgeMessage
+	hints  chan bridgeHint
+
+	mu         sync.Mutex
+	subscribed map[string]bridgeHint // by channel or pattern
+}
+
+// InitStreamBridge starts relaying the global ValueEventServer through client
+// until ctx is done.
+func InitStreamBridge(ctx context.Context, client *redis.Client) *StreamBridge {
+	return NewStreamBridge(ctx, client, ValueEventServer)
+}
+
+// NewStreamBridge attaches a bridge to events and starts its goroutines.
+func NewStreamBridge(ctx context.Context, client *redis.Client, events *ValueEvent) *StreamBridge {
+	origin, err := GenerateRandomString(12)
+	if err != nil {
+		origin = strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	b := &StreamBridge{
+		client:     client,
+		events:     events,
+		origin:     origin,
+		pubsub:     client.Subscribe(ctx),
+		outbox:     make(chan bridgeMessage, 20000),
+		hints:      make(chan bridgeHint, 5000),
+		subscribed: make(map[string]bridgeHint),
+	}
+	events.bridge.Store(b)
+
+	go b.publishLoop(ctx)
+	go b.receiveLoop(ctx)
+	go b.subscriptionLoop(ctx)
+	return b
+}
+
+// Publish relays a new value for dbKey to the other instances.
+func (b *StreamBridge) Publish(dbKey string, value int) {
+	b.enqueue(bridgeMessage{key: dbKey, value: value})
+}
+
+// PublishClose relays a CloseStream for dbKey to the other instances.
+func (b *StreamBridge) PublishClose(dbKey string) {
+	b.enqueue(bridgeMessage{key: dbKey, closed: true})
+}
+
+func (b *StreamBridge) enqueue(msg bridgeMessage) {
+	select {
+	case b.outbox <- msg:
+	default:
+		StreamBridgeDrops.Add(1)
+	}
+}
+
+// hint tells the subscription loop that a local client count crossed zero.
+// Never blocks: listen must keep draining its own channels.
+func (b *StreamBridge) hint(h bridgeHint) {
+	select {
+	case b.hints <- h:
+	default:
+		// reconcile will pick it up.
+	}
+}
+
+// Subscribed reports whether dbKey's channel is currently subscribed.
+func (b *StreamBridge) Subscribed(dbKey string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.subscribed[bridgeHint{key: dbKey}.channel()]
+	return ok
+}
+
+// SubscribedNamespace reports whether namespace's pattern is currently
+// subscribed.
+func (b *StreamBridge) SubscribedNamespace(namespace string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.subscribed[bridgeHint{namespace: namespace}.channel()]
+	return ok
+}
+
+func (b *StreamBridge) publishLoop(ctx context.Context) {
+	batch := make([]bridgeMessage, 0, maxPublishBatch)
+	latest := make(map[string]int, maxPublishBatch) // key -> index of its pending value in batch
+	for {
+		batch = batch[:0]
+		clear(latest)
+		select {
+		case <-ctx.Done():
+			return
+		case msg := <-b.outbox:
+			batch = appendCoalesced(batch, latest, msg)
+		}
+	drain:
+		for len(batch) < maxPublishBatch {
+			select {
+			case msg := <-b.outbox:
+				batch = appendCoalesced(batch, latest, msg)
+			default:
+				break drain
+			}
+		}
+
+		pipe := b.client.Pipeline()
+		for _, msg := range batch {
+			payload := b.origin + "|" + streamCloseValue
+			if !msg.closed {
+				payload = b.origin + "|" + strconv.Itoa(msg.value)
+			}
+			pipe.Publish(ctx, StreamChannelPrefix+msg.key, payload)
+		}
+		if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, context.Canceled) {
+			StreamBridgeDrops.Add(int64(len(batch)))
+			log.Printf("stream bridge: publishing %d updates failed: %v", len(batch), err)
+			continue
+		}
+		StreamBridgePublished.Add(int64(len(batch)))
+	}
+}
+
+// appendCoalesced adds msg to batch, overwriting a pending value for the same
+// key instead: subscribers only care about the latest one. A close is never
+// coalesced away, and values after a close start a new entry.
+func appendCoalesced(batch []bridgeMessage, latest map[string]int, msg bridgeMessage) []bridgeMessage {
+	if !msg.closed {
+		if i, ok := latest[msg.key]; ok {
+			batch[i] = msg
+			return batch
+		}
+		latest[msg.key] = len(batch)
+	} else {
+		delete(latest, msg.key)
+	}
+	return append(batch, msg)
+}
+
+func (b *StreamBridge) receiveLoop(ctx context.Context) {
+	ch := b.pubsub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			_ = b.pubsub.Close()
+			return
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+			origin, value, found := strings.Cut(msg.Payload, "|")
+			if !found || origin == b.origin {
+				continue
+			}
+			StreamBridgeReceived.Add(1)
+			kv := KeyValue{Key: strings.TrimPrefix(msg.Channel, StreamChannelPrefix), scope: scopeKeys}
+			if msg.Pattern != "" {
+				kv.scope = scopeNamespace
+			}
+			if value == streamCloseValue {
+				kv.Deleted = true
+			} else {
+				n, err := strconv.Atoi(value)
+				if err != nil {
+					continue
+				}
+				kv.Value = n
+			}
+			b.events.deliver(kv)
+		}
+	}
+}
+
+func (b *StreamBridge) subscriptionLoop(ctx context.Context) {
+	ticker := time.NewTicker(bridgeReconcileInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case h := <-b.hints:
+			b.sync(ctx, h)
+		case <-ticker.C:
+			b.reconcile(ctx)
+		}
+	}
+}
+
+// sync subscribes or unsubscribes h's channel to match whether it has local
+// clients right now. Idempotent, so stale or repeated hints are harmless.
+func (b *StreamBridge) sync(ctx context.Context, h bridgeHint) {
+	var want bool
+	if h.namespace != "" {
+		want = b.events.CountClientsForNamespace(h.namespace) > 0
+	} else {
+		want = b.events.CountClientsForKey(h.key) > 0
+	}
+	channel := h.channel()
+
+	b.mu.Lock()
+	_, have := b.subscribed[channel]
+	b.mu.Unlock()
+	if want == have {
+		return
+	}
+
+	var err error
+	switch {
+	case want && h.namespace != "":
+		err = b.pubsub.PSubscribe(ctx, channel)
+	case want:
+		err = b.pubsub.Subscribe(ctx, channel)
+	case h.namespace != "":
+		err = b.pubsub.PUnsubscribe(ctx, channel)
+	default:
+		err = b.pubsub.Unsubscribe(ctx, channel)
+	}
+	if err != nil {
+		log.Printf("stream bridge: updating subscription for %s failed: %v", channel, err)
+		return
+	}
+
+	b.mu.Lock()
+	if want {
+		b.subscribed[channel] = h
+	} else {
+		delete(b.subscribed, channel)
+	}
+	b.mu.Unlock()
+}
+
+func (b *StreamBridge) reconcile(ctx context.Context) {
+	hints := make(map[string]bridgeHint)
+	b.events.Mu.RLock()
+	for dbKey := range b.events.TotalClients {
+		h := bridgeHint{key: dbKey}
+		hints[h.channel()] = h
+	}
+	for namespace := range b.events.NamespaceClients {
+		h := bridgeHint{namespace: namespace}
+		hints[h.channel()] = h
+	}
+	b.events.Mu.RUnlock()
+	b.mu.Lock()
+	for channel, h := range b.subscribed {
+		hints[channel] = h
+	}
+	b.mu.Unlock()
+
+	for _, h := range hints {
+		b.sync(ctx, h)
+	}
+}
@@ -0,0 +1,123 @@
+package utils
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/require"
+)
+
+// Two event servers bridged through the same Redis stand in for two
+// instances: a hit published on one must reach a client connected to the
+// other, and nothing may echo back to the publisher.
+func TestStreamBridgeRelaysBetweenInstances(t *testing.T) {
+	mr := miniredis.RunT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	newInstance := func() (*ValueEvent, *StreamBridge) {
+		events := NewValueEventServer()
+		client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+		t.Cleanup(func() { _ = client.Close() })
+		return events, NewStreamBridge(ctx, client, events)
+	}
+	eventsA, bridgeA := newInstance()
+	_, bridgeB := newInstance()
+
+	const dbKey = "K:ns:bridged"
+	clientChan := make(chan KeyValue, 10)
+	eventsA.NewClients <- KeyClientPair{Key: dbKey, Client: clientChan}
+	require.Eventually(t, func() bool {
+		return bridgeA.Subscribed(dbKey) && mr.PubSubNumSub(StreamChannelPrefix + dbKey)[StreamChannelPrefix+dbKey] == 1
+	}, 2*time.Second, 10*time.Millisecond)
+
+	bridgeB.Publish(dbKey, 7)
+	select {
+	case kv := <-clientChan:
+		require.Equal(t, KeyValue{Key: dbKey, Value: 7, scope: scopeKeys}, kv)
+	case <-time.After(2 * time.Second):
+		t.Fatal("update from the other instance never arrived")
+	}
+
+	// A's own publishes were already delivered locally and must be ignored.
+	bridgeA.Publish(dbKey, 8)
+	bridgeB.Publish(dbKey, 9)
+	select {
+	case kv := <-clientChan:
+		require.Equal(t, 9, kv.Value)
+	case <-time.After(2 * time.Second):
+		t.Fatal("update from the other instance never arrived")
+	}
+
+	bridgeB.PublishClose(dbKey)
+	select {
+	case kv := <-clientChan:
+		require.True(t, kv.Deleted)
+	case <-time.After(2 * time.Second):
+		t.Fatal("delete from the other instance never arrived")
+	}
+
+	eventsA.ClosedClients <- KeyClientPair{Client: clientChan}
+	require.Eventually(t, func() bool { return !bridgeA.Subscribed(dbKey) }, 2*time.Second, 10*time.Millisecond)
+}
+
+// A namespace-wide client is served by a pattern subscription. When the same
+// instance also has a client on one of the namespace's keys, each client must
+// still see every update exactly once.
+func TestStreamBridgeNamespaceSubscriptions(t *testing.T) {
+	mr := miniredis.RunT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	eventsA := NewValueEventServer()
+	clientA := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer clientA.Close()
+	bridgeA := NewStreamBridge(ctx, clientA, eventsA)
+	clientB := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer clientB.Close()
+	bridgeB := NewStreamBridge(ctx, clientB, NewValueEventServer())
+
+	nsChan := make(chan KeyValue, 10)
+	keyChan := make(chan KeyValue, 10)
+	eventsA.NewClients <- KeyClientPair{Namespace: "ns", Client: nsChan}
+	eventsA.NewClients <- KeyClientPair{Key: "K:ns:one", Client: keyChan}
+	require.Eventually(t, func() bool {
+		return bridgeA.SubscribedNamespace("ns") && bridgeA.Subscribed("K:ns:one") &&
+			mr.PubSubNumPat() == 1 && mr.PubSubNumSub("abacus:stream:K:ns:one")["abacus:stream:K:ns:one"] == 1
+	}, 2*time.Second, 10*time.Millisecond)
+
+	bridgeB.Publish("K:ns:one", 1)
+	bridgeB.Publish("K:ns:two", 2)
+	bridgeB.Publish("K:other:one", 3)
+
+	require.Equal(t, "K:ns:one", (<-nsChan).Key)
+	require.Equal(t, "K:ns:two", (<-nsChan).Key)
+	require.Equal(t, 1, (<-keyChan).Value)
+	time.Sleep(100 * time.Millisecond)
+	require.Empty(t, nsChan, "K:other:one is outside the namespace")
+	require.Empty(t, keyChan, "the pattern copy must not reach key subscribers")
+}
+
+func TestAppendCoalesced(t *testing.T) {
+	latest := map[string]int{}
+	var batch []bridgeMessage
+	for _, msg := range []bridgeMessage{
+		{key: "a", value: 1},
+		{key: "b", value: 1},
+		{key: "a", value: 2},
+		{key: "a", closed: true},
+		{key: "a", value: 3},
+		{key: "a", value: 4},
+	} {
+		batch = appendCoalesced(batch, latest, msg)
+	}
+	require.Equal(t, []bridgeMessage{
+		{key: "a", value: 2},
+		{key: "b", value: 1},
+		{key: "a", closed: true},
+		{key: "a", value: 4},
+	}, batch)
+}
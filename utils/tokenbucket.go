@@ -0,0 +1,115 @@
+package utils
+
+import (
+	"hash/maphash"
+	"math"
+	"sync"
+	"time"
+)
+
+// tokenBucketShards splits TokenBuckets so concurrent requests for different
+// clients rarely wait on the same lock.
+const tokenBucketShards = 64
+
+// TokenBuckets is an in-process rate limiter: one token bucket per key,
+// holding up to limit tokens and refilling limit of them per window. It
+// backs rate limiting when Redis can't, and filters out clients that are
+// already over the limit on this instance before Redis is asked at all.
+//
+// Memory is bounded: a shard that grows past its share of maxEntries drops
+// the buckets that have refilled (which are indistinguishable from new
+// ones), then arbitrary ones if that wasn't enough. Evicting a bucket can
+// only ever let a client through early, never block one.
+type TokenBuckets struct {
+	limit     float64
+	perSecond float64 // refill rate
+	window    time.Duration
+	maxShard  int
+	seed      maphash.Seed
+	shards    [tokenBucketShards]tokenBucketShard
+}
+
+type tokenBucketShard struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBuckets returns a limiter allowing limit requests per window for
+// each key, tracking at most about maxEntries keys.
+func NewTokenBuckets(limit uint, window time.Duration, maxEntries int) *TokenBuckets {
+	b := &TokenBuckets{
+		limit:     float64(limit),
+		perSecond: float64(limit) / window.Seconds(),
+		window:    window,
+		maxShard:  max(maxEntries/tokenBucketShards, 1),
+		seed:      maphash.MakeSeed(),
+	}
+	for i := range b.shards {
+		b.shards[i].buckets = make(map[string]*tokenBucket)
+	}
+	return b
+}
+
+// Take spends one of key's tokens if it has one. It returns whether it did,
+// the whole tokens left and when the bucket will next have a token to spend
+// (if it was out) or be full again (if not).
+func (b *TokenBuckets) Take(key string, now time.Time) (allowed bool, remaining uint, reset time.Time) {
+	shard := &b.shards[maphash.String(b.seed, key)%tokenBucketShards]
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	bucket, ok := shard.buckets[key]
+	if !ok {
+		if len(shard.buckets) >= b.maxShard {
+			b.evict(shard, now)
+		}
+		bucket = &tokenBucket{tokens: b.limit, last: now}
+		shard.buckets[key] = bucket
+	}
+	if elapsed := now.Sub(bucket.last).Seconds(); elapsed > 0 {
+		bucket.tokens = math.Min(b.limit, bucket.tokens+elapsed*b.perSecond)
+		bucket.last = now
+	}
+	if bucket.tokens < 1 {
+		return false, 0, now.Add(b.refillTime(1 - bucket.tokens))
+	}
+	bucket.tokens--
+	return true, uint(bucket.tokens), now.Add(b.refillTime(b.limit - bucket.tokens))
+}
+
+func (b *TokenBuckets) refillTime(tokens float64) time.Duration {
+	return time.Duration(math.Ceil(tokens / b.perSecond * float64(time.Second)))
+}
+
+// evict makes room in a full shard. The caller holds its lock.
+func (b *TokenBuckets) evict(shard *tokenBucketShard, now time.Time) {
+	for key, bucket := range shard.buckets {
+		if now.Sub(bucket.last) >= b.window { // refilled by now
+			delete(shard.buckets, key)
+		}
+	}
+	// Still full: every client here is active. Drop a tenth, at random
+	// thanks to map iteration order, rather than sweeping on every insert.
+	for key := range shard.buckets {
+		if len(shard.buckets) < b.maxShard*9/10 {
+			break
+		}
+		delete(shard.buckets, key)
+	}
+}
+
+// Len returns the number of keys being tracked.
+func (b *TokenBuckets) Len() int {
+	n := 0
+	for i := range b.shards {
+		b.shards[i].mu.Lock()
+		n += len(b.shards[i].buckets)
+		b.shards[i].mu.Unlock()
+	}
+	return n
+}
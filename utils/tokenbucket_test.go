@@ -0,0 +1,56 @@
+package utils
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenBuckets(t *testing.T) {
+	b := NewTokenBuckets(3, 3*time.Second, 1000)
+	now := time.Now()
+
+	for want := uint(2); ; want-- {
+		allowed, remaining, reset := b.Take("client", now)
+		require.True(t, allowed)
+		require.Equal(t, want, remaining)
+		require.Equal(t, now.Add(time.Duration(3-want)*time.Second), reset, "full again once the spent tokens refill")
+		if want == 0 {
+			break
+		}
+	}
+	allowed, remaining, reset := b.Take("client", now)
+	require.False(t, allowed)
+	require.Zero(t, remaining)
+	require.Equal(t, now.Add(time.Second), reset, "the next token comes after a second")
+
+	allowed, _, _ = b.Take("other", now)
+	require.True(t, allowed, "each key has its own bucket")
+
+	allowed, _, _ = b.Take("client", now.Add(time.Second))
+	require.True(t, allowed, "one token refilled")
+	allowed, _, _ = b.Take("client", now.Add(time.Second))
+	require.False(t, allowed)
+	allowed, remaining, _ = b.Take("client", now.Add(time.Hour))
+	require.True(t, allowed)
+	require.Equal(t, uint(2), remaining, "refills stop at the limit")
+}
+
+func TestTokenBucketsEviction(t *testing.T) {
+	b := NewTokenBuckets(1, time.Minute, 64*10)
+	now := time.Now()
+	for i := 0; i < 10_000; i++ {
+		b.Take(strconv.Itoa(i), now)
+	}
+	require.LessOrEqual(t, b.Len(), 64*10, "stays within maxEntries")
+
+	// Once refilled, the old buckets make room before any active one goes.
+	later := now.Add(time.Minute)
+	for i := 0; i < 100; i++ {
+		b.Take("new"+strconv.Itoa(i), later)
+	}
+	allowed, _, _ := b.Take("new0", later)
+	require.False(t, allowed, "recent buckets are kept")
+}
@@ -0,0 +1,195 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/google/uuid"
+)
+
+// Scopes a scoped token can be minted with. The counter's admin token (and a
+// claimed namespace's) implicitly holds all of them, plus ScopeAdmin.
+const (
+	ScopeRead   = "read"
+	ScopeHit    = "hit"
+	ScopeUpdate = "update"
+	ScopeSet    = "set"
+	ScopeDelete = "delete"
+
+	// ScopeAdmin guards token management. Only admin tokens hold it; it can't
+	// be granted to a scoped token.
+	ScopeAdmin = "admin"
+)
+
+// TokenScopes lists the scopes accepted by /tokens/create, in display order.
+var TokenScopes = []string{ScopeRead, ScopeHit, ScopeUpdate, ScopeSet, ScopeDelete}
+
+// MaxScopedTokens caps the live scoped tokens per counter.
+const MaxScopedTokens = 20
+
+// ScopedToken is one token in a counter's TokenSet. The token handed to the
+// client is "{id}.{secret}"; admin tokens are plain UUIDs and never contain a
+// dot, which is how Auth tells the two apart.
+type ScopedToken struct {
+	ID string `json:"id"`
+	// Secret is plaintext when minted and hashed with HashToken in the store.
+	Secret    string   `json:"secret,omitempty"`
+	Label     string   `json:"label,omitempty"`
+	Scopes    []string `json:"scopes"`
+	CreatedAt int64    `json:"created_at"`
+	ExpiresAt int64    `json:"expires_at,omitempty"` // unix seconds, 0 for never
+}
+
+// NewScopedToken mints a token with the given scopes, expiring after ttl (0
+// for never).
+func NewScopedToken(scopes []string, label string, ttl time.Duration) (ScopedToken, error) {
+	id, err := GenerateRandomString(12)
+	if err != nil {
+		return ScopedToken{}, err
+	}
+	now := time.Now()
+	t := ScopedToken{ID: id, Secret: uuid.New().String(), Label: label, Scopes: scopes, CreatedAt: now.Unix()}
+	if ttl > 0 {
+		t.ExpiresAt = now.Add(ttl).Unix()
+	}
+	return t, nil
+}
+
+// ParseScopes validates a comma-separated scope list, e.g. "update,set",
+// returning the scopes deduplicated and in TokenScopes order.
+func ParseScopes(raw string) ([]string, error) {
+	want := make(map[string]bool)
+	for _, scope := range strings.Split(raw, ",") {
+		scope = strings.TrimSpace(scope)
+		if scope == "" {
+			continue
+		}
+		if !slices.Contains(TokenScopes, scope) {
+			return nil, errors.New("Unknown scope " + scope + ". Use " + strings.Join(TokenScopes, ", ") + ".")
+		}
+		want[scope] = true
+	}
+	if len(want) == 0 {
+		return nil, errors.New("scopes is required, e.g. ?scopes=update,set")
+	}
+	scopes := make([]string, 0, len(want))
+	for _, scope := range TokenScopes {
+		if want[scope] {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes, nil
+}
+
+// Token is what the client presents: "{id}.{secret}".
+func (t ScopedToken) Token() string {
+	return t.ID + "." + t.Secret
+}
+
+// Expired reports whether t has expired at now. Expired tokens stay in their
+// TokenSet until it's next written.
+func (t ScopedToken) Expired(now time.Time) bool {
+	return t.ExpiresAt != 0 && now.Unix() >= t.ExpiresAt
+}
+
+// HasScope reports whether t was minted with scope.
+func (t ScopedToken) HasScope(scope string) bool {
+	return slices.Contains(t.Scopes, scope)
+}
+
+// TokenSet is the record stored under T:{namespace}:{key}: every scoped
+// token of the counter, so they're read, listed and revoked together.
+type TokenSet []ScopedToken
+
+// DecodeTokenSet parses a stored token set. A missing record ("") is empty.
+func DecodeTokenSet(raw string) (TokenSet, error) {
+	var tokens TokenSet
+	if raw == "" {
+		return tokens, nil
+	}
+	err := json.Unmarshal([]byte(raw), &tokens)
+	return tokens, err
+}
+
+// Encode serializes s for the store.
+func (s TokenSet) Encode() (string, error) {
+	data, err := json.Marshal(s)
+	return string(data), err
+}
+
+// Find returns the index of the token with id, or -1.
+func (s TokenSet) Find(id string) int {
+	return slices.IndexFunc(s, func(t ScopedToken) bool { return t.ID == id })
+}
+
+// Live returns a copy of s without the tokens that have expired at now.
+func (s TokenSet) Live(now time.Time) TokenSet {
+	return slices.DeleteFunc(append(TokenSet{}, s...), func(t ScopedToken) bool { return t.Expired(now) })
+}
+
+// Tokens are stored as "sha256$<salt>$<digest>", the digest being SHA-256
+// over the salt and the token. A fast hash is enough: tokens are random UUIDs,
+// far too much entropy to brute-force, so the salt only has to keep equal
+// tokens from hashing alike. Anything without the prefix is a legacy
+// plaintext token, upgraded the first time it's used.
+const tokenHashPrefix = "sha256$"
+
+// HashToken returns the at-rest form of token.
+func HashToken(token string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	return tokenHashPrefix + hex.EncodeToString(salt) + "$" + tokenDigest(salt, token), nil
+}
+
+func tokenDigest(salt []byte, token string) string {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write([]byte(token))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// VerifyToken reports whether token matches stored, the output of HashToken
+// or a legacy plaintext token, in constant time. legacy reports the latter,
+// so the caller can upgrade it.
+func VerifyToken(stored, token string) (ok, legacy bool) {
+	if stored == "" || token == "" {
+		return false, false
+	}
+	rest, hashed := strings.CutPrefix(stored, tokenHashPrefix)
+	if !hashed {
+		return subtle.ConstantTimeCompare([]byte(stored), []byte(token)) == 1, true
+	}
+	saltHex, digest, found := strings.Cut(rest, "$")
+	salt, err := hex.DecodeString(saltHex)
+	if !found || err != nil {
+		return false, false
+	}
+	return subtle.ConstantTimeCompare([]byte(tokenDigest(salt, token)), []byte(digest)) == 1, false
+}
+
+// SplitScopedToken splits a presented token into id and secret. ok is false
+// for anything that isn't shaped like a scoped token, e.g. an admin UUID.
+func SplitScopedToken(token string) (id, secret string, ok bool) {
+	id, secret, ok = strings.Cut(token, ".")
+	return id, secret, ok && ValidTokenID(id) && secret != ""
+}
+
+// ValidTokenID reports whether id could have been minted by NewScopedToken. A
+// colon would let the id address another key's tokens.
+func ValidTokenID(id string) bool {
+	return id != "" && !strings.Contains(id, ":")
+}
+
+// CreateTokenKey maps a counter key to its TokenSet, T:{namespace}:{key}.
+func CreateTokenKey(key string) string {
+	return "T:" + strings.TrimPrefix(key, "K:")
+}
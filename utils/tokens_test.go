@@ -0,0 +1,36 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHashToken(t *testing.T) {
+	const token = "5f1c7a52-3bd4-4c3e-9d4e-0d6b1f0f2a11"
+	a, err := HashToken(token)
+	require.NoError(t, err)
+	b, err := HashToken(token)
+	require.NoError(t, err)
+	require.NotContains(t, a, token)
+	require.NotEqual(t, a, b, "each hash gets its own salt")
+
+	for _, stored := range []string{a, b} {
+		ok, legacy := VerifyToken(stored, token)
+		require.True(t, ok)
+		require.False(t, legacy)
+		ok, _ = VerifyToken(stored, strings.ToUpper(token))
+		require.False(t, ok)
+	}
+
+	ok, legacy := VerifyToken(token, token)
+	require.True(t, ok, "plaintext records from before hashing still verify")
+	require.True(t, legacy)
+	ok, _ = VerifyToken(token, "other")
+	require.False(t, ok)
+	ok, _ = VerifyToken("", "")
+	require.False(t, ok, "a missing record never matches")
+	ok, _ = VerifyToken("sha256$zz$00", token)
+	require.False(t, ok)
+}
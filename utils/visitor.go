@@ -0,0 +1,59 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// visitorSalt is mixed into every visitor hash so the raw IP/User-Agent pair
+// never reaches Redis and the stored HLL registers can't be reversed with a
+// rainbow table of the IPv4 space. Pre-initialized with a random per-process
+// salt so handlers work before main runs; main replaces it with VISITOR_SALT.
+var (
+	visitorSaltMu sync.RWMutex
+	visitorSalt   = randomSalt()
+)
+
+func randomSalt() []byte {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatalf("failed to generate visitor salt: %v", err)
+	}
+	return b
+}
+
+// InitVisitorHasher sets the salt used by VisitorHash. An empty salt keeps the
+// random per-process default, which is fine for a single instance but means
+// unique counts restart from scratch on every deploy and double-count across
+// instances, so production should always set VISITOR_SALT.
+func InitVisitorHasher(salt string) {
+	if salt == "" {
+		log.Println("warn: VISITOR_SALT is not set; unique-visitor hashes are only stable for this process")
+		return
+	}
+	visitorSaltMu.Lock()
+	visitorSalt = []byte(salt)
+	visitorSaltMu.Unlock()
+}
+
+// VisitorHash returns a salted, truncated SHA-256 of the client IP and
+// User-Agent. 16 bytes is plenty for PFADD (HLL only looks at a 64-bit hash
+// of the member anyway) and keeps the member small on the wire.
+func VisitorHash(c *gin.Context) string {
+	visitorSaltMu.RLock()
+	h := sha256.New()
+	h.Write(visitorSalt)
+	visitorSaltMu.RUnlock()
+
+	h.Write([]byte(c.ClientIP()))
+	h.Write([]byte{0}) // separator so ("1.2.3.4", "5x") != ("1.2.3.45", "x")
+	h.Write([]byte(c.Request.UserAgent()))
+
+	var sum [sha256.Size]byte
+	return hex.EncodeToString(h.Sum(sum[:0])[:16])
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/goccy/go-json"
+	"github.com/gorilla/websocket"
+
+	"pkg.jsn.cam/abacus/middleware"
+	"pkg.jsn.cam/abacus/utils"
+)
+
+const (
+	// MaxWSSubscriptions caps the keys one socket can subscribe to.
+	MaxWSSubscriptions = MaxStreamKeys
+
+	wsMaxMessageSize = 1024
+	wsWriteTimeout   = 10 * time.Second
+)
+
+var errTooManySubscriptions = errors.New("at most " + strconv.Itoa(MaxWSSubscriptions) + " subscriptions per socket")
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	// The HTTP API allows every origin; the socket does too.
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// wsRequest is a client frame, e.g. {"op":"hit","key":"visits","id":"1"}.
+// Key defaults to the one in the URL and id is echoed back on the reply.
+type wsRequest struct {
+	ID  string `json:"id,omitempty"`
+	Op  string `json:"op"`
+	Key string `json:"key,omitempty"`
+}
+
+// wsMessage is a server frame: the reply to a request (same op and id), or a
+// "value"/"delete" update pushed for a subscribed key. Counted is set, to
+// false, only on the reply to a hit that wasn't counted, as on /hit.
+type wsMessage struct {
+	ID      string `json:"id,omitempty"`
+	Op      string `json:"op"`
+	Key     string `json:"key,omitempty"`
+	Value   *int64 `json:"value,omitempty"`
+	Counted *bool  `json:"counted,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// WebSocketView serves /ws/:namespace/*key, for clients that can't use
+// EventSource or want to hit and watch counters over one connection. Clients
+// send subscribe, unsubscribe, hit and get requests for keys in the
+// namespace; the key in the URL, if any, is subscribed straight away and used
+// for requests that don't name one.
+func WebSocketView(c *gin.Context) {
+	namespace := c.Param("namespace")
+	key := strings.Trim(c.Param("key"), "/")
+	if strings.Contains(key, "/") {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Route not found. Use /ws/:namespace or /ws/:namespace/:key instead."})
+		return
+	}
+	if _, err := utils.ResolveNamespace(c, namespace); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if key != "" {
+		if _, err := utils.ResolveKey(c, namespace, key); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	conn, err := wsUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		return // Upgrade has already written the error response
+	}
+	s := &wsSession{
+		c:         c,
+		conn:      conn,
+		namespace: namespace,
+		key:       key,
+		out:       make(chan wsMessage, 100),
+		done:      make(chan struct{}),
+		subs:      make(map[string]chan utils.KeyValue),
+	}
+	defer s.close()
+	go s.writeLoop()
+
+	if key != "" {
+		s.send(s.handle(wsRequest{Op: "subscribe"}))
+	}
+	s.readLoop()
+}
+
+// wsSession is one socket. Only readLoop touches c; everything sent to the
+// client goes through out, so writeLoop is the only writer.
+type wsSession struct {
+	c         *gin.Context
+	conn      *websocket.Conn
+	namespace string
+	key       string
+	out       chan wsMessage
+	done      chan struct{}
+
+	mu   sync.Mutex
+	subs map[string]chan utils.KeyValue // by db key
+}
+
+func (s *wsSession) readLoop() {
+	s.conn.SetReadLimit(wsMaxMessageSize)
+	// Pongs answer writeLoop's pings; a peer that stops answering is gone.
+	heartbeat := utils.SSE.Heartbeat
+	extend := func() {
+		if heartbeat > 0 {
+			_ = s.conn.SetReadDeadline(time.Now().Add(2 * heartbeat))
+		}
+	}
+	extend()
+	s.conn.SetPongHandler(func(string) error {
+		extend()
+		return nil
+	})
+
+	for {
+		_, data, err := s.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		extend()
+		var req wsRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			s.send(wsMessage{Op: "error", Error: "Invalid JSON: " + err.Error()})
+			continue
+		}
+		s.send(s.handle(req))
+	}
+}
+
+func (s *wsSession) writeLoop() {
+	heartbeat, stop := tickEvery(utils.SSE.Heartbeat)
+	defer stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case msg := <-s.out:
+			data, err := json.Marshal(msg)
+			if err != nil {
+				continue
+			}
+			_ = s.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			if err := s.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				_ = s.conn.Close()
+				return
+			}
+		case <-heartbeat:
+			if err := s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout)); err != nil {
+				_ = s.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// send queues msg for writeLoop, giving up once the session is closed.
+func (s *wsSession) send(msg wsMessage) {
+	select {
+	case s.out <- msg:
+	case <-s.done:
+	}
+}
+
+// handle runs one request and returns its reply.
+func (s *wsSession) handle(req wsRequest) wsMessage {
+	reply := wsMessage{ID: req.ID, Op: req.Op, Key: req.Key}
+	if reply.Key == "" {
+		reply.Key = s.key
+	}
+	if reply.Key == "" {
+		reply.Error = "key is required"
+		return reply
+	}
+	dbKey, err := utils.ResolveKey(s.c, s.namespace, reply.Key)
+	if err != nil {
+		reply.Error = err.Error()
+		return reply
+	}
+
+	switch req.Op {
+	case "hit":
+		if _, ok := middleware.Allow(s.c, middleware.PolicyHit); !ok {
+			reply.Error = "Too many requests."
+			return reply
+		}
+		// Tokens and signatures come from the URL the socket was opened with.
+		if settings, err := keySettings(dbKey); err != nil {
+			reply.Error = "Failed to get data. Try again later."
+			return reply
+		} else if msg := hitRejection(s.c, dbKey, settings); msg != "" {
+			reply.Error = msg
+			return reply
+		}
+		if counts, err := countsHit(s.c, dbKey); err != nil {
+			reply.Error = "Failed to get data. Try again later."
+			return reply
+		} else if !counts {
+			// Like /hit: the current value, marked as not counted.
+			val, _, err := cachedValue(dbKey)
+			if err != nil {
+				reply.Error = "Failed to get data. Try again later."
+				return reply
+			}
+			reply.Value = &val
+			reply.Counted = &counts
+			return reply
+		}
+		val, err := incrKey(dbKey)
+		if err != nil {
+			reply.Error = "Failed to get data. Try again later."
+			if errors.Is(err, errValueTooLarge) {
+				reply.Error = "Value is too large. Max value is " + strconv.Itoa(math.MaxInt)
+			}
+			return reply
+		}
+		reply.Value = &val
+	case "get":
+		val, notFound, err := cachedValue(dbKey)
+		switch {
+		case notFound:
+			reply.Error = "Key not found"
+		case err != nil:
+			reply.Error = "Failed to get data. Try again later."
+		default:
+			reply.Value = &val
+		}
+	case "subscribe":
+		switch err := s.subscribe(dbKey); {
+		case errors.Is(err, errTooManySubscriptions):
+			reply.Error = "A socket can subscribe to at most " + strconv.Itoa(MaxWSSubscriptions) + " keys."
+			return reply
+		case err != nil:
+			reply.Error = "Failed to subscribe. Try again later."
+			return reply
+		}
+		// Current value, if the key exists yet, like /stream's first event.
+		// Read past the micro-cache: updates are only pushed from here on.
+		raw, err := Store.Get(context.Background(), dbKey)
+		if val, convErr := strconv.ParseInt(raw, 10, 64); err == nil && convErr == nil {
+			reply.Value = &val
+		}
+	case "unsubscribe":
+		s.unsubscribe(dbKey)
+	default:
+		reply.Error = "Unknown op " + strconv.Quote(req.Op) + ". Use subscribe, unsubscribe, hit or get."
+	}
+	return reply
+}
+
+func (s *wsSession) subscribe(dbKey string) error {
+	s.mu.Lock()
+	if _, ok := s.subs[dbKey]; ok {
+		s.mu.Unlock()
+		return nil
+	}
+	if len(s.subs) >= MaxWSSubscriptions {
+		s.mu.Unlock()
+		return errTooManySubscriptions
+	}
+	clientChan := make(chan utils.KeyValue, 100)
+	s.subs[dbKey] = clientChan
+	s.mu.Unlock()
+
+	utils.ValueEventServer.NewClients <- utils.KeyClientPair{Key: dbKey, Client: clientChan}
+	go s.forward(dbKey, clientChan)
+	return nil
+}
+
+// forward pushes dbKey's updates to the client until the event server closes
+// clientChan.
+func (s *wsSession) forward(dbKey string, clientChan chan utils.KeyValue) {
+	for kv := range clientChan {
+		msg := wsMessage{Op: "delete", Key: shortKey(kv.Key)}
+		if !kv.Deleted {
+			val := int64(kv.Value)
+			msg.Op, msg.Value = "value", &val
+		}
+		s.send(msg)
+	}
+	// Still subscribed means the event server dropped us for falling behind.
+	// Hang up, as /stream does, rather than silently miss updates.
+	s.mu.Lock()
+	evicted := s.subs[dbKey] == clientChan
+	s.mu.Unlock()
+	if evicted {
+		log.Printf("WebSocket client fell behind on %s, closing", dbKey)
+		_ = s.conn.Close()
+	}
+}
+
+func (s *wsSession) unsubscribe(dbKey string) {
+	s.mu.Lock()
+	clientChan, ok := s.subs[dbKey]
+	delete(s.subs, dbKey)
+	s.mu.Unlock()
+	if ok {
+		unregisterClient(clientChan, dbKey)
+	}
+}
+
+func (s *wsSession) close() {
+	close(s.done)
+	s.mu.Lock()
+	subs := s.subs
+	s.subs = nil
+	s.mu.Unlock()
+	for dbKey, clientChan := range subs {
+		unregisterClient(clientChan, dbKey)
+	}
+	_ = s.conn.Close()
+}
+
+// unregisterClient asks the event server to drop clientChan. label
+// identifies it in logs.
+func unregisterClient(clientChan chan utils.KeyValue, label string) {
+	select {
+	case utils.ValueEventServer.ClosedClients <- utils.KeyClientPair{Client: clientChan}:
+	case <-time.After(500 * time.Millisecond):
+		log.Printf("Warning: Timed out sending cleanup signal for %s", label)
+	}
+}
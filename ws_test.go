@@ -0,0 +1,175 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func dialWS(t *testing.T, server *httptest.Server, path string) *websocket.Conn {
+	t.Helper()
+	return dialWSWithHeader(t, server, path, nil)
+}
+
+func dialWSWithHeader(t *testing.T, server *httptest.Server, path string, header http.Header) *websocket.Conn {
+	t.Helper()
+	conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+path, header)
+	require.NoError(t, err)
+	resp.Body.Close()
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func readWS(t *testing.T, conn *websocket.Conn) wsMessage {
+	t.Helper()
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+	var msg wsMessage
+	require.NoError(t, conn.ReadJSON(&msg))
+	return msg
+}
+
+func wsValue(v int64) *int64 { return &v }
+
+// One socket hits a counter; another subscribed through the URL sees it.
+func TestWebSocketHitAndSubscribe(t *testing.T) {
+	router := setupTestRouter()
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	watcher := dialWS(t, server, "/ws/wsns/counter")
+	assert.Equal(t, wsMessage{Op: "subscribe", Key: "counter"}, readWS(t, watcher), "no value until the key exists")
+	require.Eventually(t, func() bool { return countClientsForKey("K:wsns:counter") == 1 }, time.Second, 10*time.Millisecond)
+
+	hitter := dialWS(t, server, "/ws/wsns")
+	require.NoError(t, hitter.WriteJSON(wsRequest{ID: "1", Op: "hit", Key: "counter"}))
+	assert.Equal(t, wsMessage{ID: "1", Op: "hit", Key: "counter", Value: wsValue(1)}, readWS(t, hitter))
+	assert.Equal(t, wsMessage{Op: "value", Key: "counter", Value: wsValue(1)}, readWS(t, watcher))
+
+	require.NoError(t, hitter.WriteJSON(wsRequest{ID: "2", Op: "get", Key: "counter"}))
+	assert.Equal(t, wsMessage{ID: "2", Op: "get", Key: "counter", Value: wsValue(1)}, readWS(t, hitter))
+
+	// The URL key is the default; unsubscribing stops the updates.
+	require.NoError(t, watcher.WriteJSON(wsRequest{Op: "unsubscribe"}))
+	assert.Equal(t, wsMessage{Op: "unsubscribe", Key: "counter"}, readWS(t, watcher))
+	require.Eventually(t, func() bool { return countClientsForKey("K:wsns:counter") == 0 }, time.Second, 10*time.Millisecond)
+
+	watcher.Close()
+	hitter.Close()
+}
+
+func TestWebSocketErrors(t *testing.T) {
+	router := setupTestRouter()
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/ws/wsns/x", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code, "keys are validated before upgrading")
+
+	conn := dialWS(t, server, "/ws/wsns")
+	require.NoError(t, conn.WriteJSON(wsRequest{ID: "1", Op: "hit"}))
+	assert.Equal(t, wsMessage{ID: "1", Op: "hit", Error: "key is required"}, readWS(t, conn))
+
+	require.NoError(t, conn.WriteJSON(wsRequest{ID: "2", Op: "hit", Key: "no"}))
+	msg := readWS(t, conn)
+	assert.Contains(t, msg.Error, "Invalid key")
+	assert.Nil(t, msg.Value)
+
+	require.NoError(t, conn.WriteJSON(wsRequest{ID: "3", Op: "get", Key: "missing"}))
+	assert.Equal(t, wsMessage{ID: "3", Op: "get", Key: "missing", Error: "Key not found"}, readWS(t, conn))
+
+	require.NoError(t, conn.WriteJSON(wsRequest{ID: "4", Op: "incr", Key: "counter"}))
+	assert.Contains(t, readWS(t, conn).Error, "Unknown op")
+
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte("{")))
+	assert.Equal(t, "error", readWS(t, conn).Op)
+}
+
+// Hits over the socket pass the same settings checks as /hit, with the
+// socket's URL standing in for the hit's.
+func TestWebSocketHitSettings(t *testing.T) {
+	router := setupTestRouter()
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	code, body := doRequest(router, "POST", "/create/wssettings/signed", "")
+	require.Equal(t, http.StatusCreated, code)
+	adminKey := body["admin_key"].(string)
+	code, _ = doRequest(router, "POST", "/settings/wssettings/signed?require_signature=true", adminKey)
+	require.Equal(t, http.StatusOK, code)
+	code, body = doRequest(router, "POST", "/tokens/create/wssettings/signed?scopes=hit", adminKey)
+	require.Equal(t, http.StatusCreated, code)
+	hitToken := body["token"].(string)
+
+	conn := dialWS(t, server, "/ws/wssettings/signed")
+	readWS(t, conn) // subscribe
+	require.NoError(t, conn.WriteJSON(wsRequest{ID: "1", Op: "hit"}))
+	msg := readWS(t, conn)
+	assert.Contains(t, msg.Error, "signed hits")
+	assert.Nil(t, msg.Value)
+
+	conn = dialWS(t, server, "/ws/wssettings/signed?token="+hitToken)
+	readWS(t, conn)
+	require.NoError(t, conn.WriteJSON(wsRequest{ID: "1", Op: "hit"}))
+	assert.Equal(t, wsMessage{ID: "1", Op: "hit", Key: "signed", Value: wsValue(1)}, readWS(t, conn),
+		"a token with the hit scope stands in for a signature")
+}
+
+func TestWebSocketBotHits(t *testing.T) {
+	router := setupTestRouter()
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	code, body := doRequest(router, "POST", "/create/wsbots/visits", "")
+	require.Equal(t, http.StatusCreated, code)
+	adminKey := body["admin_key"].(string)
+	code, _ = doRequest(router, "POST", "/settings/wsbots/visits?filter_bots=true", adminKey)
+	require.Equal(t, http.StatusOK, code)
+
+	camo := http.Header{"User-Agent": {"github-camo (876de43e)"}}
+	conn := dialWSWithHeader(t, server, "/ws/wsbots", camo)
+	require.NoError(t, conn.WriteJSON(wsRequest{ID: "1", Op: "hit", Key: "visits"}))
+	notCounted := false
+	assert.Equal(t, wsMessage{ID: "1", Op: "hit", Key: "visits", Value: wsValue(0), Counted: &notCounted}, readWS(t, conn))
+
+	conn = dialWSWithHeader(t, server, "/ws/wsbots?token="+adminKey, camo)
+	require.NoError(t, conn.WriteJSON(wsRequest{ID: "2", Op: "hit", Key: "visits"}))
+	assert.Equal(t, wsMessage{ID: "2", Op: "hit", Key: "visits", Value: wsValue(1)}, readWS(t, conn),
+		"a token with the hit scope is trusted")
+}
+
+// A visitor is the same over the socket as over /hit: the IP and User-Agent
+// the socket was opened with.
+func TestWebSocketHitCooldown(t *testing.T) {
+	router := setupTestRouter()
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	code, _ := doRequest(router, "POST", "/create/wscooldown/visits?dedupe=1h", "")
+	require.Equal(t, http.StatusCreated, code)
+
+	notCounted := false
+	conn := dialWS(t, server, "/ws/wscooldown")
+	require.NoError(t, conn.WriteJSON(wsRequest{ID: "1", Op: "hit", Key: "visits"}))
+	assert.Equal(t, wsMessage{ID: "1", Op: "hit", Key: "visits", Value: wsValue(1)}, readWS(t, conn))
+	require.NoError(t, conn.WriteJSON(wsRequest{ID: "2", Op: "hit", Key: "visits"}))
+	assert.Equal(t, wsMessage{ID: "2", Op: "hit", Key: "visits", Value: wsValue(1), Counted: &notCounted}, readWS(t, conn))
+
+	conn = dialWS(t, server, "/ws/wscooldown")
+	require.NoError(t, conn.WriteJSON(wsRequest{ID: "3", Op: "hit", Key: "visits"}))
+	assert.Equal(t, wsMessage{ID: "3", Op: "hit", Key: "visits", Value: wsValue(1), Counted: &notCounted}, readWS(t, conn),
+		"reconnecting doesn't start a new cooldown")
+
+	dial := func(userAgent string) *websocket.Conn {
+		return dialWSWithHeader(t, server, "/ws/wscooldown", http.Header{"User-Agent": {userAgent}})
+	}
+	conn = dial("another browser")
+	require.NoError(t, conn.WriteJSON(wsRequest{ID: "4", Op: "hit", Key: "visits"}))
+	assert.Equal(t, wsMessage{ID: "4", Op: "hit", Key: "visits", Value: wsValue(2)}, readWS(t, conn))
+}